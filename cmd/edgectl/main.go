@@ -0,0 +1,137 @@
+// Command edgectl inspects and manages edge sites running the edge plugin,
+// through their admin and push APIs.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// A subcommand. Its setup defines its flags on a flag set, and returns the
+// function that runs it with the arguments left once they're parsed.
+type command struct {
+	usage string
+	help  string
+	setup func(fs *flag.FlagSet) func(args []string) error
+}
+
+// The subcommands by name, set up in init since some of them refer back to
+// their own usage.
+var commands map[string]command
+
+func init() {
+	commands = map[string]command{
+		"dump": {
+			usage: "dump ADMIN_URL",
+			help:  "print the service table of an edge site",
+			setup: dump,
+		},
+		"diff": {
+			usage: "diff ADMIN_URL ADMIN_URL",
+			help:  "print the entries only one of two edge sites has",
+			setup: diff,
+		},
+		"resolve": {
+			usage: "resolve [-alt M] [-hp M] [-client ID] ADMIN_URL SERVICE LAT LON",
+			help:  "simulate resolving a service for a client at the given coordinates",
+			setup: resolve,
+		},
+		"register": {
+			usage: "register [push flags] PUSH_URL SERVICE",
+			help:  "register a service for a site with an upstream",
+			setup: register,
+		},
+		"withdraw": {
+			usage: "withdraw [push flags] PUSH_URL SERVICE",
+			help:  "withdraw a service for a site from an upstream",
+			setup: withdraw,
+		},
+		"validate": {
+			usage: "validate COREFILE",
+			help:  "check every edge stanza in a Corefile",
+			setup: validate,
+		},
+	}
+}
+
+// The order commands are listed in the usage.
+var commandOrder = []string{"dump", "diff", "resolve", "register", "withdraw", "validate"}
+
+// The timeout of every request made to an edge site.
+const requestTimeout = 10 * time.Second
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, found := commands[flag.Arg(0)]
+	if !found {
+		fmt.Fprintf(os.Stderr, "edgectl: unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	fs := flag.NewFlagSet(flag.Arg(0), flag.ExitOnError)
+	run := cmd.setup(fs)
+	fs.Parse(flag.Args()[1:])
+	if err := run(fs.Args()); err != nil {
+		fmt.Fprintf(os.Stderr, "edgectl %s: %v\n", flag.Arg(0), err)
+		os.Exit(1)
+	}
+}
+
+// Prints the usage of every command.
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: edgectl COMMAND [ARGS...]")
+	fmt.Fprintln(os.Stderr)
+	for _, name := range commandOrder {
+		fmt.Fprintf(os.Stderr, "  %-60s %s\n", commands[name].usage, commands[name].help)
+	}
+}
+
+// Client flags shared by the commands that talk to an edge site over TLS.
+type tlsFlags struct {
+	cert, key, ca string
+}
+
+// Registers the TLS flags on a flag set.
+func (f *tlsFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.cert, "cert", "", "client certificate to present")
+	fs.StringVar(&f.key, "key", "", "key of the client certificate")
+	fs.StringVar(&f.ca, "ca", "", "CA to verify the edge site against")
+}
+
+// Creates an HTTP client configured with the TLS flags.
+func (f *tlsFlags) client() (*http.Client, error) {
+	cfg := &tls.Config{}
+	if f.cert != "" || f.key != "" {
+		cert, err := tls.LoadX509KeyPair(f.cert, f.key)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	if f.ca != "" {
+		pem, err := ioutil.ReadFile(f.ca)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", f.ca)
+		}
+		cfg.RootCAs = pool
+	}
+	return &http.Client{
+		Timeout:   requestTimeout,
+		Transport: &http.Transport{TLSClientConfig: cfg},
+	}, nil
+}
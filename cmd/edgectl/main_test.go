@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/optikon/coredns/plugin/edge"
+)
+
+func TestCommandFlags(t *testing.T) {
+	for _, name := range commandOrder {
+		cmd, found := commands[name]
+		if !found {
+			t.Errorf("Command %s is listed but not defined", name)
+			continue
+		}
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Setting up the flags of %s panicked: %v", name, r)
+				}
+			}()
+			fs := flag.NewFlagSet(name, flag.ContinueOnError)
+			fs.SetOutput(ioutil.Discard)
+			if cmd.setup(fs) == nil {
+				t.Errorf("Command %s has nothing to run", name)
+			}
+			if err := fs.Parse(nil); err != nil {
+				t.Errorf("Parsing the flags of %s failed: %v", name, err)
+			}
+		}()
+	}
+	if len(commandOrder) != len(commands) {
+		t.Errorf("Expected all %d commands to be listed, got %d", len(commands), len(commandOrder))
+	}
+}
+
+func TestResolveFlags(t *testing.T) {
+	fs := flag.NewFlagSet("resolve", flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	commands["resolve"].setup(fs)
+	args := []string{"-client", "10.0.0.1", "-key", "client.key", "http://localhost:8055", "svc", "1", "2"}
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if fs.NArg() != 4 {
+		t.Errorf("Expected 4 arguments left, got %v", fs.Args())
+	}
+}
+
+// Runs a push command against a test upstream, returning the batch it sent.
+func runPush(t *testing.T, name string, args ...string) edge.ServiceTableBatch {
+	var batch edge.ServiceTableBatch
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/batch" {
+			t.Errorf("Expected a push to /batch, got %s", r.URL.Path)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer s.Close()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(ioutil.Discard)
+	run := commands[name].setup(fs)
+	if err := fs.Parse(append(args, s.URL, "svc.default.svc.cluster.external")); err != nil {
+		t.Fatal(err)
+	}
+	if err := run(fs.Args()); err != nil {
+		t.Fatal(err)
+	}
+	return batch
+}
+
+func TestPushEvent(t *testing.T) {
+	batch := runPush(t, "register", "-id", "edge-1", "-ip", "10.0.0.1", "-lat", "42.36", "-lon", "-71.06")
+	if batch.Meta.ID != "edge-1" || !batch.Meta.IP.Equal(net.ParseIP("10.0.0.1")) || batch.Meta.GeoCoords.Lat != 42.36 || batch.Meta.GeoCoords.Lon != -71.06 {
+		t.Errorf("Unexpected site %+v", batch.Meta)
+	}
+	want := []edge.ServiceEvent{{Type: edge.Add, Service: "svc.default.svc.cluster.external"}}
+	if !reflect.DeepEqual(batch.Events, want) {
+		t.Errorf("Expected %+v, got %+v", want, batch.Events)
+	}
+
+	// The generation is only set when asked for.
+	batch = runPush(t, "withdraw", "-id", "edge-1", "-ip", "10.0.0.1", "-generation", "42")
+	want = []edge.ServiceEvent{{Type: edge.Delete, Service: "svc.default.svc.cluster.external", Generation: 42}}
+	if !reflect.DeepEqual(batch.Events, want) {
+		t.Errorf("Expected %+v, got %+v", want, batch.Events)
+	}
+}
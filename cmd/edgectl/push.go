@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/optikon/coredns/plugin/edge"
+)
+
+// Flags describing the site a service is registered for, and how to push it.
+type pushFlags struct {
+	tlsFlags
+	id, ip        string
+	lat, lon, alt float64
+	keyID, secret string
+	generation    uint64
+}
+
+// Registers the push flags on a flag set.
+func (f *pushFlags) register(fs *flag.FlagSet) {
+	f.tlsFlags.register(fs)
+	fs.StringVar(&f.id, "id", "", "ID of the site (required)")
+	fs.StringVar(&f.ip, "ip", "", "IP of the site (required)")
+	fs.Float64Var(&f.lat, "lat", 0, "latitude of the site")
+	fs.Float64Var(&f.lon, "lon", 0, "longitude of the site")
+	fs.Float64Var(&f.alt, "alt", 0, "altitude of the site in meters")
+	fs.StringVar(&f.keyID, "hmac-id", "", "ID of the HMAC key to sign the push with")
+	fs.StringVar(&f.secret, "hmac-secret", "", "base64 encoded secret of the HMAC key")
+	fs.Uint64Var(&f.generation, "generation", 0, "generation to stamp the event with, to order it among the site's own events (0 applies it regardless of them)")
+}
+
+// Registers a service for a site with an upstream.
+func register(fs *flag.FlagSet) func(args []string) error {
+	return pushEvent("register", edge.Add, fs)
+}
+
+// Withdraws a service for a site from an upstream.
+func withdraw(fs *flag.FlagSet) func(args []string) error {
+	return pushEvent("withdraw", edge.Delete, fs)
+}
+
+// Pushes a single event for a site as a batch.
+func pushEvent(name string, typ edge.ServiceEventType, fs *flag.FlagSet) func(args []string) error {
+	var pf pushFlags
+	pf.register(fs)
+	return func(args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s", commands[name].usage)
+		}
+		if pf.id == "" {
+			return fmt.Errorf("an -id is required")
+		}
+		ip := net.ParseIP(pf.ip)
+		if ip == nil {
+			return fmt.Errorf("a valid -ip is required")
+		}
+		site := edge.Site{ID: pf.id, IP: ip}
+		site.GeoCoords.Lat, site.GeoCoords.Lon, site.GeoCoords.Altitude = pf.lat, pf.lon, pf.alt
+		batch := edge.ServiceTableBatch{
+			Meta: site,
+			Events: []edge.ServiceEvent{{
+				Type:    typ,
+				Service: args[1],
+
+				// Events without a generation are always applied, and don't
+				// keep the site's own later events from being applied either.
+				Generation: pf.generation,
+			}},
+		}
+		body, err := json.Marshal(batch)
+		if err != nil {
+			return err
+		}
+		const path = "/batch"
+		req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(args[0], "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if pf.keyID != "" {
+			headers, err := edge.SignPush(pf.keyID, pf.secret, http.MethodPost, path, body)
+			if err != nil {
+				return err
+			}
+			for header, val := range headers {
+				req.Header.Set(header, val)
+			}
+		}
+		client, err := pf.client()
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("upstream responded with %s", resp.Status)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/optikon/coredns/plugin/edge"
+)
+
+// Simulates resolving a service for a client at the given coordinates, using
+// the same logic the edge site uses to answer DNS requests.
+func resolve(fs *flag.FlagSet) func(args []string) error {
+	var tf tlsFlags
+	tf.register(fs)
+	alt := fs.String("alt", "", "altitude of the client in meters")
+	hp := fs.String("hp", "", "horizontal precision of the client's location in meters")
+	clientID := fs.String("client", "", "client identity sites are stuck to, defaults to my IP")
+	return func(args []string) error {
+		if len(args) != 4 {
+			return fmt.Errorf("usage: %s", commands["resolve"].usage)
+		}
+		client, err := tf.client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		query.Set("service", args[1])
+		query.Set("lat", args[2])
+		query.Set("lon", args[3])
+		for name, val := range map[string]string{"alt": *alt, "hp": *hp, "key": *clientID} {
+			if val != "" {
+				query.Set(name, val)
+			}
+		}
+		res := edge.ResolveResult{}
+		if err := getJSON(client, strings.TrimSuffix(args[0], "/")+"/resolve?"+query.Encode(), &res); err != nil {
+			return err
+		}
+		for _, site := range res.Candidates {
+			marker := " "
+			if site.IP.Equal(res.Chosen.IP) && site.ID == res.Chosen.ID {
+				marker = "*"
+			}
+			fmt.Printf("%s %s\t%.4f\t%.4f\n", marker, siteName(site), site.GeoCoords.Lat, site.GeoCoords.Lon)
+		}
+		return nil
+	}
+}
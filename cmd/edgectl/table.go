@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/optikon/coredns/plugin/edge"
+)
+
+// Fetches and decodes a JSON document from an admin API endpoint.
+func getJSON(client *http.Client, url string, v interface{}) error {
+	resp, err := client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Fetches the service table of an edge site.
+func fetchTable(client *http.Client, adminURL string) (map[string][]edge.TableEntry, error) {
+	table := make(map[string][]edge.TableEntry)
+	err := getJSON(client, strings.TrimSuffix(adminURL, "/")+"/table", &table)
+	return table, err
+}
+
+// Returns the names of the services in a table in order.
+func sortedServices(table map[string][]edge.TableEntry) []string {
+	services := make([]string, 0, len(table))
+	for service := range table {
+		services = append(services, service)
+	}
+	sort.Strings(services)
+	return services
+}
+
+// Describes the site of an entry in a single column.
+func siteName(site edge.Site) string {
+	if site.ID != "" && site.ID != site.IP.String() {
+		return fmt.Sprintf("%s (%s)", site.ID, site.IP)
+	}
+	return site.IP.String()
+}
+
+// Prints the service table of an edge site.
+func dump(fs *flag.FlagSet) func(args []string) error {
+	var tf tlsFlags
+	tf.register(fs)
+	return func(args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s", commands["dump"].usage)
+		}
+		client, err := tf.client()
+		if err != nil {
+			return err
+		}
+		table, err := fetchTable(client, args[0])
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "SERVICE\tSITE\tLAT\tLON\tUPDATED\tEXPIRES")
+		for _, service := range sortedServices(table) {
+			for _, entry := range table[service] {
+				expires := "-"
+				if entry.Expires != nil {
+					expires = entry.Expires.Format("15:04:05")
+				}
+				fmt.Fprintf(w, "%s\t%s\t%.4f\t%.4f\t%s\t%s\n", service, siteName(entry.Site),
+					entry.Site.GeoCoords.Lat, entry.Site.GeoCoords.Lon, entry.Updated.Format("15:04:05"), expires)
+			}
+		}
+		return w.Flush()
+	}
+}
+
+// Prints the entries that only one of two edge sites has. Sites are compared
+// by ID and IP, so differing coordinates for the same site aren't reported.
+func diff(fs *flag.FlagSet) func(args []string) error {
+	var tf tlsFlags
+	tf.register(fs)
+	return func(args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("usage: %s", commands["diff"].usage)
+		}
+		client, err := tf.client()
+		if err != nil {
+			return err
+		}
+		a, err := fetchTable(client, args[0])
+		if err != nil {
+			return err
+		}
+		b, err := fetchTable(client, args[1])
+		if err != nil {
+			return err
+		}
+		names := func(entries []edge.TableEntry) map[string]bool {
+			set := make(map[string]bool, len(entries))
+			for _, entry := range entries {
+				set[siteName(entry.Site)] = true
+			}
+			return set
+		}
+		all := make(map[string][]edge.TableEntry, len(a)+len(b))
+		for service := range a {
+			all[service] = nil
+		}
+		for service := range b {
+			all[service] = nil
+		}
+		differ := false
+		for _, service := range sortedServices(all) {
+			inA, inB := names(a[service]), names(b[service])
+			for _, site := range sortedKeys(inA) {
+				if !inB[site] {
+					fmt.Printf("- %s %s\n", service, site)
+					differ = true
+				}
+			}
+			for _, site := range sortedKeys(inB) {
+				if !inA[site] {
+					fmt.Printf("+ %s %s\n", service, site)
+					differ = true
+				}
+			}
+		}
+		if differ {
+			os.Exit(1)
+		}
+		return nil
+	}
+}
+
+// Returns the keys of a set in order.
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
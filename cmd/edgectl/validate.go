@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/mholt/caddy"
+	"github.com/mholt/caddy/caddyfile"
+
+	"github.com/optikon/coredns/plugin/edge"
+)
+
+// Checks every edge stanza in a Corefile with the same parsing logic the
+// plugin runs on startup.
+func validate(fs *flag.FlagSet) func(args []string) error {
+	return func(args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s", commands["validate"].usage)
+		}
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		// The edge plugin is compiled into custom builds only, so it isn't one
+		// of the stock directives.
+		directives := append([]string{"edge"}, dnsserver.Directives...)
+		blocks, err := caddyfile.Parse(args[0], f, directives)
+		if err != nil {
+			return err
+		}
+		found := 0
+		for _, block := range blocks {
+			tokens, ok := block.Tokens["edge"]
+			if !ok {
+				continue
+			}
+			found++
+			c := &caddy.Controller{Dispenser: caddyfile.NewDispenserTokens(args[0], tokens)}
+			if err := edge.ValidateConfig(c); err != nil {
+				return fmt.Errorf("server block %v: %v", block.Keys, err)
+			}
+		}
+		if found == 0 {
+			return fmt.Errorf("no edge stanza found in %s", args[0])
+		}
+		fmt.Printf("%d edge stanza(s) OK\n", found)
+		return nil
+	}
+}
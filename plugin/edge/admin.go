@@ -0,0 +1,189 @@
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const defaultAdminAddr = ":8055"
+
+// SiteStatus is what I know about a downstream edge site.
+type SiteStatus struct {
+	Site     Site       `json:"site"`
+	Services []string   `json:"services"`
+	Lease    *time.Time `json:"lease_expires,omitempty"`
+	Feed     bool       `json:"feed"`
+}
+
+// ResolveResult is how a request for a service from a given location would be
+// resolved from my table.
+type ResolveResult struct {
+	Chosen     Site   `json:"chosen"`
+	Candidates []Site `json:"candidates"`
+}
+
+// UpstreamStatus is the health of an upstream and its push connection.
+type UpstreamStatus struct {
+	Addr     string `json:"addr"`
+	Fails    uint32 `json:"fails"`
+	Down     bool   `json:"down"`
+	PushURL  string `json:"push_url"`
+	Outbox   int    `json:"outbox"`
+	Session  bool   `json:"session"`
+	Pipeline bool   `json:"pipeline"`
+}
+
+// Start serving the read-only admin API.
+func (e *Edge) startServingAdmin() {
+	if e.adminAddr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/table", e.adminHandler(func() interface{} { return e.table.Entries() }))
+	mux.HandleFunc("/services", e.adminHandler(func() interface{} {
+		services := e.localServices()
+		sort.Strings(services)
+		return services
+	}))
+	mux.HandleFunc("/sites", e.adminHandler(func() interface{} { return e.siteStatuses() }))
+	mux.HandleFunc("/upstreams", e.adminHandler(func() interface{} { return e.upstreamStatuses() }))
+	mux.HandleFunc("/resolve", e.adminResolve)
+	e.adminServer = &http.Server{Addr: e.adminAddr, Handler: mux}
+	go func() {
+		if err := e.adminServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Errorf("admin ListenAndServe error: %s", err)
+		}
+	}()
+}
+
+// Stop serving the admin API.
+func (e *Edge) stopServingAdmin() {
+	if e.adminServer != nil {
+		e.adminServer.Shutdown(context.Background())
+	}
+}
+
+// Wraps a function returning the state to show in a GET-only JSON handler.
+func (e *Edge) adminHandler(state func() interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(state()); err != nil {
+			log.Errorf("unable to write admin response: %v", err)
+		}
+	}
+}
+
+// Simulates the resolution of a service for a client at the given location,
+// as in /resolve?service=my-svc.my-namespace.svc.cluster.external&lat=1&lon=2.
+// The optional alt and hp parameters give the client's altitude and precision
+// in meters, and key the client identity used to pick among equally close sites.
+func (e *Edge) adminResolve(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	var from Location
+	for _, param := range []struct {
+		name     string
+		val      *float64
+		required bool
+	}{
+		{"lat", &from.Lat, true},
+		{"lon", &from.Lon, true},
+		{"alt", &from.Altitude, false},
+		{"hp", &from.Precision, false},
+	} {
+		raw := query.Get(param.name)
+		if raw == "" && !param.required {
+			continue
+		}
+		val, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			http.Error(w, "invalid "+param.name, http.StatusBadRequest)
+			return
+		}
+		*param.val = val
+	}
+	key := query.Get("key")
+	if key == "" {
+		key, _, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	index, found := e.table.lookupIndex(query.Get("service"))
+	if !found {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	res := findClosest(index, from, key)
+	if len(res.Candidates) == 0 {
+		http.Error(w, "service not found", http.StatusNotFound)
+		return
+	}
+	e.adminHandler(func() interface{} {
+		return ResolveResult{Chosen: res.Candidates[res.Chosen], Candidates: res.Candidates}
+	})(w, r)
+}
+
+// Returns the status of every downstream edge site that pushed its services
+// to me, held a lease, or is registered for a feed.
+func (e *Edge) siteStatuses() []SiteStatus {
+	own := hashOf(e.site)
+	statuses := make(map[uint64]*SiteStatus)
+	status := func(hash uint64, site Site) *SiteStatus {
+		s, found := statuses[hash]
+		if !found {
+			s = &SiteStatus{Site: site, Services: []string{}}
+			statuses[hash] = s
+		}
+		return s
+	}
+	for hash, entries := range e.table.Sites() {
+		if hash != own {
+			s := status(hash, entries.Meta)
+			s.Services = entries.Services
+			sort.Strings(s.Services)
+		}
+	}
+	for hash, l := range e.leases.Leases() {
+		expires := l.expires
+		status(hash, l.site).Lease = &expires
+	}
+	for hash, site := range e.children.list() {
+		status(hash, site).Feed = true
+	}
+	list := make([]SiteStatus, 0, len(statuses))
+	for _, s := range statuses {
+		list = append(list, *s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Site.IP.String() < list[j].Site.IP.String() })
+	return list
+}
+
+// Returns the status of every upstream.
+func (e *Edge) upstreamStatuses() []UpstreamStatus {
+	list := make([]UpstreamStatus, len(e.proxies))
+	for i, p := range e.proxies {
+		list[i] = UpstreamStatus{
+			Addr:     p.addr,
+			Fails:    atomic.LoadUint32(&p.fails),
+			Down:     p.Down(e.maxUpstreamFails),
+			PushURL:  p.pushAddr,
+			Outbox:   p.outbox.Len(),
+			Session:  p.session.Up(),
+			Pipeline: p.pipeline != nil,
+		}
+	}
+	return list
+}
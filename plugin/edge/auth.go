@@ -0,0 +1,210 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+)
+
+const (
+	// The headers carrying the HMAC signature of a push.
+	keyIDHeader     = "X-Edge-Key-Id"
+	timestampHeader = "X-Edge-Timestamp"
+	signatureHeader = "X-Edge-Signature"
+
+	// The allowed clock skew between signing and verifying edge sites.
+	hmacFudge = 5 * time.Minute
+
+	// The method and path signed when opening a gRPC session.
+	sessionMethod = "GRPC"
+	sessionPath   = "/edge.Edge/Session"
+)
+
+// hmacKey is a shared secret used to sign pushes between edge sites that
+// don't have certificates.
+type hmacKey struct {
+	id     string
+	secret []byte
+}
+
+// Creates a new HMAC key from its base64 encoded secret.
+func newHmacKey(id, secret string) (*hmacKey, error) {
+	b, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		return nil, errInvalidHmacSecret
+	}
+	return &hmacKey{id: id, secret: b}, nil
+}
+
+// Computes the signature over a push: its method, path, timestamp and body.
+func (k *hmacKey) signature(method, path, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, k.secret)
+	mac.Write([]byte(method + "\n" + path + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Returns the headers carrying the signature over a push made now.
+func (k *hmacKey) sign(method, path string, body []byte) map[string]string {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	return map[string]string{
+		keyIDHeader:     k.id,
+		timestampHeader: timestamp,
+		signatureHeader: k.signature(method, path, timestamp, body),
+	}
+}
+
+// SignPush returns the headers carrying the signature over a push made now
+// with the given key, for clients outside of this plugin.
+func SignPush(keyID, secret, method, path string, body []byte) (map[string]string, error) {
+	key, err := newHmacKey(keyID, secret)
+	if err != nil {
+		return nil, err
+	}
+	return key.sign(method, path, body), nil
+}
+
+// Verifies the signature over a push, returning the ID of the key it was
+// signed with.
+func (e *Edge) verifyHmac(keyID, timestamp, signature, method, path string, body []byte) (string, error) {
+	key, found := e.hmacKeys[keyID]
+	if !found {
+		return "", errUnknownHmacKey
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errInvalidHmacSignature
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > hmacFudge || skew < -hmacFudge {
+		return "", errInvalidHmacSignature
+	}
+	expected := key.signature(method, path, timestamp, body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", errInvalidHmacSignature
+	}
+	return keyID, nil
+}
+
+// The context key the identity of an authenticated edge site is stored under.
+type identityKey struct{}
+
+// Returns the identity of the edge site a push came from: the common name of
+// its client certificate, or the ID of the key it signed the push with.
+// Empty if pushes aren't authenticated.
+func identityFrom(ctx context.Context) string {
+	id, _ := ctx.Value(identityKey{}).(string)
+	return id
+}
+
+// Returns the common name of a verified client certificate, if there is one.
+func certIdentity(state *tls.ConnectionState) (string, bool) {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName, true
+}
+
+// Returns true if pushes have to be authenticated.
+func (e *Edge) authRequired() bool {
+	return e.pushTLS || len(e.hmacKeys) > 0
+}
+
+// Wraps a handler so it only serves pushes from authenticated edge sites,
+// passing on their identity in the request context.
+func (e *Edge) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	if !e.authRequired() {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if id, ok := certIdentity(r.TLS); ok {
+			next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		id, err := e.verifyHmac(r.Header.Get(keyIDHeader), r.Header.Get(timestampHeader),
+			r.Header.Get(signatureHeader), r.Method, r.URL.Path, body)
+		if err != nil {
+			log.Errorf("rejected push from %s: %v", r.RemoteAddr, err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		next(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	}
+}
+
+// hmacCredentials signs the opening of every gRPC session with an HMAC key.
+type hmacCredentials struct {
+	key    *hmacKey
+	secure bool
+}
+
+// GetRequestMetadata returns the signature over a session opened now.
+func (c hmacCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return c.key.sign(sessionMethod, sessionPath, nil), nil
+}
+
+// RequireTransportSecurity returns true if the session is also secured by TLS.
+func (c hmacCredentials) RequireTransportSecurity() bool { return c.secure }
+
+// Authenticates the edge site that opened a gRPC session, returning its identity.
+func (e *Edge) authenticateSession(ctx context.Context) (string, error) {
+	if !e.authRequired() {
+		return "", nil
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			if id, ok := certIdentity(&info.State); ok {
+				return id, nil
+			}
+		}
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	get := func(header string) string {
+		if vals := md.Get(header); len(vals) > 0 {
+			return vals[0]
+		}
+		return ""
+	}
+	return e.verifyHmac(get(keyIDHeader), get(timestampHeader), get(signatureHeader), sessionMethod, sessionPath, nil)
+}
+
+// Builds the TLS config the push listener is served with, which verifies the
+// client certificates of downstream edge sites against the CA given to tls.
+// Sites without a certificate are still let in if HMAC keys are configured,
+// as long as they sign their pushes.
+func (e *Edge) pushServerTLSConfig() *tls.Config {
+	cfg := &tls.Config{
+		Certificates: e.tlsConfig.Certificates,
+		ClientCAs:    e.tlsConfig.RootCAs,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}
+	if len(e.hmacKeys) > 0 {
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg
+}
+
+// Checks that the tls arguments include a certificate, key and CA, which are
+// all needed to both serve and make pushes over TLS.
+func validatePushTLSConfig(cfg *tls.Config) error {
+	if len(cfg.Certificates) == 0 || cfg.RootCAs == nil {
+		return errPushTLSConfig
+	}
+	return nil
+}
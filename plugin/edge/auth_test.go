@@ -0,0 +1,26 @@
+package edge
+
+import (
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestGrpcHmacSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"grpc", false},
+		{"hmac_sign a c2VjcmV0", false},
+		{"grpc\nhmac_sign a c2VjcmV0", true},
+		{"grpc\nhmac_key a c2VjcmV0", true},
+	}
+	for _, test := range tests {
+		c := caddy.NewTestController("dns", "edge 10.0.0.1 1 2 . 10.0.0.2:53 {\nsite_id a\n"+test.input+"\n}")
+		_, err := parseEdge(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%q: expected error %v, got %v", test.input, test.shouldErr, err)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package edge
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+)
+
+// authorization lists what a single authenticated edge site may push: the
+// services it may register, as NAMESPACE/NAME patterns, the networks its
+// sites' IPs must be in, and the patterns its sites' IDs must match. An empty
+// list allows anything.
+type authorization struct {
+	services []string
+	networks []*net.IPNet
+	sites    []string
+}
+
+// Returns the authorization of an edge site identity, creating it if needed.
+func (e *Edge) authorizationOf(identity string) *authorization {
+	authz, found := e.authorizations[identity]
+	if !found {
+		authz = new(authorization)
+		e.authorizations[identity] = authz
+	}
+	return authz
+}
+
+// Checks that a service pattern is of the form NAMESPACE/NAME, where either
+// part may use shell globs.
+func validateServicePattern(pattern string) error {
+	parts := strings.Split(pattern, "/")
+	if len(parts) != 2 {
+		return errInvalidServicePattern
+	}
+	for _, part := range parts {
+		if _, err := path.Match(part, ""); err != nil {
+			return errInvalidServicePattern
+		}
+	}
+	return nil
+}
+
+// Checks that a site ID pattern is a valid shell glob.
+func validateSitePattern(pattern string) error {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return errInvalidSitePattern
+	}
+	return nil
+}
+
+// Returns true if a site with the given ID may be pushed.
+func (a *authorization) allowsSite(id string) bool {
+	if len(a.sites) == 0 {
+		return true
+	}
+	for _, pattern := range a.sites {
+		if matched, _ := path.Match(pattern, id); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the site may be pushed with the given IP.
+func (a *authorization) allowsIP(ip net.IP) bool {
+	if len(a.networks) == 0 {
+		return true
+	}
+	for _, network := range a.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the given service may be registered. Service names look
+// like my-svc.my-namespace.svc.cluster.external, and are matched against the
+// patterns by namespace and name.
+func (a *authorization) allowsService(service string) bool {
+	if len(a.services) == 0 {
+		return true
+	}
+	name := strings.TrimSuffix(service, serviceExtension)
+	dot := strings.Index(name, ".")
+	if dot < 0 || name == service {
+		return false
+	}
+	namespaced := name[dot+1:] + "/" + name[:dot]
+	for _, pattern := range a.services {
+		if matched, _ := path.Match(pattern, namespaced); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks that the edge site with the given identity may push updates for a
+// site. Updates for sites without an ID are always refused, since their
+// entries couldn't be told apart from any other site's, as are updates for
+// sites whose coordinates aren't on the globe, which no distance could be
+// measured to. Otherwise, always passes if no authorizations are configured.
+func (e *Edge) authorizeSite(identity string, meta Site) error {
+	if meta.ID == "" {
+		return e.reject(identity, meta, "site_id", errNoSiteID)
+	}
+	if !meta.GeoCoords.Valid() {
+		return e.reject(identity, meta, "location", errInvalidSiteLocation)
+	}
+	if len(e.authorizations) == 0 {
+		return nil
+	}
+	authz, found := e.authorizations[identity]
+	if !found {
+		return e.reject(identity, meta, "identity", errUnknownIdentity)
+	}
+	if !authz.allowsIP(meta.IP) {
+		return e.reject(identity, meta, "network", errNetworkNotAllowed)
+	}
+	if !authz.allowsSite(meta.ID) {
+		return e.reject(identity, meta, "site", errSiteNotAllowed)
+	}
+	return nil
+}
+
+// Checks that the edge site with the given identity may register a service.
+// Always passes if no authorizations are configured.
+func (e *Edge) authorizeService(identity string, meta Site, service string) error {
+	if len(e.authorizations) == 0 {
+		return nil
+	}
+	if authz, found := e.authorizations[identity]; found && authz.allowsService(service) {
+		return nil
+	}
+	return e.reject(identity, meta, "service", fmt.Errorf("%v: %s", errServiceNotAllowed, service))
+}
+
+// Logs and counts a rejected update.
+func (e *Edge) reject(identity string, meta Site, reason string, err error) error {
+	log.Warningf("rejected update for site %s (%s) from %q: %v", meta.ID, meta.IP, identity, err)
+	RejectedUpdateCount.WithLabelValues(reason).Inc()
+	return err
+}
@@ -0,0 +1,71 @@
+package edge
+
+import (
+	"net"
+	"testing"
+
+	"github.com/mholt/caddy"
+)
+
+func TestAllowSitesSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"hmac_key relay c2VjcmV0\nallow_sites relay relay eu-*", false},
+		{"hmac_key relay c2VjcmV0\nallow_sites relay", true},
+		{"hmac_key relay c2VjcmV0\nallow_sites relay eu-[", true},
+		{"allow_sites relay eu-*", true},
+	}
+	for _, test := range tests {
+		c := caddy.NewTestController("dns", "edge 10.0.0.1 1 2 . 10.0.0.2:53 {\nsite_id a\n"+test.input+"\n}")
+		_, err := parseEdge(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%q: expected error %v, got %v", test.input, test.shouldErr, err)
+		}
+	}
+}
+
+func TestAuthorizeSiteID(t *testing.T) {
+	e := New()
+	e.authorizationOf("relay").sites = []string{"relay", "eu-*"}
+	e.authorizationOf("leaf").sites = []string{"leaf"}
+
+	tests := []struct {
+		identity string
+		id       string
+		ok       bool
+	}{
+		{"relay", "relay", true},
+		{"relay", "eu-paris", true},
+		{"relay", "us-boston", false},
+		{"leaf", "leaf", true},
+		{"leaf", "relay", false},
+	}
+	for _, test := range tests {
+		site := Site{ID: test.id, IP: net.ParseIP("10.0.0.1")}
+		before := counterValue(RejectedUpdateCount.WithLabelValues("site"))
+		err := e.authorizeSite(test.identity, site)
+		if (err == nil) != test.ok {
+			t.Errorf("%s pushing %s: expected the site to be allowed: %v, got %v", test.identity, test.id, test.ok, err)
+		}
+		want := 0.0
+		if !test.ok {
+			want = 1
+		}
+		if rejected := counterValue(RejectedUpdateCount.WithLabelValues("site")) - before; rejected != want {
+			t.Errorf("%s pushing %s: expected %v rejections to be counted, got %v", test.identity, test.id, want, rejected)
+		}
+	}
+
+	// A site can't take over another site's entries by pushing under its ID.
+	victim := Site{ID: "relay", IP: net.ParseIP("10.0.0.1")}
+	e.table.Add(victim, "default/a")
+	batch := ServiceTableBatch{Meta: victim, Events: []ServiceEvent{{Type: Delete, Service: "default/a"}}}
+	if err := e.applyBatch("leaf", batch); err != errSiteNotAllowed {
+		t.Errorf("Expected %v, got %v", errSiteNotAllowed, err)
+	}
+	if services := e.table.ServicesOf(victim); len(services) != 1 {
+		t.Errorf("Expected the site's entries to be left alone, got %v", services)
+	}
+}
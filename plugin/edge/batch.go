@@ -0,0 +1,148 @@
+package edge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultBatchWindow = 100 * time.Millisecond
+	batchPath          = "/batch"
+
+	// The number of events that can be queued before the watch loop blocks.
+	batchQueueSize = 1024
+)
+
+// ServiceTableBatch encapsulates a set of service events from an edge site,
+// to be applied to the table all at once.
+type ServiceTableBatch struct {
+	Meta   Site           `json:"meta"`
+	Events []ServiceEvent `json:"events"`
+
+	// The run of the site that the generations of the events were counted in.
+	Run string `json:"run,omitempty"`
+
+	// The IDs of the sites that relayed the batch on its way up, in order.
+	Path []string `json:"path,omitempty"`
+}
+
+// Starts collecting local service events into batches. The first event of a
+// batch opens a window of e.batchWindow, and every event that arrives within
+// it is pushed upstream along with it. Only the latest event for each service
+// is kept.
+func (e *Edge) startBatchingEvents() {
+	e.batchQueue = make(chan ServiceEvent, batchQueueSize)
+	e.batchStop = make(chan struct{})
+	go func() {
+		pending := make(map[string]ServiceEvent)
+		var window <-chan time.Time
+		for {
+			select {
+			case event := <-e.batchQueue:
+				pending[event.Service] = event
+				if e.batchWindow <= 0 {
+					e.flushBatch(pending)
+					pending = make(map[string]ServiceEvent)
+				} else if window == nil {
+					window = time.After(e.batchWindow)
+				}
+			case <-window:
+				e.flushBatch(pending)
+				pending = make(map[string]ServiceEvent)
+				window = nil
+			case <-e.batchStop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops batching events. Events still waiting for their window are dropped,
+// since the next full sync brings upstreams up to date anyway.
+func (e *Edge) stopBatchingEvents() {
+	if e.batchStop != nil {
+		close(e.batchStop)
+	}
+}
+
+// Queues a local service event to be pushed upstream with the next batch.
+func (e *Edge) queueEvent(event ServiceEvent) {
+	select {
+	case e.batchQueue <- event:
+	case <-e.batchStop:
+	}
+}
+
+// Pushes a batch of events to every upstream.
+func (e *Edge) flushBatch(pending map[string]ServiceEvent) {
+	if len(pending) == 0 {
+		return
+	}
+	batch := ServiceTableBatch{
+		Meta:   e.site,
+		Events: make([]ServiceEvent, 0, len(pending)),
+		Run:    e.run,
+	}
+	for _, event := range pending {
+		batch.Events = append(batch.Events, event)
+	}
+	log.Debugf("pushing batch of %d service events upstream", len(batch.Events))
+	for _, p := range e.proxies {
+		p.pushServiceBatch(batch)
+	}
+}
+
+// Parse incoming batches of table updates from edge sites.
+func (e *Edge) parseTableBatch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	jsn, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln("error while reading table batch:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	batch := ServiceTableBatch{}
+	if err = json.Unmarshal(jsn, &batch); err != nil {
+		log.Errorln("error while unmarshalling JSON into table batch struct:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err = e.applyBatch(identityFrom(r.Context()), batch); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// Applies a batch of table updates pushed by the edge site with the given
+// identity, leaving out any events for services it may not register or older
+// than ones already applied, and relays it further upstream. Batches from
+// before the site last restarted are dropped altogether.
+func (e *Edge) applyBatch(identity string, batch ServiceTableBatch) error {
+	if err := e.authorizeSite(identity, batch.Meta); err != nil {
+		return err
+	}
+	if !e.generations.CheckRun(batch.Meta, batch.Run) {
+		log.Debugf("discarding batch from an earlier run of site %s", batch.Meta.IP)
+		return nil
+	}
+	events := batch.Events[:0]
+	for _, event := range batch.Events {
+		if e.authorizeService(identity, batch.Meta, event.Service) != nil {
+			continue
+		}
+		if e.generations.Advance(batch.Meta, event.Service, event.Generation) {
+			events = append(events, event)
+		} else {
+			log.Debugf("discarding stale event %+v from site %s", event, batch.Meta.IP)
+		}
+	}
+	e.table.Apply(batch.Meta, events)
+	e.leases.Renew(batch.Meta)
+	batch.Events = events
+	e.relayBatch(batch)
+	return nil
+}
@@ -1,7 +1,10 @@
 package edge
 
 import (
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ServiceTable specifies the mapping from service DNS names to edge sites.
@@ -15,24 +18,93 @@ type ServiceTableUpdate struct {
 }
 
 // ConcurrentServiceTable is a table that can be safely shared between goroutines.
+// Writers update the table under the lock and then publish an immutable copy
+// of it, with the sites of every service indexed by location, which lookups
+// read without taking any lock.
 type ConcurrentServiceTable struct {
 	sync.RWMutex
 	table ServiceTable
+
+	// The published copy of the table, as an index of the sites running each
+	// service. Indexes are never modified once stored, so they can be handed
+	// out to any number of readers.
+	published atomic.Value
+
+	// The services whose sets changed since the table was last published,
+	// which need their indexes rebuilt.
+	dirty map[string]bool
+
+	// The expiry times of entries learned from upstream resolutions, by
+	// service name and site hash. Entries without one never expire.
+	expiries map[string]map[uint64]time.Time
+
+	// The times entries were last added or confirmed by a sync from their
+	// site, by service name and site hash.
+	updated map[string]map[uint64]time.Time
+}
+
+// TableEntry is a site running a service, along with when the entry was last
+// updated and, if it was learned, when it expires.
+type TableEntry struct {
+	Site    Site       `json:"site"`
+	Updated time.Time  `json:"updated"`
+	Expires *time.Time `json:"expires,omitempty"`
 }
 
 // NewConcurrentServiceTable creates a new concurrent table.
 func NewConcurrentServiceTable() *ConcurrentServiceTable {
-	return &ConcurrentServiceTable{
-		table: make(ServiceTable),
+	cst := &ConcurrentServiceTable{
+		table:    make(ServiceTable),
+		dirty:    make(map[string]bool),
+		expiries: make(map[string]map[uint64]time.Time),
+		updated:  make(map[string]map[uint64]time.Time),
 	}
+	cst.published.Store(make(map[string]*siteIndex))
+	return cst
 }
 
-// Lookup performs a locked lookup for edge sites running a particular service.
+// Lookup finds the edge sites running a particular service in the published
+// table, without waiting on writers. The returned set must not be modified.
 func (cst *ConcurrentServiceTable) Lookup(svc string) (Set, bool) {
-	cst.Lock()
-	defer cst.Unlock()
-	set, found := cst.table[svc]
-	return set, found
+	index, found := cst.lookupIndex(svc)
+	if !found {
+		return nil, false
+	}
+	return index.sites, true
+}
+
+// Finds the index of the edge sites running a particular service in the
+// published table, without waiting on writers.
+func (cst *ConcurrentServiceTable) lookupIndex(svc string) (*siteIndex, bool) {
+	index, found := cst.published.Load().(map[string]*siteIndex)[svc]
+	return index, found
+}
+
+// Publishes a copy of the table for lookups, copying and reindexing only the
+// sets that changed since the last one. Must be called with the lock held.
+func (cst *ConcurrentServiceTable) publish() {
+	if len(cst.dirty) == 0 {
+		return
+	}
+	prev := cst.published.Load().(map[string]*siteIndex)
+	next := make(map[string]*siteIndex, len(cst.table))
+	for serviceName, index := range prev {
+		next[serviceName] = index
+	}
+	for serviceName := range cst.dirty {
+		edgeSites, found := cst.table[serviceName]
+		if !found {
+			delete(next, serviceName)
+			continue
+		}
+		copied := make(Set, len(edgeSites))
+		for hash, val := range edgeSites {
+			copied[hash] = val
+		}
+		next[serviceName] = newSiteIndex(copied)
+	}
+	cst.published.Store(next)
+	cst.dirty = make(map[string]bool)
 }
 
 // Add adds a new entry to the table.
@@ -41,35 +113,369 @@ func (cst *ConcurrentServiceTable) Add(meta Site, serviceName string) {
 	// Lock down the table.
 	cst.Lock()
 	defer cst.Unlock()
+	defer cst.publish()
 
-	// Add the new site.
-	if edgeSites, found := cst.table[serviceName]; found {
-		edgeSites.Add(meta)
-	} else {
-		newSet := NewSet()
-		newSet.Add(meta)
-		cst.table[serviceName] = newSet
-	}
+	// Add the new site, which never expires even if it was learned before.
+	cst.add(meta, serviceName)
+	cst.clearExpiry(hashOf(meta), serviceName)
 
 	// Log the new table.
 	log.Debugf("updated table: %+v", cst.table)
 }
 
+// AddWithExpiry adds a new entry to the table that is removed again by
+// RemoveExpired after the given time. Entries that were added without an
+// expiry are left alone.
+func (cst *ConcurrentServiceTable) AddWithExpiry(meta Site, serviceName string, expires time.Time) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
+
+	// Only add the site if it isn't already there for good.
+	hash := hashOf(meta)
+	if edgeSites, found := cst.table[serviceName]; found {
+		if _, exists := edgeSites[hash]; exists {
+			if _, expiring := cst.expiries[serviceName][hash]; !expiring {
+				return
+			}
+		}
+	}
+	cst.add(meta, serviceName)
+	if cst.expiries[serviceName] == nil {
+		cst.expiries[serviceName] = make(map[uint64]time.Time)
+	}
+	cst.expiries[serviceName][hash] = expires
+}
+
 // Remove deletes an entry from the table.
 func (cst *ConcurrentServiceTable) Remove(meta Site, serviceName string) {
 
 	// Lock down the table.
 	cst.Lock()
 	defer cst.Unlock()
+	defer cst.publish()
+
+	// Remove the site.
+	hash := hashOf(meta)
+	cst.remove(hash, serviceName)
+	cst.clearExpiry(hash, serviceName)
+
+	// Log the new table.
+	log.Debugf("updated table: %+v", cst.table)
+}
+
+// Apply adds and removes the entries of a site for a set of service events,
+// all under a single lock so lookups never see part of the set applied.
+func (cst *ConcurrentServiceTable) Apply(meta Site, events []ServiceEvent) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
+
+	// Apply the events in order.
+	hash := hashOf(meta)
+	for _, event := range events {
+		switch event.Type {
+		case Add:
+			cst.add(meta, event.Service)
+		case Delete:
+			cst.remove(hash, event.Service)
+		}
+		cst.clearExpiry(hash, event.Service)
+	}
+
+	// Log the new table.
+	log.Debugf("updated table: %+v", cst.table)
+}
+
+// RemoveExpired deletes all entries that expired before the given time.
+func (cst *ConcurrentServiceTable) RemoveExpired(now time.Time) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
 
-	// Add the new site.
+	// Remove the expired sites.
+	for serviceName, expiries := range cst.expiries {
+		for hash, expires := range expiries {
+			if now.Before(expires) {
+				continue
+			}
+			cst.remove(hash, serviceName)
+			cst.clearExpiry(hash, serviceName)
+		}
+	}
+}
+
+// Adds a site to the set for a service. Must be called with the lock held.
+func (cst *ConcurrentServiceTable) add(meta Site, serviceName string) {
+	hash := hashOf(meta)
+	edgeSites, found := cst.table[serviceName]
+	if !found {
+		edgeSites = NewSet()
+		cst.table[serviceName] = edgeSites
+	}
+	if existing, exists := edgeSites[hash]; !exists || !reflect.DeepEqual(existing, meta) {
+		edgeSites[hash] = meta
+		cst.dirty[serviceName] = true
+	}
+	if cst.updated[serviceName] == nil {
+		cst.updated[serviceName] = make(map[uint64]time.Time)
+	}
+	cst.updated[serviceName][hash] = time.Now()
+}
+
+// Removes a site from the set for a service by its hash. Must be called with
+// the lock held.
+func (cst *ConcurrentServiceTable) remove(hash uint64, serviceName string) {
 	if edgeSites, found := cst.table[serviceName]; found {
-		edgeSites.Remove(meta)
+		if _, exists := edgeSites[hash]; exists {
+			cst.dirty[serviceName] = true
+		}
+		delete(edgeSites, hash)
 		if edgeSites.Len() == 0 {
 			delete(cst.table, serviceName)
 		}
 	}
+	if updated, found := cst.updated[serviceName]; found {
+		delete(updated, hash)
+		if len(updated) == 0 {
+			delete(cst.updated, serviceName)
+		}
+	}
+}
+
+// Forgets the expiry of an entry. Must be called with the lock held.
+func (cst *ConcurrentServiceTable) clearExpiry(hash uint64, serviceName string) {
+	if expiries, found := cst.expiries[serviceName]; found {
+		delete(expiries, hash)
+		if len(expiries) == 0 {
+			delete(cst.expiries, serviceName)
+		}
+	}
+}
+
+// RemoveSite deletes every entry of the given site.
+func (cst *ConcurrentServiceTable) RemoveSite(meta Site) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
+
+	// Remove the site from every service.
+	hash := hashOf(meta)
+	for serviceName := range cst.table {
+		cst.remove(hash, serviceName)
+		cst.clearExpiry(hash, serviceName)
+	}
+
+	// Log the new table.
+	log.Debugf("updated table: %+v", cst.table)
+}
+
+// UpdateSite replaces the stored address, coordinates and metadata of a site
+// in every entry it has, without changing which services it's running.
+func (cst *ConcurrentServiceTable) UpdateSite(meta Site) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
+
+	// Replace the site wherever it has changed.
+	cst.updateSite(meta, false)
+}
+
+// ConfirmSite is like UpdateSite, but also records that every entry of the
+// site was confirmed just now.
+func (cst *ConcurrentServiceTable) ConfirmSite(meta Site) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
+
+	// Replace the site wherever it has changed, and refresh its entries.
+	cst.updateSite(meta, true)
+}
+
+// Replaces a site in every entry it has, refreshing when the entries were
+// last updated if asked to. Must be called with the lock held.
+func (cst *ConcurrentServiceTable) updateSite(meta Site, confirm bool) {
+	hash := hashOf(meta)
+	now := time.Now()
+	for serviceName, edgeSites := range cst.table {
+		existing, found := edgeSites[hash]
+		if !found {
+			continue
+		}
+		if !reflect.DeepEqual(existing, meta) {
+			edgeSites[hash] = meta
+			cst.dirty[serviceName] = true
+		}
+		if confirm {
+			cst.updated[serviceName][hash] = now
+		}
+	}
+}
+
+// ServicesOf returns the names of all services the given site is running.
+func (cst *ConcurrentServiceTable) ServicesOf(meta Site) []string {
+	cst.RLock()
+	defer cst.RUnlock()
+	hash := hashOf(meta)
+	var services []string
+	for serviceName, edgeSites := range cst.table {
+		if _, found := edgeSites[hash]; found {
+			services = append(services, serviceName)
+		}
+	}
+	return services
+}
+
+// ReplaceSite atomically replaces all the services the given site is running.
+func (cst *ConcurrentServiceTable) ReplaceSite(meta Site, services []string) {
+
+	// Lock down the table.
+	cst.Lock()
+	defer cst.Unlock()
+	defer cst.publish()
+
+	// Remove the site from every service it's no longer running.
+	hash := hashOf(meta)
+	keep := make(map[string]bool, len(services))
+	for _, serviceName := range services {
+		keep[serviceName] = true
+	}
+	for serviceName, edgeSites := range cst.table {
+		if _, found := edgeSites[hash]; found && !keep[serviceName] {
+			cst.remove(hash, serviceName)
+			cst.clearExpiry(hash, serviceName)
+		}
+	}
+
+	// Add it to every service it is running.
+	for serviceName := range keep {
+		cst.add(meta, serviceName)
+		cst.clearExpiry(hash, serviceName)
+	}
 
 	// Log the new table.
 	log.Debugf("updated table: %+v", cst.table)
 }
+
+// SiteEntries holds every service a site is running.
+type SiteEntries struct {
+	Meta     Site
+	Services []string
+}
+
+// Sites returns the services of every site in the table by site hash,
+// leaving out entries that expire.
+func (cst *ConcurrentServiceTable) Sites() map[uint64]*SiteEntries {
+	cst.RLock()
+	defer cst.RUnlock()
+	sites := make(map[uint64]*SiteEntries)
+	for serviceName, edgeSites := range cst.table {
+		for hash, val := range edgeSites {
+			if _, expiring := cst.expiries[serviceName][hash]; expiring {
+				continue
+			}
+			entries, found := sites[hash]
+			if !found {
+				entries = &SiteEntries{Meta: val.(Site)}
+				sites[hash] = entries
+			}
+			entries.Services = append(entries.Services, serviceName)
+		}
+	}
+	return sites
+}
+
+// ExpiringSiteEntries holds the services of a site that expire, along with
+// when they do.
+type ExpiringSiteEntries struct {
+	Meta    Site
+	Expires map[string]time.Time
+}
+
+// ExpiringSites returns the services of every site in the table that expire,
+// by site hash.
+func (cst *ConcurrentServiceTable) ExpiringSites() map[uint64]*ExpiringSiteEntries {
+	cst.RLock()
+	defer cst.RUnlock()
+	sites := make(map[uint64]*ExpiringSiteEntries)
+	for serviceName, expiries := range cst.expiries {
+		for hash, expires := range expiries {
+			val, exists := cst.table[serviceName][hash]
+			if !exists {
+				continue
+			}
+			entries, found := sites[hash]
+			if !found {
+				entries = &ExpiringSiteEntries{
+					Meta:    val.(Site),
+					Expires: make(map[string]time.Time),
+				}
+				sites[hash] = entries
+			}
+			entries.Expires[serviceName] = expires
+		}
+	}
+	return sites
+}
+
+// Expiring returns true if any entry of the given site expires.
+func (cst *ConcurrentServiceTable) Expiring(meta Site) bool {
+	cst.RLock()
+	defer cst.RUnlock()
+	hash := hashOf(meta)
+	for _, expiries := range cst.expiries {
+		if _, found := expiries[hash]; found {
+			return true
+		}
+	}
+	return false
+}
+
+// Entries returns every entry in the table by service name.
+func (cst *ConcurrentServiceTable) Entries() map[string][]TableEntry {
+	cst.RLock()
+	defer cst.RUnlock()
+	entries := make(map[string][]TableEntry, len(cst.table))
+	for serviceName, edgeSites := range cst.table {
+		list := make([]TableEntry, 0, len(edgeSites))
+		for hash, val := range edgeSites {
+			entry := TableEntry{
+				Site:    val.(Site),
+				Updated: cst.updated[serviceName][hash],
+			}
+			if expires, expiring := cst.expiries[serviceName][hash]; expiring {
+				entry.Expires = &expires
+			}
+			list = append(list, entry)
+		}
+		entries[serviceName] = list
+	}
+	return entries
+}
+
+// Snapshot returns a copy of the whole table.
+func (cst *ConcurrentServiceTable) Snapshot() map[string][]Site {
+	cst.RLock()
+	defer cst.RUnlock()
+	snapshot := make(map[string][]Site, len(cst.table))
+	for serviceName, edgeSites := range cst.table {
+		sites := make([]Site, 0, len(edgeSites))
+		for _, val := range edgeSites {
+			sites = append(sites, val.(Site))
+		}
+		snapshot[serviceName] = sites
+	}
+	return snapshot
+}
@@ -0,0 +1,101 @@
+package edge
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+// Returns a site with an ID and IP derived from n.
+func testSite(n int) Site {
+	return Site{
+		ID: fmt.Sprintf("site-%d", n),
+		IP: net.IPv4(10, byte(n>>16), byte(n>>8), byte(n)),
+	}
+}
+
+func TestLookupSnapshot(t *testing.T) {
+	cst := NewConcurrentServiceTable()
+	cst.Add(testSite(0), "default/a")
+	sites, found := cst.Lookup("default/a")
+	if !found || sites.Len() != 1 {
+		t.Fatalf("Expected 1 site, got %v", sites)
+	}
+
+	// Writers keep changing the table while the returned set is read, which
+	// the race detector flags if they touch it.
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i <= 1000; i++ {
+			cst.Add(testSite(i), "default/a")
+			if i%2 == 0 {
+				cst.RemoveSite(testSite(i - 1))
+			}
+		}
+		cst.RemoveSite(testSite(0))
+	}()
+	for i := 0; i < 1000; i++ {
+		if sites.Len() != 1 {
+			t.Fatalf("Expected the returned set to stay at 1 site, got %d", sites.Len())
+		}
+		for _, val := range sites {
+			if val.(Site).ID != "site-0" {
+				t.Fatalf("Expected the returned set to hold site-0, got %v", val)
+			}
+		}
+	}
+	wg.Wait()
+
+	// Later lookups see the writes.
+	if sites, _ := cst.Lookup("default/a"); sites.Len() != 500 {
+		t.Errorf("Expected 500 sites after the writes, got %d", sites.Len())
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	cst := NewConcurrentServiceTable()
+	services := make([]string, 10)
+	for i := range services {
+		services[i] = fmt.Sprintf("default/svc-%d", i)
+	}
+	for i := 0; i < 100; i++ {
+		cst.Add(testSite(i), services[i%len(services)])
+	}
+
+	// A writer keeps adding and removing a site for as long as lookups run.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		site := testSite(1000)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				cst.Add(site, "default/svc-0")
+			} else {
+				cst.RemoveSite(site)
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, found := cst.Lookup(services[i%len(services)]); !found {
+				b.Fatal("lookup failed")
+			}
+			i++
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
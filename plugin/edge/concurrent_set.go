@@ -46,6 +46,17 @@ func (cs *ConcurrentSet) Overwrite(newValues Set) {
 	cs.items = newValues
 }
 
+// Values returns a copy of all the elements in the set.
+func (cs *ConcurrentSet) Values() []interface{} {
+	cs.RLock()
+	defer cs.RUnlock()
+	values := make([]interface{}, 0, len(cs.items))
+	for _, val := range cs.items {
+		values = append(values, val)
+	}
+	return values
+}
+
 // Len returns the number of elements in the set.
 func (cs *ConcurrentSet) Len() int {
 	cs.Lock()
@@ -29,6 +29,12 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Returns true if a request is forwarded to the upstream proxy over a stream
+// connection, TCP or TLS, rather than over UDP.
+func (p *Proxy) streamed(state request.Request, forceTCP bool) bool {
+	return forceTCP || state.Proto() == "tcp" || p.transport.tlsConfig != nil
+}
+
 // Establishes a connection and forwards a message to the upstream proxy.
 func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, metric bool) (*dns.Msg, error) {
 
@@ -37,6 +43,17 @@ func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, me
 		proto = "tcp"
 	}
 
+	// Sign the request if this upstream expects it.
+	req := state.Req
+	if p.tsigKey != nil {
+		req = p.tsigKey.sign(req)
+	}
+
+	// Stream connections are shared between queries when pipelining is enabled.
+	if p.pipeline != nil && (proto == "tcp" || p.transport.tlsConfig != nil) {
+		return p.pipeline.Exchange(ctx, req)
+	}
+
 	conn, err := p.Dial(proto)
 	if err != nil {
 		return nil, err
@@ -49,15 +66,20 @@ func (p *Proxy) connect(ctx context.Context, state request.Request, forceTCP, me
 	}
 
 	conn.SetWriteDeadline(time.Now().Add(timeout))
-	if err := conn.WriteMsg(state.Req); err != nil {
-		conn.Close() // not giving it back
+	if err := conn.WriteMsg(req); err != nil {
+		p.Discard(conn) // not giving it back
 		return nil, err
 	}
 
 	conn.SetReadDeadline(time.Now().Add(timeout))
 	ret, err := conn.ReadMsg()
 	if err != nil {
-		conn.Close() // not giving it back
+		p.Discard(conn) // not giving it back
+
+		// A truncated reply is still handed back, so it can be retried.
+		if err == dns.ErrTruncated {
+			return ret, err
+		}
 		return nil, err
 	}
 
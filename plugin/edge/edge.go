@@ -22,6 +22,7 @@ package edge
 
 import (
 	"crypto/tls"
+	"hash/fnv"
 	"io"
 	"net"
 	"net/http"
@@ -32,6 +33,7 @@ import (
 	"github.com/miekg/dns"
 	ot "github.com/opentracing/opentracing-go"
 	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 )
@@ -50,13 +52,40 @@ var (
 
 // Site is a wrapper for all information needed about edge sites.
 type Site struct {
-	IP        net.IP `json:"ip"`
-	GeoCoords Point  `json:"coords"`
+	ID        string   `json:"id,omitempty"`
+	IP        net.IP   `json:"ip"`
+	GeoCoords Location `json:"coords"`
+
+	// Descriptive metadata about the site, for operators.
+	Name    string            `json:"name,omitempty"`
+	Region  string            `json:"region,omitempty"`
+	Labels  map[string]string `json:"labels,omitempty"`
+	Contact string            `json:"contact,omitempty"`
+}
+
+// Returns the key a site is stored under in sets and tables. Sites are keyed
+// by their ID, so a site that changes its address or coordinates replaces its
+// old entries instead of appearing as a new site. Sites learned from older
+// upstreams may have no ID, and are keyed by all their fields instead.
+func (s Site) key() uint64 {
+	if s.ID == "" {
+		return hashValue(s)
+	}
+	h := fnv.New64a()
+	io.WriteString(h, s.ID)
+	return h.Sum64()
 }
 
 // Edge encapsulates all edge plugin state.
 type Edge struct {
 
+	// The generation of the last service event sent to my upstreams. Kept
+	// first so it stays 64-bit aligned for atomic access.
+	generation uint64
+
+	// The ID of this run of the edge site, sent along with its generations.
+	run string
+
 	// Next is a reference to the next plugin in the CoreDNS plugin chain.
 	Next plugin.Handler
 
@@ -73,21 +102,77 @@ type Edge struct {
 	// IP is the public IP address of this cluster.
 	ip net.IP
 
-	// The geo coordinates of this cluster.
-	geoCoords Point
+	// The geo coordinates of this cluster, along with their precision.
+	location Location
 
 	// Site encapsulates all the information about this edge site that would
 	// need to get sent upstream.
 	site Site
 
+	// The unique ID of this edge site, sent along with forwarded requests
+	// and every push.
+	siteID string
+
+	// Descriptive metadata about this edge site, sent along with every push.
+	siteName    string
+	siteRegion  string
+	siteLabels  map[string]string
+	siteContact string
+
 	// The LOC Resource Record associated with this edge site's location.
 	locRR dns.RR
 
-	// A server for receiving table updates from downstream edge sites.
-	server *http.Server
+	// Also sends the legacy LOC record upstream, for upstreams that don't
+	// understand the location option yet.
+	legacyLOC bool
+
+	// The TSIG keys that downstream edge sites sign their requests with,
+	// indexed by key name. Location data is only trusted from requests that
+	// are validly signed with one of them.
+	downstreamKeys map[string]*tsigKey
+
+	// Trusts location data from unsigned downstream requests, as before
+	// downstream signing existed.
+	insecureDownstream bool
+
+	// The TSIG keys declared in the Corefile, indexed by key name, and the
+	// upstreams each of them signs for (all upstreams if empty).
+	tsigKeys     map[string]*tsigKey
+	upstreamTsig map[string][]string
+
+	// A server for receiving table updates from downstream edge sites, the
+	// address it listens on and the path prefix it serves under.
+	server       *http.Server
+	listenAddr   string
+	listenPrefix string
+
+	// The address the read-only admin API is served on, if at all.
+	adminAddr   string
+	adminServer *http.Server
+
+	// The push URLs and gRPC addresses of upstreams that override the ones
+	// derived from their DNS address, by upstream.
+	pushURLs map[string]pushOverride
+
+	// Whether table updates are exchanged over gRPC sessions, along with the
+	// server for sessions with downstream edge sites.
+	grpc       bool
+	grpcAddr   string
+	grpcServer *grpc.Server
+
+	// Whether pushes are made and served over TLS with client certificates,
+	// the HMAC keys pushes from downstream edge sites may be signed with, and
+	// the one I sign my own pushes with.
+	pushTLS  bool
+	hmacKeys map[string]*hmacKey
+	hmacSign *hmacKey
+
+	// What each authenticated downstream edge site may push, by identity. If
+	// empty, anything is allowed.
+	authorizations map[string]*authorization
 
 	// The set of services currently running at this edge site.
-	services Set
+	services *ConcurrentSet
 
 	// The set of upstream proxies for forwarding requests.
 	proxies []*Proxy
@@ -111,24 +196,116 @@ type Edge struct {
 	// The maximum number of allowable failures before giving up forwarding.
 	maxUpstreamFails uint32
 
+	// The maximum number of edge sites a request may be forwarded through.
+	maxHops int
+
+	// The generations of the last service events applied from each downstream site.
+	generations *generationTable
+
+	// The digests of syncs from downstream sites that had services left out.
+	filteredDigests *filteredDigests
+
+	// The window over which local service events are collected before being
+	// pushed upstream in a single batch.
+	batchWindow time.Duration
+	batchQueue  chan ServiceEvent
+	batchStop   chan struct{}
+
+	// Where batches waiting to be pushed upstream are persisted, if anywhere,
+	// and how many of them are kept per upstream.
+	outboxDir  string
+	outboxSize int
+
+	// How often my upstreams stream their table to me, if at all, and how far
+	// away the sites they send may be.
+	feedInterval time.Duration
+	feedRadius   float64
+
+	// The downstream sites I'm streaming my table to, and a channel that's
+	// closed to end all feeds in both directions.
+	children children
+	feedStop chan struct{}
+
+	// The leases of downstream sites, which keep their entries in my table
+	// for as long as they send heartbeats.
+	leases    *leaseTable
+	leaseStop chan struct{}
+
+	// The interval between heartbeats sent to my upstreams.
+	heartbeatInterval time.Duration
+	heartbeatStop     chan struct{}
+
+	// Where the table is persisted, how often, and how long entries loaded
+	// from it are kept before a sync from their site confirms them.
+	persistPath     string
+	persistInterval time.Duration
+	persistStop     chan struct{}
+	staleTimeout    time.Duration
+
+	// The sites whose entries were loaded from the persist file, which are
+	// persisted again while they're still stale.
+	staleSites map[uint64]bool
+
+	// The interval between full syncs of my services with my upstreams.
+	syncInterval time.Duration
+	syncStop     chan struct{}
+
+	// How long sites learned from upstream resolutions are kept in my table,
+	// or 0 to not learn from upstream at all.
+	learnTTL  time.Duration
+	learnStop chan struct{}
+
 	// The duration before expiring cached connections.
 	expire time.Duration
 
+	// The maximum number of idle and open connections per upstream and protocol.
+	maxIdleConns int
+	maxOpenConns int
+
 	// Forces TCP forwarding even when the initial request was UDP.
 	forceTCP bool
+
+	// Multiplexes TCP and TLS queries over shared connections when set, with
+	// the maximum number of connections and in-flight queries per connection.
+	pipeline         bool
+	pipelineConns    int
+	pipelineInFlight int
 }
 
 // New returns a new Edge instance.
 func New() *Edge {
 	return &Edge{
 		maxUpstreamFails:    defaultMaxUpstreamFails,
+		maxHops:             defaultMaxHops,
+		syncInterval:        defaultSyncInterval,
+		heartbeatInterval:   defaultHeartbeatInterval,
+		batchWindow:         defaultBatchWindow,
+		outboxSize:          defaultOutboxSize,
+		feedStop:            make(chan struct{}),
+		hmacKeys:            make(map[string]*hmacKey),
+		listenAddr:          ":" + pushPort,
+		grpcAddr:            ":" + grpcPort,
+		pushURLs:            make(map[string]pushOverride),
+		authorizations:      make(map[string]*authorization),
+		persistInterval:     defaultPersistInterval,
+		staleTimeout:        defaultStaleTimeout,
+		leases:              newLeaseTable(defaultLeaseGrace),
+		generation:          initialGeneration(),
+		run:                 newRunID(),
+		generations:         newGenerationTable(),
+		filteredDigests:     newFilteredDigests(),
 		tlsConfig:           new(tls.Config),
 		expire:              defaultExpire,
+		maxIdleConns:        defaultMaxIdleConns,
+		maxOpenConns:        defaultMaxOpenConns,
 		policy:              new(random),
 		baseDomain:          ".",
 		healthCheckInterval: healthCheckDuration,
 		table:               NewConcurrentServiceTable(),
-		services:            NewSet(),
+		services:            NewConcurrentSet(),
+		tsigKeys:            make(map[string]*tsigKey),
+		upstreamTsig:        make(map[string][]string),
+		downstreamKeys:      make(map[string]*tsigKey),
 	}
 }
 
@@ -142,15 +319,17 @@ func (e *Edge) NumUpstreams() int { return len(e.proxies) }
 //
 // Control flow: First determine if the request is invalid or blacklisted. If it
 // is, then fall through to the next plugin. If not, then determine if the
-// request has an Extra LOC record, meaning it was forwarded from a downstream
-// edge plugin. If no LOC is found, it must be from a client. In that case,
+// request carries a location option, meaning it was forwarded from a downstream
+// edge plugin. The location is only trusted when the request is validly signed
+// with one of the downstream TSIG keys, unless insecure_downstream is set. If no location
+// is found, it must be from a client. In that case,
 // check if the requested service is running locally. If it is, return my IP.
-// Otherwise, if a LOC was found, try to check my local table to see if I have
-// a list of edge sites running the requested service. If I do, then determine
-// the edge site closest to the location in LOC. If no LOC was found, simply
-// try to find the service running closest to my location. If no entries can be
-// found in my table for the requested service, then inject my location in a
-// LOC record, and forward the request up to one of my upstreams. Whatever
+// Otherwise, if a location was found, try to check my local table to see if I
+// have a list of edge sites running the requested service. If I do, then
+// determine the edge site closest to that location. If no location was found,
+// simply try to find the service running closest to my location. If no entries
+// can be found in my table for the requested service, then inject my location
+// in a location option, and forward the request up to one of my upstreams. Whatever
 // response they give me, I will return back to the client unmodified. Lastly,
 // if I have no upstreams to foward to, fall through to the `proxy` plugin to
 // handle this request.
@@ -170,8 +349,24 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	// Declare the response we want to send back.
 	res := new(dns.Msg)
 
-	// Parse out (and remove) the LOC field from the request, if one exists.
-	loc, locFound := extractLocationRecord(r)
+	// Verify and strip the request's TSIG signature, if any.
+	trusted := e.verifyTsig(r)
+
+	// Parse out (and remove) the location of the downstream edge site from the
+	// request, if one exists.
+	loc, locFound := extractLocation(r)
+	if locFound && !trusted {
+		log.Infof("ignoring location of unauthenticated downstream request from %s", state.IP())
+		locFound = false
+	}
+
+	// Parse out (and remove) the edge sites this request has already been
+	// forwarded through.
+	path := extractPath(r)
+
+	// Determine whether the downstream edge site wants to know how the
+	// request was resolved.
+	wantsResolution := extractResolutionRequest(r) && locFound
 
 	// Parse the target domain out of the request (NOTE: This will always have
 	// a trailing dot.)
@@ -180,22 +375,31 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	// Determine if the requested service is running locally and write a reply
 	// with my ip if it is.
 	if !locFound && e.services.Contains(requestedService) {
-		writeAuthoritativeResponse(res, &state, e.ip)
+		writeAuthoritativeResponse(res, &state, e.ip, nil)
 		log.Debugf("requested service %s found running locally. returning my ip", requestedService)
 		return dns.RcodeSuccess, nil
 	}
 
 	// Determine if there is another edge site that I know of that is running
-	// the requested service. If there is, redirect to the closest.
-	edgeSites, entryFound := e.table.Lookup(requestedService)
-	if entryFound && len(edgeSites) > 0 {
-		var closest net.IP
+	// the requested service. If there is, redirect to the closest. If none of
+	// them can be measured against, the request is forwarded instead.
+	edgeSites, entryFound := e.table.lookupIndex(requestedService)
+	var meta resolution
+	if entryFound && edgeSites.Len() > 0 {
 		if locFound {
-			closest = findClosestToPoint(edgeSites, loc)
+			meta = findClosest(edgeSites, loc.Location, stickinessKey(loc, state))
+		} else {
+			meta = findClosest(edgeSites, e.location, state.IP())
+		}
+	}
+	if len(meta.Candidates) > 0 {
+		closest := meta.Candidates[meta.Chosen].IP
+		if wantsResolution {
+			meta = meta.including(edgeSites, loc.Location)
+			writeAuthoritativeResponse(res, &state, closest, &meta)
 		} else {
-			closest = findClosestToPoint(edgeSites, e.geoCoords)
+			writeAuthoritativeResponse(res, &state, closest, nil)
 		}
-		writeAuthoritativeResponse(res, &state, closest)
 		log.Debugf("requested service %s found in table. returning its IP: %s", requestedService, closest.String())
 		return dns.RcodeSuccess, nil
 	}
@@ -207,8 +411,39 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 		return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
 	}
 
-	// Inject my location as a LOC record in the Extra fields of the message.
-	insertLocationRecord(r, e.locRR)
+	// Refuse to forward the request if it has already passed through me, or
+	// through too many other edge sites.
+	if reason, ok := e.checkPath(path); !ok {
+		log.Errorf("refusing to forward request for %s: %s", requestedService, reason)
+		servfail := state.ErrorMessage(dns.RcodeServerFailure)
+		if r.IsEdns0() != nil {
+			servfail.SetEdns0(uint16(state.Size()), state.Do())
+			insertExtendedError(servfail, edeOther, reason)
+		}
+		w.WriteMsg(servfail)
+		return dns.RcodeSuccess, nil
+	}
+
+	// Inject the location and the updated path as EDNS0 options, remembering
+	// whether the client sent an OPT record of its own. A location received
+	// from a trusted downstream site is passed on unchanged, so upstreams pick
+	// the site closest to where the request came from rather than to me.
+	fwdLoc := edgeLocation{Location: e.location, SiteID: e.siteID}
+	locRR := e.locRR
+	if locFound {
+		fwdLoc = loc
+		if rr, err := convertLocationToLOC(loc.Location); err == nil {
+			locRR = rr
+		}
+	}
+	addedOPT := insertLocation(r, fwdLoc)
+	insertPath(r, path.Next(e.siteID))
+	if e.learnTTL > 0 || wantsResolution {
+		insertResolutionRequest(r)
+	}
+	if e.legacyLOC {
+		insertLocationRecord(r, locRR)
+	}
 	log.Debugf("forwarding request upstream: %+v", r)
 
 	// Forward the request to one of the upstream proxies.
@@ -250,9 +485,17 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 			child.Finish()
 		}
 
-		res, err = truncated(res, err)
+		res, err = truncated(state, res, err)
 		upstreamErr = err
 
+		// Transparently retry truncated UDP replies over TCP.
+		stream := proxy.streamed(state, e.forceTCP)
+		if err == nil && !e.forceTCP {
+			if ret := proxy.retryTruncated(ctx, state, res); ret != res {
+				res, stream = ret, true
+			}
+		}
+
 		if err != nil {
 			// Kick off health check to see if *our* upstream is broken.
 			if e.maxUpstreamFails != 0 {
@@ -271,6 +514,25 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 			return dns.RcodeSuccess, nil
 		}
 
+		// Learn from how the upstream resolved the service, and pass it on to
+		// the downstream edge site if it asked. Replies over UDP are easily
+		// spoofed, so their resolution is dropped instead.
+		if meta, found := extractResolution(res); found {
+			if !stream {
+				log.Debugf("ignoring resolution of %s received over udp from %s", requestedService, proxy.addr)
+			} else {
+				e.learn(requestedService, meta)
+				if wantsResolution {
+					insertResolution(res, meta, state.Size())
+				}
+			}
+		}
+
+		// Don't hand an OPT record back to a client that didn't send one.
+		if addedOPT {
+			removeOPT(res)
+		}
+
 		// Compress the return message.
 		res.Compress = true
 
@@ -287,7 +549,7 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 
 	// If there was an upstream error, return a server failure.
 	if upstreamErr != nil {
-		log.Infoln("upstream proxy generated an error (%v)", upstreamErr)
+		log.Infof("upstream proxy generated an error (%v)", upstreamErr)
 		return dns.RcodeServerFailure, upstreamErr
 	}
 
@@ -297,8 +559,9 @@ func (e *Edge) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (
 	return plugin.NextOrFailure(e.Name(), e.Next, ctx, w, r)
 }
 
-// Write the given IP address as an Authoritative Answer to the request.
-func writeAuthoritativeResponse(res *dns.Msg, state *request.Request, ip net.IP) {
+// Write the given IP address as an Authoritative Answer to the request, along
+// with how it was resolved if meta is set.
+func writeAuthoritativeResponse(res *dns.Msg, state *request.Request, ip net.IP, meta *resolution) {
 
 	// Set the reply to the given request.
 	res.SetReply(state.Req)
@@ -320,25 +583,65 @@ func writeAuthoritativeResponse(res *dns.Msg, state *request.Request, ip net.IP)
 	}
 	res.Answer = []dns.RR{rr}
 
+	// Attach the resolution metadata.
+	if meta != nil {
+		res.SetEdns0(uint16(state.Size()), state.Do())
+		insertResolution(res, *meta, state.Size())
+	}
+
 	// Write the message.
 	state.W.WriteMsg(res)
 }
 
-// Determines the IP address of the edge site closest to the given Point.
-func findClosestToPoint(edgeSiteSet Set, p Point) net.IP {
-	var closest net.IP
-	var minDist float64
-	first := true
-	for _, val := range edgeSiteSet {
-		edgeSite := val.(Site)
-		dist := p.GreatCircleDistance(edgeSite.GeoCoords)
-		if first || dist < minDist {
-			closest = edgeSite.IP
-			minDist = dist
-			first = false
+// Determines the edge site closest to the given Location, returning the
+// candidate sites along with the chosen one. When the location is coarse, any
+// site that could be the closest given the uncertainty of both the location
+// and the sites is a candidate, and they are treated as a tie. Ties are broken
+// by rendezvous hashing on the key, so the same client keeps getting sent to
+// the same site.
+func findClosest(index *siteIndex, from Location, key string) resolution {
+
+	// Find the closest site.
+	closest, closestDist, found := index.nearest(from)
+	if !found {
+		return resolution{}
+	}
+
+	// Collect every site that is within the uncertainty radius of the closest
+	// one, and pick the sticky favourite among them.
+	slack := 2*from.Uncertainty() + closest.GeoCoords.Uncertainty()
+	sites, dists := index.within(from, closestDist+slack+index.maxUncertainty)
+	candidates := sites[:0]
+	best := 0
+	var bestScore uint64
+	for i, edgeSite := range sites {
+		if dists[i]-closestDist > slack+edgeSite.GeoCoords.Uncertainty() {
+			continue
+		}
+		score := stickiness(key, edgeSite.IP)
+		if len(candidates) == 0 || score > bestScore {
+			best, bestScore = len(candidates), score
 		}
+		candidates = append(candidates, edgeSite)
+	}
+	return resolution{Chosen: best, Candidates: candidates}
+}
+
+// Returns the rendezvous hashing score of a site for a particular client.
+func stickiness(key string, ip net.IP) uint64 {
+	h := fnv.New64a()
+	io.WriteString(h, key)
+	h.Write(ip)
+	return h.Sum64()
+}
+
+// Returns the key a request sticks to a site by: the downstream edge site it
+// was forwarded from if known, and otherwise the address it came from.
+func stickinessKey(loc edgeLocation, state request.Request) string {
+	if loc.SiteID != "" {
+		return loc.SiteID
 	}
-	return closest
+	return state.IP()
 }
 
 // Removes the root domain from a DNS address.
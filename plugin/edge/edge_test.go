@@ -0,0 +1,155 @@
+package edge
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+// Starts a DNS server that hands every request it receives to the returned
+// channel before answering it.
+func newCapturingServer() (*dnstest.Server, chan *dns.Msg) {
+	reqs := make(chan *dns.Msg, 16)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		reqs <- r.Copy()
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	return s, reqs
+}
+
+// Creates an edge site forwarding to the given upstream, with the given extra
+// options.
+func newTestEdge(t *testing.T, upstream, options string) *Edge {
+	c := caddy.NewTestController("dns", "edge 10.0.0.1 -71.06 42.36 . "+upstream+" {\nsite_id a\n"+options+"\n}")
+	e, err := parseEdge(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.locRR, err = convertLocationToLOC(e.location); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// Extracts the location of a request the way upstreams that predate the
+// location option do: from a LOC record at the very end of Extra.
+func extractLastLocationRecord(r *dns.Msg) (Location, bool) {
+	if len(r.Extra) == 0 {
+		return Location{}, false
+	}
+	loc, err := convertLOCToLocation(r.Extra[len(r.Extra)-1])
+	if err != nil {
+		return Location{}, false
+	}
+	r.Extra = r.Extra[:len(r.Extra)-1]
+	return loc, true
+}
+
+func TestLegacyLOCForwarded(t *testing.T) {
+	s, reqs := newCapturingServer()
+	defer s.Close()
+	e := newTestEdge(t, s.Addr, "legacy_loc")
+
+	m := new(dns.Msg)
+	m.SetQuestion("svc.default.svc.cluster.external.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := e.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatal(err)
+	}
+
+	// An upstream that hasn't been upgraded finds the LOC record last, even
+	// though an OPT record was added to carry the location option.
+	fwd := <-reqs
+	if fwd.IsEdns0() == nil {
+		t.Fatal("Expected the forwarded request to carry an OPT record")
+	}
+	loc, found := extractLastLocationRecord(fwd)
+	if !found {
+		t.Fatalf("Expected a LOC record at the end of Extra, got %v", fwd.Extra)
+	}
+	if math.Abs(loc.Lat-42.36) > 1e-3 || math.Abs(loc.Lon+71.06) > 1e-3 {
+		t.Errorf("Expected a location of 42.36, -71.06, got %v", loc.Point)
+	}
+}
+
+// Returns a site at the given coordinates.
+func siteAt(n int, lon, lat float64) Site {
+	site := testSite(n)
+	site.GeoCoords = Location{Point: NewPoint(lon, lat)}
+	return site
+}
+
+func TestFindClosest(t *testing.T) {
+	sites := NewSet()
+	sites.Add(siteAt(0, 0, 0))
+	sites.Add(siteAt(1, 0, 0.1))
+	sites.Add(siteAt(2, 0, 10))
+	index := newSiteIndex(sites)
+
+	// A precise location only has the closest site as a candidate.
+	meta := findClosest(index, Location{Point: NewPoint(0, 0.01)}, "client")
+	if len(meta.Candidates) != 1 || meta.Candidates[meta.Chosen].ID != "site-0" {
+		t.Errorf("Expected site-0 as the only candidate, got %+v", meta)
+	}
+
+	// A coarse location can't tell the two nearby sites apart, but still
+	// rules out the far away one.
+	coarse := Location{Point: NewPoint(0, 0.01), Precision: 20000}
+	meta = findClosest(index, coarse, "client")
+	if len(meta.Candidates) != 2 {
+		t.Fatalf("Expected 2 candidates, got %+v", meta)
+	}
+	for _, site := range meta.Candidates {
+		if site.ID == "site-2" {
+			t.Errorf("Expected site-2 not to be a candidate, got %+v", meta)
+		}
+	}
+
+	if meta := findClosest(newSiteIndex(NewSet()), coarse, "client"); len(meta.Candidates) != 0 {
+		t.Errorf("Expected no candidates in an empty index, got %+v", meta)
+	}
+}
+
+func TestFindClosestTieBreaking(t *testing.T) {
+	// Two sites exactly as far from the client.
+	sites := NewSet()
+	sites.Add(siteAt(0, 0, 1))
+	sites.Add(siteAt(1, 0, -1))
+	index := newSiteIndex(sites)
+	from := Location{Point: NewPoint(0, 0)}
+
+	chosen := make(map[string]int)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("client-%d", i)
+		meta := findClosest(index, from, key)
+		if len(meta.Candidates) != 2 {
+			t.Fatalf("Expected both sites as candidates, got %+v", meta)
+		}
+		site := meta.Candidates[meta.Chosen]
+
+		// The tie is broken by the highest stickiness score, so the same
+		// client always gets the same site.
+		for _, other := range meta.Candidates {
+			if stickiness(key, other.IP) > stickiness(key, site.IP) {
+				t.Fatalf("%s: chose %s over %s with a higher score", key, site.ID, other.ID)
+			}
+		}
+		if again := findClosest(index, from, key); again.Candidates[again.Chosen].ID != site.ID {
+			t.Fatalf("%s: chose %s, then %s", key, site.ID, again.Candidates[again.Chosen].ID)
+		}
+		chosen[site.ID]++
+	}
+
+	// Different clients are spread across both sites.
+	if chosen["site-0"] == 0 || chosen["site-1"] == 0 {
+		t.Errorf("Expected clients to be spread across both sites, got %v", chosen)
+	}
+}
@@ -0,0 +1,80 @@
+package edge
+
+import (
+	"encoding/binary"
+
+	"github.com/miekg/dns"
+)
+
+// EDNS0 local option codes used between edge sites.
+const (
+	locationOptionCode = dns.EDNS0LOCALSTART + iota
+	pathOptionCode
+	resolutionOptionCode
+)
+
+// The Extended DNS Error option code and the info code for errors that
+// don't fit any of the registered ones (RFC 8914).
+const (
+	edeOptionCode = 15
+	edeOther      = 0
+)
+
+// Returns the data of the local EDNS0 option with the given code and removes
+// the option from the message, if it exists.
+func extractOption(r *dns.Msg, code uint16) ([]byte, bool) {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil, false
+	}
+	for i, o := range opt.Option {
+		local, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || local.Code != code {
+			continue
+		}
+		opt.Option = append(opt.Option[:i], opt.Option[i+1:]...)
+		return local.Data, true
+	}
+	return nil, false
+}
+
+// Sets a local EDNS0 option on the message, replacing any existing option
+// with the same code. If the message has no OPT record, one is added with
+// the minimum UDP size and true is returned, so the caller knows to strip it
+// from the reply again.
+func insertOption(r *dns.Msg, code uint16, data []byte) bool {
+	added := false
+	opt := r.IsEdns0()
+	if opt == nil {
+		r.SetEdns0(dns.MinMsgSize, false)
+		opt = r.IsEdns0()
+		added = true
+	}
+	extractOption(r, code)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: code, Data: data})
+	return added
+}
+
+// Removes the OPT record from a message, for replies to clients that didn't
+// send one in the first place.
+func removeOPT(m *dns.Msg) {
+	extra := m.Extra[:0]
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Extra = extra
+}
+
+// Attaches an Extended DNS Error to a reply, if the reply can carry EDNS0.
+func insertExtendedError(m *dns.Msg, infoCode uint16, text string) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	data := make([]byte, 2+len(text))
+	binary.BigEndian.PutUint16(data, infoCode)
+	copy(data[2:], text)
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{Code: edeOptionCode, Data: data})
+}
@@ -12,6 +12,34 @@ var (
 	errTableParseFailure     = errors.New("unable to parse Table returned from upstream")
 	errFindingClosestCluster = errors.New("unable to compute closest edge cluster")
 	errInvalidIP             = errors.New("invalid IP address")
+	errMissingSiteID         = errors.New("site_id is required")
 	errInvalidLOC            = errors.New("unable to parse LOC record")
+	errInvalidLocation       = errors.New("unable to parse location option")
+	errInvalidPath           = errors.New("unable to parse path option")
+	errInvalidResolution     = errors.New("unable to parse resolution option")
+	errInvalidTsigAlgorithm  = errors.New("unsupported TSIG algorithm")
+	errInvalidTsigSecret     = errors.New("TSIG secret must be base64 encoded")
+	errSyncDigestMismatch    = errors.New("digest mismatch in table sync")
+	errSyncNeedsServices     = errors.New("upstream needs the full set of services")
+	errSessionDown           = errors.New("no session with upstream")
+	errSessionTimeout        = errors.New("timed out waiting for upstream to acknowledge batch")
+	errInvalidHmacSecret     = errors.New("HMAC secret must be base64 encoded")
+	errInvalidHmacSignature  = errors.New("invalid HMAC signature")
+	errUnknownHmacKey        = errors.New("unknown HMAC key")
+	errPushTLSConfig         = errors.New("push_tls requires tls with a certificate, key and CA")
+	errInvalidServicePattern = errors.New("service patterns must look like NAMESPACE/NAME")
+	errUnknownIdentity       = errors.New("no authorization for identity")
+	errNoSiteID              = errors.New("site has no ID")
+	errInvalidSiteLocation   = errors.New("site coordinates out of range")
+	errNetworkNotAllowed     = errors.New("site IP not in an allowed network")
+	errSiteNotAllowed        = errors.New("site ID not allowed")
+	errInvalidSitePattern    = errors.New("invalid site ID pattern")
+	errServiceNotAllowed     = errors.New("service not allowed")
+	errAuthzWithoutAuth      = errors.New("allow_services, allow_networks and allow_sites require push_tls or hmac_key")
+	errGrpcHmacWithoutTLS    = errors.New("grpc with hmac_key or hmac_sign requires push_tls")
+	errFeedRejected          = errors.New("upstream rejected feed request")
 	errEventParseFailure     = errors.New("unrecognized watch event type")
+	errPoolExhausted         = errors.New("timed out waiting for a free upstream connection")
+	errPipelineTimeout       = errors.New("timed out waiting for pipelined reply")
+	errPipelineFull          = errors.New("no room for another query on pipelined connections")
 )
@@ -21,6 +21,10 @@ const (
 type ServiceEvent struct {
 	Type    ServiceEventType `json:"type"`
 	Service string           `json:"service"`
+
+	// Increases with every event sent by a site, so upstreams can tell which
+	// of two events for the same service is the latest. Zero if unknown.
+	Generation uint64 `json:"gen,omitempty"`
 }
 
 // Parses a client-go event and converts it to our ServiceEvent type.
@@ -0,0 +1,253 @@
+package edge
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFeedInterval = 30 * time.Second
+	minFeedInterval     = time.Second
+	feedPath            = "/feed"
+
+	// The number of feed intervals entries received from a feed are kept for,
+	// so that a single late snapshot doesn't drop them.
+	feedIntervalsPerTTL = 3
+)
+
+// FeedRequest registers a downstream edge site for a feed of its upstream's
+// table. The upstream replies with a stream of ServiceTableSnapshots, one
+// every Interval seconds, for as long as the request stays open.
+type FeedRequest struct {
+	Meta     Site   `json:"meta"`
+	Interval uint32 `json:"interval"`
+
+	// Only sites within this many kilometers of the downstream site are sent.
+	// Zero sends every site.
+	Radius float64 `json:"radius,omitempty"`
+}
+
+// children holds the downstream edge sites currently registered for a feed.
+type children struct {
+	sync.Mutex
+	sites map[uint64]Site
+}
+
+// Registers a downstream site for a feed.
+func (c *children) add(site Site) {
+	c.Lock()
+	defer c.Unlock()
+	if c.sites == nil {
+		c.sites = make(map[uint64]Site)
+	}
+	c.sites[hashOf(site)] = site
+}
+
+// Unregisters a downstream site once its feed ends.
+func (c *children) remove(site Site) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.sites, hashOf(site))
+}
+
+// Returns the registered downstream sites by hash.
+func (c *children) list() map[uint64]Site {
+	c.Lock()
+	defer c.Unlock()
+	sites := make(map[uint64]Site, len(c.sites))
+	for hash, site := range c.sites {
+		sites[hash] = site
+	}
+	return sites
+}
+
+// Returns a copy of the table holding only the sites within radius km of
+// the given site, leaving out the site itself.
+func (e *Edge) filteredSnapshot(to Site, radius float64) map[string][]Site {
+	own := hashOf(to)
+	snapshot := e.table.Snapshot()
+	for serviceName, sites := range snapshot {
+		filtered := sites[:0]
+		for _, site := range sites {
+			if hashOf(site) == own {
+				continue
+			}
+			if radius > 0 && to.GeoCoords.Distance(site.GeoCoords) > radius {
+				continue
+			}
+			filtered = append(filtered, site)
+		}
+		if len(filtered) == 0 {
+			delete(snapshot, serviceName)
+		} else {
+			snapshot[serviceName] = filtered
+		}
+	}
+	return snapshot
+}
+
+// Streams the table to a registered downstream edge site, if the identity it
+// connected with may push updates for the site it registers as.
+func (e *Edge) serveFeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	jsn, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln("error while reading feed request:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	req := FeedRequest{}
+	if err = json.Unmarshal(jsn, &req); err != nil {
+		log.Errorln("error while unmarshalling JSON into feed request struct:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err = e.authorizeSite(identityFrom(r.Context()), req.Meta); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	interval := time.Duration(req.Interval) * time.Second
+	if interval < minFeedInterval {
+		interval = minFeedInterval
+	}
+
+	// Register the child for as long as the stream lasts.
+	e.children.add(req.Meta)
+	defer e.children.remove(req.Meta)
+	log.Infof("streaming table to site %s (%s) every %s", req.Meta.ID, req.Meta.IP, interval)
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		snapshot := ServiceTableSnapshot{
+			Meta:  e.site,
+			Table: e.filteredSnapshot(req.Meta, req.Radius),
+		}
+		if err := enc.Encode(snapshot); err != nil {
+			log.Infof("feed to site %s (%s) ended: %v", req.Meta.ID, req.Meta.IP, err)
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		case <-e.feedStop:
+			return
+		}
+	}
+}
+
+// Subscribes to the table feed of every upstream, adding the sites it carries
+// to my table so requests can be sent to sibling sites directly.
+func (e *Edge) startFollowingFeeds() {
+	if e.feedInterval <= 0 || len(e.proxies) == 0 {
+		return
+	}
+	for _, p := range e.proxies {
+		go e.followFeed(p)
+	}
+}
+
+// Follows the table feed of a single upstream, reconnecting with a backoff
+// whenever the stream ends.
+func (e *Edge) followFeed(p *Proxy) {
+	req := FeedRequest{
+		Meta:     e.site,
+		Interval: uint32(e.feedInterval / time.Second),
+		Radius:   e.feedRadius,
+	}
+	jsn, err := json.Marshal(req)
+	if err != nil {
+		log.Errorf("unable to marshal feed request: %v", err)
+		return
+	}
+	backoff := minPushBackoff
+	for {
+		// The table is fed over the session instead while there is one.
+		if p.session.Up() {
+			select {
+			case <-time.After(e.feedInterval):
+				continue
+			case <-e.feedStop:
+				return
+			}
+		}
+		if err := e.readFeed(p, jsn); err != nil {
+			log.Errorf("feed from upstream %s ended: %v (reconnecting in %s)", p.addr, err, backoff)
+		} else {
+			backoff = minPushBackoff
+		}
+		select {
+		case <-time.After(backoff):
+		case <-e.feedStop:
+			return
+		}
+		if backoff *= 2; backoff > maxPushBackoff {
+			backoff = maxPushBackoff
+		}
+	}
+}
+
+// Reads snapshots off a single feed connection until it ends.
+func (e *Edge) readFeed(p *Proxy, jsn []byte) error {
+	req, err := p.newPushRequest(http.MethodPost, feedPath, jsn)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-e.feedStop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	client := &http.Client{Transport: p.pushTransport}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errFeedRejected
+	}
+	dec := json.NewDecoder(resp.Body)
+	for {
+		snapshot := ServiceTableSnapshot{}
+		if err := dec.Decode(&snapshot); err != nil {
+			return err
+		}
+		e.applyFeed(snapshot, p.addr)
+	}
+}
+
+// Adds the sites in a snapshot fed by an upstream to my table, for a few feed
+// intervals.
+func (e *Edge) applyFeed(snapshot ServiceTableSnapshot, from string) {
+	expires := time.Now().Add(feedIntervalsPerTTL * e.feedInterval)
+	own := hashOf(e.site)
+	for serviceName, sites := range snapshot.Table {
+		for _, site := range sites {
+			if hashOf(site) != own {
+				e.table.AddWithExpiry(site, serviceName, expires)
+			}
+		}
+	}
+	log.Debugf("received table of %d services from upstream %s", len(snapshot.Table), from)
+}
@@ -0,0 +1,113 @@
+package edge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFilteredSnapshot(t *testing.T) {
+	e := New()
+	child := siteAt(0, 0, 0)
+	near := siteAt(1, 0, 1)
+	far := siteAt(2, 0, 45)
+	e.table.Add(child, "default/a")
+	e.table.Add(near, "default/a")
+	e.table.Add(far, "default/b")
+	e.table.Add(child, "default/c")
+
+	// The child never gets its own entries back, and services it's the only
+	// site running are left out altogether.
+	snapshot := e.filteredSnapshot(child, 0)
+	if len(snapshot) != 2 || len(snapshot["default/a"]) != 1 || snapshot["default/a"][0].ID != near.ID || len(snapshot["default/b"]) != 1 {
+		t.Errorf("Expected a at the near site and b at the far one, got %+v", snapshot)
+	}
+
+	// A radius leaves out the sites further away.
+	snapshot = e.filteredSnapshot(child, 500)
+	if len(snapshot) != 1 || len(snapshot["default/a"]) != 1 {
+		t.Errorf("Expected only a at the near site, got %+v", snapshot)
+	}
+}
+
+func TestApplyFeed(t *testing.T) {
+	e := New()
+	e.siteID = "site-0"
+	e.site = siteAt(0, 0, 0)
+	e.feedInterval = 10 * time.Second
+	sibling := siteAt(1, 0, 1)
+
+	e.applyFeed(ServiceTableSnapshot{Table: map[string][]Site{
+		"default/a": {sibling, e.site},
+	}}, "upstream")
+
+	// My own entries aren't taken from the feed.
+	if services := e.table.ServicesOf(e.site); len(services) != 0 {
+		t.Errorf("Expected no entries for my own site, got %v", services)
+	}
+	if services := e.table.ServicesOf(sibling); len(services) != 1 || !e.table.Expiring(sibling) {
+		t.Fatalf("Expected an expiring entry for the sibling, got %v", services)
+	}
+
+	// The entries outlive a late snapshot, but not a feed that stopped.
+	e.table.RemoveExpired(time.Now().Add(e.feedInterval))
+	if services := e.table.ServicesOf(sibling); len(services) != 1 {
+		t.Errorf("Expected the entry to survive a late snapshot, got %v", services)
+	}
+	e.table.RemoveExpired(time.Now().Add(feedIntervalsPerTTL*e.feedInterval + time.Second))
+	if services := e.table.ServicesOf(sibling); len(services) != 0 {
+		t.Errorf("Expected the entry to expire, got %v", services)
+	}
+}
+
+// Sends a feed request from the given identity, returning the response once
+// the feed has been served for a moment.
+func requestFeed(e *Edge, identity string, req FeedRequest) (*httptest.ResponseRecorder, bool) {
+	jsn, _ := json.Marshal(req)
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), identityKey{}, identity))
+	r := httptest.NewRequest(http.MethodPost, feedPath, bytes.NewReader(jsn)).WithContext(ctx)
+	w := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		e.serveFeed(w, r)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	registered := len(e.children.list()) > 0
+	cancel()
+	<-done
+	return w, registered
+}
+
+func TestServeFeedAuthorization(t *testing.T) {
+	e := New()
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	e.authorizationOf("edge-a").networks = []*net.IPNet{network}
+	allowed := Site{ID: "edge-a", IP: net.ParseIP("10.1.0.1")}
+
+	tests := []struct {
+		name     string
+		identity string
+		meta     Site
+		ok       bool
+	}{
+		{"allowed", "edge-a", allowed, true},
+		{"outside network", "edge-a", Site{ID: "edge-a", IP: net.ParseIP("10.2.0.1")}, false},
+		{"unknown identity", "edge-b", allowed, false},
+		{"no site ID", "edge-a", Site{IP: net.ParseIP("10.1.0.1")}, false},
+	}
+	for _, test := range tests {
+		w, registered := requestFeed(e, test.identity, FeedRequest{Meta: test.meta, Interval: 1})
+		if registered != test.ok || (w.Code == http.StatusOK) != test.ok {
+			t.Errorf("%s: expected the feed to be served: %v, got status %d and registered %v", test.name, test.ok, w.Code, registered)
+		}
+	}
+	if children := e.children.list(); len(children) != 0 {
+		t.Errorf("Expected no children once the feeds ended, got %v", children)
+	}
+}
@@ -0,0 +1,136 @@
+package edge
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Returns the generation to stamp the next outgoing service event with.
+// Generations are seeded from the clock when the edge site starts, so they
+// usually keep increasing across restarts without being persisted. Since the
+// clock may have gone backwards in the meantime, every run also has its own
+// ID, and upstreams start counting afresh when a site's run changes.
+func (e *Edge) nextGeneration() uint64 {
+	return atomic.AddUint64(&e.generation, 1)
+}
+
+// Returns the generation of the last outgoing service event.
+func (e *Edge) currentGeneration() uint64 {
+	return atomic.LoadUint64(&e.generation)
+}
+
+// Creates the starting generation for this run of the edge site.
+func initialGeneration() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// Creates a random ID for this run of the edge site.
+func newRunID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("unable to create run ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// generationTable holds the generation of the last service event applied for
+// each (site, service) pair, so events that arrive out of order or more than
+// once can be discarded. It also holds the generation of the last sync applied
+// for each site, which no event for any of its services may be older than,
+// and the runs of each site that those generations were counted in.
+type generationTable struct {
+	sync.Mutex
+	seen   map[uint64]map[string]uint64
+	floors map[uint64]uint64
+	runs   map[uint64]siteRuns
+}
+
+// The current run of a site, and the one before it.
+type siteRuns struct {
+	current, previous string
+}
+
+// Creates a new, empty generation table.
+func newGenerationTable() *generationTable {
+	return &generationTable{
+		seen:   make(map[uint64]map[string]uint64),
+		floors: make(map[uint64]uint64),
+		runs:   make(map[uint64]siteRuns),
+	}
+}
+
+// CheckRun records the run of a site that an update came from, and returns
+// false if it's the run the site left behind when it last restarted, which
+// only a late or replayed update can come from. A new run drops every
+// generation recorded for the site, since the restarted site counts them
+// afresh. Updates without a run come from sites that don't send one, and are
+// always let through.
+func (gt *generationTable) CheckRun(meta Site, run string) bool {
+	if run == "" {
+		return true
+	}
+	gt.Lock()
+	defer gt.Unlock()
+	hash := hashOf(meta)
+	runs := gt.runs[hash]
+	switch run {
+	case runs.current:
+		return true
+	case runs.previous:
+		return false
+	}
+	if runs.current != "" {
+		log.Infof("site %s (%s) restarted, resetting its generations", meta.ID, meta.IP)
+	}
+	delete(gt.seen, hash)
+	delete(gt.floors, hash)
+	gt.runs[hash] = siteRuns{current: run, previous: runs.current}
+	return true
+}
+
+// Advance records the generation of an event for a service at a site, and
+// returns false if an event with the same or a later generation has already
+// been applied. Events without a generation come from sites that don't stamp
+// them, and are always applied.
+func (gt *generationTable) Advance(meta Site, service string, generation uint64) bool {
+	if generation == 0 {
+		return true
+	}
+	gt.Lock()
+	defer gt.Unlock()
+	hash := hashOf(meta)
+	services, found := gt.seen[hash]
+	if !found {
+		services = make(map[string]uint64)
+		gt.seen[hash] = services
+	}
+	if generation <= services[service] || generation <= gt.floors[hash] {
+		return false
+	}
+	services[service] = generation
+	return true
+}
+
+// AdvanceSite records the generation of a sync applied for a site, so events
+// for any of its services with the same or an earlier generation are
+// discarded from then on.
+func (gt *generationTable) AdvanceSite(meta Site, generation uint64) {
+	gt.Lock()
+	defer gt.Unlock()
+	hash := hashOf(meta)
+	if generation > gt.floors[hash] {
+		gt.floors[hash] = generation
+	}
+}
+
+// Forget drops every generation recorded for a site.
+func (gt *generationTable) Forget(meta Site) {
+	gt.Lock()
+	defer gt.Unlock()
+	delete(gt.seen, hashOf(meta))
+	delete(gt.floors, hashOf(meta))
+	delete(gt.runs, hashOf(meta))
+}
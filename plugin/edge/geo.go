@@ -5,6 +5,7 @@ import "math"
 const (
 	earthRaidusKm = 6371
 	radianScalar  = math.Pi / 180.0
+	metersPerKm   = 1000.0
 )
 
 // Point represents a point on the planet.
@@ -39,3 +40,39 @@ func (p1 Point) GreatCircleDistance(p2 Point) float64 {
 
 	return earthRaidusKm * c
 }
+
+// Location is a Point along with its altitude and how precisely it is known,
+// mirroring the fields of a DNS LOC record (RFC 1876). All values are in meters.
+type Location struct {
+	Point
+	Altitude      float64 `json:"alt,omitempty"`
+	Size          float64 `json:"size,omitempty"`
+	Precision     float64 `json:"hp,omitempty"`
+	VertPrecision float64 `json:"vp,omitempty"`
+}
+
+// Distance returns the distance in kilometers between two locations, taking
+// the difference in altitude into account.
+func (l1 Location) Distance(l2 Location) float64 {
+	surface := l1.GreatCircleDistance(l2.Point)
+	height := (l2.Altitude - l1.Altitude) / metersPerKm
+	return math.Sqrt(surface*surface + height*height)
+}
+
+// Valid returns true if the location is a finite point on the globe, with
+// finite, non-negative sizes.
+func (l1 Location) Valid() bool {
+	for _, v := range []float64{l1.Lat, l1.Lon, l1.Altitude, l1.Size, l1.Precision, l1.VertPrecision} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return false
+		}
+	}
+	return l1.Lat >= -90 && l1.Lat <= 90 && l1.Lon >= -180 && l1.Lon <= 180 &&
+		l1.Size >= 0 && l1.Precision >= 0 && l1.VertPrecision >= 0
+}
+
+// Uncertainty returns the radius in kilometers around the location within
+// which the actual position may lie.
+func (l1 Location) Uncertainty() float64 {
+	return (l1.Precision + l1.Size/2) / metersPerKm
+}
@@ -0,0 +1,20 @@
+package edge
+
+import "testing"
+
+func TestUncertainty(t *testing.T) {
+	tests := []struct {
+		loc  Location
+		want float64
+	}{
+		{Location{}, 0},
+		{Location{Precision: 1000}, 1},
+		{Location{Size: 30}, 0.015},
+		{Location{Precision: 1000, Size: 30}, 1.015},
+	}
+	for _, test := range tests {
+		if got := test.loc.Uncertainty(); got != test.want {
+			t.Errorf("%+v: expected %v km, got %v km", test.loc, test.want, got)
+		}
+	}
+}
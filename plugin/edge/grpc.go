@@ -0,0 +1,321 @@
+package edge
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/optikon/coredns/plugin/edge/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const grpcPort = "8054"
+
+// Converts a site to its protobuf form.
+func siteToProto(s Site) *pb.Site {
+	return &pb.Site{
+		Id:      s.ID,
+		Ip:      s.IP.To16(),
+		Lat:     s.GeoCoords.Lat,
+		Lon:     s.GeoCoords.Lon,
+		Alt:     s.GeoCoords.Altitude,
+		Size:    s.GeoCoords.Size,
+		Hp:      s.GeoCoords.Precision,
+		Vp:      s.GeoCoords.VertPrecision,
+		Name:    s.Name,
+		Region:  s.Region,
+		Labels:  s.Labels,
+		Contact: s.Contact,
+	}
+}
+
+// Converts a site from its protobuf form. IPs are kept in their 16 byte form,
+// as they are when parsed from JSON, so the site hashes the same either way.
+func siteFromProto(s *pb.Site) Site {
+	if s == nil {
+		return Site{}
+	}
+	return Site{
+		ID: s.Id,
+		IP: net.IP(s.Ip).To16(),
+		GeoCoords: Location{
+			Point:         NewPoint(s.Lon, s.Lat),
+			Altitude:      s.Alt,
+			Size:          s.Size,
+			Precision:     s.Hp,
+			VertPrecision: s.Vp,
+		},
+		Name:    s.Name,
+		Region:  s.Region,
+		Labels:  s.Labels,
+		Contact: s.Contact,
+	}
+}
+
+// Converts a batch to its protobuf form.
+func batchToProto(b ServiceTableBatch, seq uint64) *pb.Batch {
+	events := make([]*pb.Event, len(b.Events))
+	for i, evt := range b.Events {
+		events[i] = &pb.Event{
+			Type:       pb.Event_Type(evt.Type),
+			Service:    evt.Service,
+			Generation: evt.Generation,
+		}
+	}
+	return &pb.Batch{
+		Meta:   siteToProto(b.Meta),
+		Events: events,
+		Path:   b.Path,
+		Seq:    seq,
+		Run:    b.Run,
+	}
+}
+
+// Converts a batch from its protobuf form.
+func batchFromProto(b *pb.Batch) ServiceTableBatch {
+	events := make([]ServiceEvent, len(b.Events))
+	for i, evt := range b.Events {
+		events[i] = ServiceEvent{
+			Type:       ServiceEventType(evt.Type),
+			Service:    evt.Service,
+			Generation: evt.Generation,
+		}
+	}
+	return ServiceTableBatch{
+		Meta:   siteFromProto(b.Meta),
+		Events: events,
+		Path:   b.Path,
+		Run:    b.Run,
+	}
+}
+
+// Converts a heartbeat to its protobuf form.
+func heartbeatToProto(hb Heartbeat) *pb.Heartbeat {
+	return &pb.Heartbeat{
+		Meta: siteToProto(hb.Meta),
+		Ttl:  hb.TTL,
+		Path: hb.Path,
+	}
+}
+
+// Converts a heartbeat from its protobuf form.
+func heartbeatFromProto(hb *pb.Heartbeat) Heartbeat {
+	return Heartbeat{
+		Meta: siteFromProto(hb.Meta),
+		TTL:  hb.Ttl,
+		Path: hb.Path,
+	}
+}
+
+// Converts a sync to its protobuf form.
+func syncToProto(s ServiceTableSync) *pb.Sync {
+	return &pb.Sync{
+		Meta:       siteToProto(s.Meta),
+		Services:   s.Services,
+		Digest:     s.Digest,
+		Path:       s.Path,
+		Full:       s.Full,
+		Generation: s.Generation,
+		Run:        s.Run,
+	}
+}
+
+// Converts a sync from its protobuf form.
+func syncFromProto(s *pb.Sync) ServiceTableSync {
+	return ServiceTableSync{
+		Meta:       siteFromProto(s.Meta),
+		Services:   s.Services,
+		Digest:     s.Digest,
+		Path:       s.Path,
+		Full:       s.Full,
+		Generation: s.Generation,
+		Run:        s.Run,
+	}
+}
+
+// Converts a table snapshot to its protobuf form.
+func snapshotToProto(s ServiceTableSnapshot) *pb.Snapshot {
+	entries := make([]*pb.Entry, 0, len(s.Table))
+	for serviceName, sites := range s.Table {
+		entry := &pb.Entry{Service: serviceName, Sites: make([]*pb.Site, len(sites))}
+		for i, site := range sites {
+			entry.Sites[i] = siteToProto(site)
+		}
+		entries = append(entries, entry)
+	}
+	return &pb.Snapshot{Meta: siteToProto(s.Meta), Entries: entries}
+}
+
+// Converts a table snapshot from its protobuf form.
+func snapshotFromProto(s *pb.Snapshot) ServiceTableSnapshot {
+	table := make(map[string][]Site, len(s.Entries))
+	for _, entry := range s.Entries {
+		sites := make([]Site, len(entry.Sites))
+		for i, site := range entry.Sites {
+			sites[i] = siteFromProto(site)
+		}
+		table[entry.Service] = sites
+	}
+	return ServiceTableSnapshot{Meta: siteFromProto(s.Meta), Table: table}
+}
+
+// edgeServer serves sessions with downstream edge sites over gRPC.
+type edgeServer struct {
+	e *Edge
+}
+
+// Session handles a single session with a downstream edge site: applying the
+// table updates it sends, acknowledging its batches and, if it asked for a
+// feed, streaming my table back to it. Sessions are refused if the identity
+// they're opened with may not push updates for the site they register as.
+func (s edgeServer) Session(stream pb.Edge_SessionServer) error {
+	e := s.e
+	identity, err := e.authenticateSession(stream.Context())
+	if err != nil {
+		log.Errorf("rejected session: %v", err)
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	up, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	reg := up.GetRegister()
+	if reg == nil {
+		return status.Error(codes.InvalidArgument, "session must start with a registration")
+	}
+	meta := siteFromProto(reg.Meta)
+	if err := e.authorizeSite(identity, meta); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	log.Infof("opened session with site %s (%s)", meta.ID, meta.IP)
+	defer log.Infof("closed session with site %s (%s)", meta.ID, meta.IP)
+
+	// Streams can't be sent on from more than one goroutine at once.
+	var mu sync.Mutex
+	send := func(down *pb.Down) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return stream.Send(down)
+	}
+
+	// Feed my table to the site if it asked for it.
+	done := make(chan struct{})
+	defer close(done)
+	if reg.FeedInterval > 0 {
+		interval := time.Duration(reg.FeedInterval) * time.Second
+		if interval < minFeedInterval {
+			interval = minFeedInterval
+		}
+		e.children.add(meta)
+		defer e.children.remove(meta)
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				snapshot := ServiceTableSnapshot{
+					Meta:  e.site,
+					Table: e.filteredSnapshot(meta, reg.FeedRadius),
+				}
+				if err := send(&pb.Down{Msg: &pb.Down_Snapshot{Snapshot: snapshotToProto(snapshot)}}); err != nil {
+					return
+				}
+				select {
+				case <-ticker.C:
+				case <-done:
+					return
+				case <-e.feedStop:
+					return
+				}
+			}
+		}()
+	}
+
+	// Apply everything the site sends until it hangs up.
+	for {
+		up, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch msg := up.Msg.(type) {
+		case *pb.Up_Batch:
+			// Rejected batches are acknowledged too, since sending them
+			// again won't change the outcome.
+			e.applyBatch(identity, batchFromProto(msg.Batch))
+			if err := send(&pb.Down{Msg: &pb.Down_Ack{Ack: &pb.Ack{Seq: msg.Batch.Seq}}}); err != nil {
+				return err
+			}
+		case *pb.Up_Heartbeat:
+			e.applyHeartbeat(identity, heartbeatFromProto(msg.Heartbeat))
+		case *pb.Up_Sync:
+			sync := syncFromProto(msg.Sync)
+			if err := e.applySync(identity, sync); err == errSyncNeedsServices {
+				if err := send(&pb.Down{Msg: &pb.Down_Resync{Resync: msg.Sync}}); err != nil {
+					return err
+				}
+			} else if err == errSyncDigestMismatch {
+				log.Errorf("%v from %s", err, sync.Meta.IP)
+			}
+		default:
+			log.Errorf("unexpected message in session with site %s: %T", meta.IP, up.Msg)
+		}
+	}
+}
+
+// Sets up a gRPC session with every upstream, opened once the proxies start.
+func (e *Edge) startSessions() {
+	if !e.grpc {
+		return
+	}
+	register := &pb.Register{Meta: siteToProto(e.site)}
+	if e.feedInterval > 0 {
+		register.FeedInterval = uint32(e.feedInterval / time.Second)
+		register.FeedRadius = e.feedRadius
+	}
+	for _, p := range e.proxies {
+		p, from := p, p.addr
+		p.EnableSession(register, p.sessionDialOptions(), func(snapshot ServiceTableSnapshot) {
+			e.applyFeed(snapshot, from)
+		}, func(sync ServiceTableSync) {
+			if err := p.sendSync(e.fullSync(sync)); err != nil {
+				log.Errorf("unable to send services of site %s to upstream %s: %v", sync.Meta.ID, from, err)
+			}
+		})
+	}
+}
+
+// Start serving gRPC sessions on e.grpcAddr.
+func (e *Edge) startServingSessions() {
+	if !e.grpc {
+		return
+	}
+	ln, err := net.Listen("tcp", e.grpcAddr)
+	if err != nil {
+		log.Fatalf("unable to listen for gRPC sessions: %v", err)
+	}
+	var opts []grpc.ServerOption
+	if e.pushTLS {
+		opts = append(opts, grpc.Creds(credentials.NewTLS(e.pushServerTLSConfig())))
+	}
+	e.grpcServer = grpc.NewServer(opts...)
+	pb.RegisterEdgeServer(e.grpcServer, edgeServer{e: e})
+	go func() {
+		if err := e.grpcServer.Serve(ln); err != nil {
+			log.Errorf("gRPC server error: %v", err)
+		}
+	}()
+}
+
+// Stop serving gRPC sessions.
+func (e *Edge) stopServingSessions() {
+	if e.grpcServer != nil {
+		e.grpcServer.Stop()
+	}
+}
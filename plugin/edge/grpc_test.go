@@ -0,0 +1,232 @@
+package edge
+
+import (
+	"math"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/optikon/coredns/plugin/edge/pb"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Returns a site with every field set.
+func fullSite() Site {
+	return Site{
+		ID: "edge-1",
+		IP: net.ParseIP("10.0.0.1"),
+		GeoCoords: Location{
+			Point:         NewPoint(-71.06, 42.36),
+			Altitude:      43,
+			Size:          30,
+			Precision:     1000,
+			VertPrecision: 10,
+		},
+		Name:    "Boston",
+		Region:  "us-east",
+		Labels:  map[string]string{"tier": "edge"},
+		Contact: "ops@example.org",
+	}
+}
+
+func TestSiteProtoRoundTrip(t *testing.T) {
+	site := fullSite()
+	if got := siteFromProto(siteToProto(site)); !reflect.DeepEqual(got, site) {
+		t.Errorf("Expected %+v, got %+v", site, got)
+	}
+
+	// IPv4 addresses come back in their 16 byte form, so the site hashes the
+	// same as when it's parsed from JSON.
+	site.IP = site.IP.To4()
+	if got := siteFromProto(siteToProto(site)); hashOf(got) != hashOf(fullSite()) {
+		t.Errorf("Expected %+v to hash like %+v", got, fullSite())
+	}
+
+	if got := siteFromProto(nil); !reflect.DeepEqual(got, Site{}) {
+		t.Errorf("Expected an empty site, got %+v", got)
+	}
+}
+
+func TestUpdateProtoRoundTrip(t *testing.T) {
+	batch := ServiceTableBatch{
+		Meta:   fullSite(),
+		Events: []ServiceEvent{{Type: Add, Service: "default/a", Generation: 1}, {Type: Delete, Service: "default/b", Generation: 2}},
+		Path:   []string{"relay"},
+		Run:    "run-1",
+	}
+	pbBatch := batchToProto(batch, 7)
+	if pbBatch.Seq != 7 {
+		t.Errorf("Expected seq 7, got %d", pbBatch.Seq)
+	}
+	if got := batchFromProto(pbBatch); !reflect.DeepEqual(got, batch) {
+		t.Errorf("Expected %+v, got %+v", batch, got)
+	}
+
+	hb := Heartbeat{Meta: fullSite(), TTL: 30, Path: []string{"relay"}}
+	if got := heartbeatFromProto(heartbeatToProto(hb)); !reflect.DeepEqual(got, hb) {
+		t.Errorf("Expected %+v, got %+v", hb, got)
+	}
+
+	sync := ServiceTableSync{
+		Meta:       fullSite(),
+		Services:   []string{"default/a"},
+		Digest:     digestServices([]string{"default/a"}),
+		Full:       true,
+		Generation: 3,
+		Run:        "run-1",
+		Path:       []string{"relay"},
+	}
+	if got := syncFromProto(syncToProto(sync)); !reflect.DeepEqual(got, sync) {
+		t.Errorf("Expected %+v, got %+v", sync, got)
+	}
+
+	snapshot := ServiceTableSnapshot{Meta: fullSite(), Table: map[string][]Site{"default/a": {fullSite()}}}
+	if got := snapshotFromProto(snapshotToProto(snapshot)); !reflect.DeepEqual(got, snapshot) {
+		t.Errorf("Expected %+v, got %+v", snapshot, got)
+	}
+}
+
+func TestAuthorizeSiteLocation(t *testing.T) {
+	e := New()
+	tests := []struct {
+		name string
+		loc  Location
+		ok   bool
+	}{
+		{"valid", fullSite().GeoCoords, true},
+		{"poles and antimeridian", Location{Point: NewPoint(-180, 90)}, true},
+		{"NaN latitude", Location{Point: NewPoint(0, math.NaN())}, false},
+		{"infinite longitude", Location{Point: NewPoint(math.Inf(1), 0)}, false},
+		{"latitude > 90", Location{Point: NewPoint(0, 90.5)}, false},
+		{"longitude < -180", Location{Point: NewPoint(-180.5, 0)}, false},
+		{"NaN altitude", Location{Altitude: math.NaN()}, false},
+		{"negative precision", Location{Precision: -1}, false},
+	}
+	for _, test := range tests {
+		site := fullSite()
+		site.GeoCoords = test.loc
+		if err := e.authorizeSite("", site); (err == nil) != test.ok {
+			t.Errorf("%s: expected the site to be allowed: %v, got %v", test.name, test.ok, err)
+		}
+	}
+}
+
+func TestServeDNSNoCandidates(t *testing.T) {
+	s, reqs := newCapturingServer()
+	defer s.Close()
+	e := newTestEdge(t, s.Addr, "")
+
+	// A site that slipped into the table without valid coordinates can't be
+	// the closest, so the request is forwarded rather than answered.
+	site := testSite(1)
+	site.GeoCoords = Location{Point: NewPoint(math.NaN(), math.NaN())}
+	e.table.Add(site, "svc.default.external")
+
+	m := new(dns.Msg)
+	m.SetQuestion("svc.default.external.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := e.ServeDNS(context.Background(), rec, m); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-reqs:
+	default:
+		t.Error("Expected the request to be forwarded upstream")
+	}
+}
+
+// Serves sessions for an edge site on a local port, returning a connection
+// to it.
+func newSessionServer(t *testing.T, e *Edge) (*grpc.ClientConn, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	pb.RegisterEdgeServer(srv, edgeServer{e: e})
+	go srv.Serve(ln)
+	conn, err := grpc.Dial(ln.Addr().String(), grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, func() {
+		conn.Close()
+		srv.Stop()
+	}
+}
+
+func TestSessionBatchAck(t *testing.T) {
+	e := New()
+	conn, stop := newSessionServer(t, e)
+	defer stop()
+	stream, err := pb.NewEdgeClient(conn).Session(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	site := fullSite()
+	if err := stream.Send(&pb.Up{Msg: &pb.Up_Register{Register: &pb.Register{Meta: siteToProto(site)}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every batch is acknowledged with its seq once it's been applied.
+	batch := ServiceTableBatch{Meta: site, Events: []ServiceEvent{{Type: Add, Service: "default/a", Generation: 1}}}
+	for seq := uint64(1); seq <= 2; seq++ {
+		if err := stream.Send(&pb.Up{Msg: &pb.Up_Batch{Batch: batchToProto(batch, seq)}}); err != nil {
+			t.Fatal(err)
+		}
+		down, err := stream.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ack := down.GetAck(); ack == nil || ack.Seq != seq {
+			t.Fatalf("Expected an ack for seq %d, got %v", seq, down)
+		}
+		batch.Events[0].Generation++
+	}
+	if services := e.table.ServicesOf(site); len(services) != 1 || services[0] != "default/a" {
+		t.Errorf("Expected a to be running at the site, got %v", services)
+	}
+
+	// A sync whose digest doesn't match is echoed back, asking for the
+	// full set of services.
+	sync := syncToProto(ServiceTableSync{Meta: site, Digest: digestServices(nil), Generation: 3})
+	if err := stream.Send(&pb.Up{Msg: &pb.Up_Sync{Sync: sync}}); err != nil {
+		t.Fatal(err)
+	}
+	down, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resync := down.GetResync(); resync == nil || resync.Digest != sync.Digest {
+		t.Errorf("Expected a resync, got %v", down)
+	}
+	stream.CloseSend()
+}
+
+func TestSessionRejectedRegistration(t *testing.T) {
+	e := New()
+	conn, stop := newSessionServer(t, e)
+	defer stop()
+
+	for _, site := range []Site{{IP: net.ParseIP("10.0.0.1")}, {ID: "edge-1", GeoCoords: Location{Point: NewPoint(0, math.NaN())}}} {
+		stream, err := pb.NewEdgeClient(conn).Session(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := stream.Send(&pb.Up{Msg: &pb.Up_Register{Register: &pb.Register{Meta: siteToProto(site), FeedInterval: 1}}}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+			t.Errorf("%+v: expected %v, got %v", site, codes.PermissionDenied, err)
+		}
+	}
+	if children := e.children.list(); len(children) != 0 {
+		t.Errorf("Expected no children to be registered, got %v", children)
+	}
+}
@@ -0,0 +1,241 @@
+package edge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+const (
+	defaultHeartbeatInterval = 10 * time.Second
+	defaultLeaseGrace        = 30 * time.Second
+	heartbeatPath            = "/heartbeat"
+
+	// The number of heartbeats a downstream site may miss before its lease
+	// runs out.
+	heartbeatsPerLease = 3
+
+	// How often expired leases are checked for.
+	leaseCheckInterval = time.Second
+)
+
+// Heartbeat is sent periodically by a downstream edge site to keep its table
+// entries alive at its upstreams.
+type Heartbeat struct {
+	Meta Site `json:"meta"`
+
+	// How long the upstream should keep the site's entries, in seconds.
+	TTL uint32 `json:"ttl"`
+
+	// The IDs of the sites that relayed the heartbeat on its way up, in order.
+	Path []string `json:"path,omitempty"`
+}
+
+// lease tracks how long a downstream site's table entries are kept.
+type lease struct {
+	site    Site
+	ttl     time.Duration
+	expires time.Time
+}
+
+// leaseTable holds the leases of all downstream sites that send heartbeats.
+// Sites that have never sent one don't hold a lease, and their entries are
+// kept until they are deleted explicitly.
+type leaseTable struct {
+	sync.Mutex
+	leases map[uint64]*lease
+	grace  time.Duration
+}
+
+// Creates a new lease table, which keeps entries for the given grace period
+// after their lease runs out.
+func newLeaseTable(grace time.Duration) *leaseTable {
+	return &leaseTable{
+		leases: make(map[uint64]*lease),
+		grace:  grace,
+	}
+}
+
+// Grant starts or renews the lease of a site, and returns true if the site's
+// address or metadata differ from those of its last grant, or it held none.
+func (lt *leaseTable) Grant(site Site, ttl time.Duration) bool {
+	lt.Lock()
+	defer lt.Unlock()
+	expires := time.Now().Add(ttl + lt.grace)
+	hash := hashOf(site)
+	if l, found := lt.leases[hash]; found {
+		changed := !reflect.DeepEqual(l.site, site)
+		l.site = site
+		l.ttl = ttl
+		if expires.After(l.expires) {
+			l.expires = expires
+		}
+		return changed
+	}
+	lt.leases[hash] = &lease{site: site, ttl: ttl, expires: expires}
+	return true
+}
+
+// Renew extends the lease of a site that already holds one by the time of
+// its last grant. Sites without a lease are left alone.
+func (lt *leaseTable) Renew(site Site) {
+	lt.Lock()
+	defer lt.Unlock()
+	if l, found := lt.leases[hashOf(site)]; found {
+		if expires := time.Now().Add(l.ttl + lt.grace); expires.After(l.expires) {
+			l.expires = expires
+		}
+	}
+}
+
+// TTLOf returns the lease TTL last granted to a site, zero if it holds none.
+func (lt *leaseTable) TTLOf(site Site) time.Duration {
+	lt.Lock()
+	defer lt.Unlock()
+	if l, found := lt.leases[hashOf(site)]; found {
+		return l.ttl
+	}
+	return 0
+}
+
+// Leases returns a copy of every lease by site hash.
+func (lt *leaseTable) Leases() map[uint64]lease {
+	lt.Lock()
+	defer lt.Unlock()
+	leases := make(map[uint64]lease, len(lt.leases))
+	for hash, l := range lt.leases {
+		leases[hash] = *l
+	}
+	return leases
+}
+
+// Expire removes and returns all sites whose lease ran out before the given time.
+func (lt *leaseTable) Expire(now time.Time) []Site {
+	lt.Lock()
+	defer lt.Unlock()
+	var expired []Site
+	for hash, l := range lt.leases {
+		if now.After(l.expires) {
+			expired = append(expired, l.site)
+			delete(lt.leases, hash)
+		}
+	}
+	return expired
+}
+
+// Periodically removes the table entries of downstream sites whose lease has run out.
+func (e *Edge) startExpiringLeases() {
+	e.leaseStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(leaseCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case now := <-ticker.C:
+				for _, site := range e.leases.Expire(now) {
+					log.Infof("lease of site %s (%s) expired, removing its entries", site.ID, site.IP)
+					e.table.RemoveSite(site)
+					e.generations.Forget(site)
+					e.filteredDigests.Forget(site)
+				}
+			case <-e.leaseStop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops expiring leases.
+func (e *Edge) stopExpiringLeases() {
+	if e.leaseStop != nil {
+		close(e.leaseStop)
+	}
+}
+
+// Returns the lease TTL in seconds to ask for with heartbeats sent every
+// interval, rounded up so a lease never runs out early.
+func leaseTTL(interval time.Duration) uint32 {
+	return uint32((heartbeatsPerLease*interval + time.Second - 1) / time.Second)
+}
+
+// Periodically sends heartbeats to every upstream.
+func (e *Edge) startSendingHeartbeats() {
+	if e.heartbeatInterval <= 0 || len(e.proxies) == 0 {
+		return
+	}
+	e.heartbeatStop = make(chan struct{})
+	hb := Heartbeat{
+		Meta: e.site,
+		TTL:  leaseTTL(e.heartbeatInterval),
+	}
+	go func() {
+		ticker := time.NewTicker(e.heartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				for _, p := range e.proxies {
+					if err := p.sendHeartbeat(hb); err != nil {
+						log.Errorf("unable to send heartbeat to upstream %s: %v", p.addr, err)
+					}
+				}
+			case <-e.heartbeatStop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops sending heartbeats.
+func (e *Edge) stopSendingHeartbeats() {
+	if e.heartbeatStop != nil {
+		close(e.heartbeatStop)
+	}
+}
+
+// Parse incoming heartbeats from edge sites, renewing their lease.
+func (e *Edge) parseHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	jsn, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln("error while reading heartbeat:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	hb := Heartbeat{}
+	if err = json.Unmarshal(jsn, &hb); err != nil {
+		log.Errorln("error while unmarshalling JSON into heartbeat struct:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err = e.applyHeartbeat(identityFrom(r.Context()), hb); err != nil {
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// Renews the lease of the edge site a heartbeat is from, and relays it
+// further upstream so every tier above me expires the site's entries once
+// its heartbeats stop.
+func (e *Edge) applyHeartbeat(identity string, hb Heartbeat) error {
+	if err := e.authorizeSite(identity, hb.Meta); err != nil {
+		return err
+	}
+	e.grantLease(hb.Meta, time.Duration(hb.TTL)*time.Second)
+	e.relayHeartbeat(hb)
+	return nil
+}
+
+// Grants a lease to a site that sent a heartbeat, and picks up any change to
+// its address or metadata. The table is only updated when the site differs
+// from its last heartbeat, since that means going through every entry.
+func (e *Edge) grantLease(meta Site, ttl time.Duration) {
+	if e.leases.Grant(meta, ttl) {
+		e.table.UpdateSite(meta)
+	}
+}
@@ -0,0 +1,94 @@
+package edge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mholt/caddy"
+)
+
+func TestLeaseTTL(t *testing.T) {
+	tests := []struct {
+		interval time.Duration
+		ttl      uint32
+	}{
+		{time.Second, 3},
+		{1500 * time.Millisecond, 5},
+		{10 * time.Second, 30},
+	}
+	for _, test := range tests {
+		if ttl := leaseTTL(test.interval); ttl != test.ttl {
+			t.Errorf("Expected a TTL of %d for %s, got %d", test.ttl, test.interval, ttl)
+		}
+	}
+}
+
+func TestHeartbeatSetup(t *testing.T) {
+	tests := []struct {
+		input     string
+		shouldErr bool
+	}{
+		{"heartbeat 0", false},
+		{"heartbeat 1s", false},
+		{"heartbeat 300ms", true},
+		{"heartbeat -1s", true},
+	}
+	for _, test := range tests {
+		c := caddy.NewTestController("dns", "edge 10.0.0.1 1 2 . 10.0.0.2:53 {\nsite_id a\n"+test.input+"\n}")
+		_, err := parseEdge(c)
+		if (err != nil) != test.shouldErr {
+			t.Errorf("%q: expected error %v, got %v", test.input, test.shouldErr, err)
+		}
+	}
+}
+
+func TestLeaseExpire(t *testing.T) {
+	lt := newLeaseTable(0)
+	site := Site{ID: "a", IP: net.ParseIP("10.0.0.1")}
+	lt.Grant(site, time.Second)
+	if expired := lt.Expire(time.Now()); len(expired) != 0 {
+		t.Errorf("Expected no expired leases, got %v", expired)
+	}
+	if expired := lt.Expire(time.Now().Add(2 * time.Second)); len(expired) != 1 {
+		t.Errorf("Expected 1 expired lease, got %v", expired)
+	}
+}
+
+func TestRelayedHeartbeat(t *testing.T) {
+	e := New()
+	e.siteID = "upper"
+	grandchild := Site{ID: "grandchild", IP: net.ParseIP("10.0.0.1")}
+	e.table.Add(grandchild, "default/a")
+
+	// A heartbeat relayed by a site in between grants the grandchild a lease
+	// here too, which removes its entries once it runs out.
+	hb := Heartbeat{Meta: grandchild, TTL: 1, Path: []string{"mid"}}
+	if err := e.applyHeartbeat("", hb); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := e.leases.TTLOf(grandchild); ttl != time.Second {
+		t.Fatalf("Expected a lease of 1s, got %s", ttl)
+	}
+	for _, site := range e.leases.Expire(time.Now().Add(e.leases.grace + 2*time.Second)) {
+		e.table.RemoveSite(site)
+	}
+	if services := e.table.ServicesOf(grandchild); len(services) != 0 {
+		t.Errorf("Expected the grandchild's entries to be removed, got %v", services)
+	}
+}
+
+func TestLeaseGrantChanged(t *testing.T) {
+	lt := newLeaseTable(0)
+	site := Site{ID: "a", IP: net.ParseIP("10.0.0.1")}
+	if !lt.Grant(site, time.Second) {
+		t.Error("Expected the first grant to report a change")
+	}
+	if lt.Grant(site, time.Second) {
+		t.Error("Expected a grant for the same site to report no change")
+	}
+	site.IP = net.ParseIP("10.0.0.2")
+	if !lt.Grant(site, time.Second) {
+		t.Error("Expected a grant for a moved site to report a change")
+	}
+}
@@ -1,17 +1,35 @@
 package edge
 
 import (
+	"context"
 	"encoding/json"
 	"io/ioutil"
 	"net/http"
 )
 
-// Start listening for table updates on port 8053.
+// Start listening for table updates on e.listenAddr, under e.listenPrefix.
 func (e *Edge) startListeningForTableUpdates() {
-	e.server = &http.Server{Addr: ":" + pushPort}
-	http.HandleFunc("/", e.parseTableUpdate)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", e.authenticate(e.parseTableUpdate))
+	mux.HandleFunc(batchPath, e.authenticate(e.parseTableBatch))
+	mux.HandleFunc(syncPath, e.authenticate(e.parseTableSync))
+	mux.HandleFunc(snapshotPath, e.authenticate(e.serveTableSnapshot))
+	mux.HandleFunc(heartbeatPath, e.authenticate(e.parseHeartbeat))
+	mux.HandleFunc(feedPath, e.authenticate(e.serveFeed))
+	var handler http.Handler = mux
+	if e.listenPrefix != "" {
+		handler = http.StripPrefix(e.listenPrefix, mux)
+	}
+	e.server = &http.Server{Addr: e.listenAddr, Handler: handler}
 	go func() {
-		if err := e.server.ListenAndServe(); err != nil {
+		var err error
+		if e.pushTLS {
+			e.server.TLSConfig = e.pushServerTLSConfig()
+			err = e.server.ListenAndServeTLS("", "")
+		} else {
+			err = e.server.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			log.Fatalf("ListenAndServe error: %s", err)
 		}
 	}()
@@ -29,15 +47,30 @@ func (e *Edge) parseTableUpdate(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
+	identity := identityFrom(r.Context())
+	if e.authorizeSite(identity, update.Meta) != nil || e.authorizeService(identity, update.Meta, update.Event.Service) != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if !e.generations.Advance(update.Meta, update.Event.Service, update.Event.Generation) {
+		log.Debugf("discarding stale event %+v from site %s", update.Event, update.Meta.IP)
+		e.leases.Renew(update.Meta)
+		return
+	}
 	switch update.Event.Type {
 	case Add:
 		e.table.Add(update.Meta, update.Event.Service)
 	case Delete:
 		e.table.Remove(update.Meta, update.Event.Service)
 	}
+	e.leases.Renew(update.Meta)
+	e.relayBatch(ServiceTableBatch{
+		Meta:   update.Meta,
+		Events: []ServiceEvent{update.Event},
+	})
 }
 
 // Stop listening for updates.
 func (e *Edge) stopListeningForTableUpdates() {
-	e.server.Shutdown(nil)
+	e.server.Shutdown(context.Background())
 }
@@ -8,6 +8,7 @@ package edge
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"strconv"
 
@@ -17,6 +18,13 @@ import (
 // The TTL for the LOC record forwarded upstream.
 const locTTL = 0
 
+// The defaults for the optional LOC fields, in meters (see RFC 1876).
+const (
+	defaultLOCSize          = 1
+	defaultLOCPrecision     = 10000
+	defaultLOCVertPrecision = 10
+)
+
 // The domain name provided in the LOC record.
 var edgeDomain = fmt.Sprintf("%s.site.", pluginName)
 
@@ -45,42 +53,48 @@ var (
 	locRe         = regexp.MustCompile(locReStr)
 )
 
-// Parses and removes the LOC record from the Extra fields of a DNS message.
-func extractLocationRecord(r *dns.Msg) (Point, bool) {
-
-	// Assert that such a record actually exists.
-	if len(r.Extra) == 0 {
-		return Point{}, false
-	}
+// Parses and removes the legacy edge LOC record from the Extra fields of a
+// DNS message.
+func extractLocationRecord(r *dns.Msg) (Location, bool) {
 
-	// Try to extract the last entry.
-	point, err := convertLOCToPoint(r.Extra[len(r.Extra)-1])
-	if err != nil {
-		return Point{}, false
-	}
+	// Look for the edge LOC record anywhere in Extra, since OPT and TSIG
+	// records may have been appended after it.
+	for i, rr := range r.Extra {
+		if rr.Header().Rrtype != dns.TypeLOC || rr.Header().Name != edgeDomain {
+			continue
+		}
+		location, err := convertLOCToLocation(rr)
+		if err != nil {
+			return Location{}, false
+		}
 
-	// Remove the LOC record from the back of Extra.
-	r.Extra = r.Extra[:(len(r.Extra) - 1)]
+		// Remove the LOC record from Extra.
+		r.Extra = append(r.Extra[:i], r.Extra[i+1:]...)
 
-	// Return the parse point.
-	return point, true
+		// Return the parsed location.
+		return location, true
+	}
+	return Location{}, false
 }
 
-// Inserts a LOC record into a DNS request under the Extra fields.
+// Inserts a LOC record into a DNS request under the Extra fields. It's added
+// to the end, after the OPT record, since that's where upstreams that predate
+// the location option look for it. Only a TSIG record is added after it.
 func insertLocationRecord(r *dns.Msg, locRR dns.RR) {
-
-	// Add the LOC record to the *end* of the Extra fields.
-	// NOTE: This is where we'll look for it when we extract it.
 	r.Extra = append(r.Extra, locRR)
 }
 
-// Takes a geographic point and converts it to a DNS LOC RR record.
-func convertPointToLOC(point Point) (dns.RR, error) {
+// Takes a geographic location and converts it to a DNS LOC RR record.
+func convertLocationToLOC(location Location) (dns.RR, error) {
 
 	// Start by populating a LOC struct.
 	loc := new(dns.LOC)
-	loc.Longitude = uint32(int(float64(dns.LOC_DEGREES)*point.Lon) + dns.LOC_PRIMEMERIDIAN)
-	loc.Latitude = uint32(int(float64(dns.LOC_DEGREES)*point.Lat) + dns.LOC_EQUATOR)
+	loc.Longitude = uint32(int(float64(dns.LOC_DEGREES)*location.Lon) + dns.LOC_PRIMEMERIDIAN)
+	loc.Latitude = uint32(int(float64(dns.LOC_DEGREES)*location.Lat) + dns.LOC_EQUATOR)
+	loc.Altitude = uint32(math.Round((location.Altitude + dns.LOC_ALTITUDEBASE) * 100))
+	loc.Size = metersToLOCSize(location.Size)
+	loc.HorizPre = metersToLOCSize(location.Precision)
+	loc.VertPre = metersToLOCSize(location.VertPrecision)
 	loc.Header().Name = edgeDomain
 	loc.Header().Class = dns.ClassINET
 	loc.Header().Rrtype = dns.TypeLOC
@@ -93,41 +107,57 @@ func convertPointToLOC(point Point) (dns.RR, error) {
 	}
 
 	// Log the conversion.
-	log.Debugf("converted (%f, %f) to LOC record: %+v", point.Lon, point.Lat, rr)
+	log.Debugf("converted %+v to LOC record: %+v", location, rr)
 
 	return rr, nil
 }
 
-// Takes a DNS LOC record and converts it to a geographic point.
-func convertLOCToPoint(loc dns.RR) (Point, error) {
+// Converts a size or precision in meters to the RFC 1876 encoding: a
+// mantissa and a power of ten exponent, in centimeters. Values are rounded
+// up, so precision is never overstated.
+func metersToLOCSize(m float64) uint8 {
+	cm := uint64(math.Ceil(math.Max(m, 0) * 100))
+	var exp uint8
+	for cm > 9 && exp < 9 {
+		cm = (cm + 9) / 10
+		exp++
+	}
+	if cm > 9 {
+		cm = 9
+	}
+	return uint8(cm)<<4 | exp
+}
+
+// Takes a DNS LOC record and converts it to a geographic location.
+func convertLOCToLocation(loc dns.RR) (Location, error) {
 
 	// Assert that the RR is a LOC record.
 	if loc.Header().Rrtype != dns.TypeLOC || loc.Header().Name != edgeDomain {
 		log.Errorf("LOC record expecting type %v and name %s (received %v and %s)", dns.TypeLOC, edgeDomain, loc.Header().Rrtype, loc.Header().Name)
-		return Point{}, errInvalidLOC
+		return Location{}, errInvalidLOC
 	}
 
-	// Parse out the lon-lat in decimal degrees.
-	lon, lat, err := parseLOCString(loc.String())
+	// Parse out the location in decimal degrees and meters.
+	location, err := parseLOCString(loc.String())
 	if err != nil {
 		log.Debugf("unable to parse LOC string %s (%v)", loc.String(), err)
-		return Point{}, err
+		return Location{}, err
 	}
 
 	// Log the conversion.
-	log.Debugf("converted LOC record %+v to (%f, %f)", loc.String(), lon, lat)
+	log.Debugf("converted LOC record %+v to %+v", loc.String(), location)
 
-	return NewPoint(lon, lat), nil
+	return location, nil
 }
 
 // Takes a LOC string and converts it to the struct.
-func parseLOCString(l string) (float64, float64, error) {
+func parseLOCString(l string) (Location, error) {
 
 	// Use regex to parse out the parts of the string.
 	parts := locRe.FindStringSubmatch(l)
 	if parts == nil || len(parts) != 13 {
 		log.Errorf("LOC string didn't match regex: recieved parts %+v", parts)
-		return 0.0, 0.0, errInvalidLOC
+		return Location{}, errInvalidLOC
 	}
 
 	// Log the parsed parts.
@@ -137,7 +167,7 @@ func parseLOCString(l string) (float64, float64, error) {
 	lat, ok := dmsToDD(parts[1], parts[2], parts[3], 90)
 	if !ok {
 		log.Errorf("latitude DMS to DD conversion failed")
-		return 0.0, 0.0, errInvalidLOC
+		return Location{}, errInvalidLOC
 	}
 	if parts[4] == "S" {
 		lat = -lat
@@ -147,13 +177,46 @@ func parseLOCString(l string) (float64, float64, error) {
 	lon, ok := dmsToDD(parts[5], parts[6], parts[7], 180)
 	if !ok {
 		log.Errorf("longitude DMS to DD conversion failed")
-		return 0.0, 0.0, errInvalidLOC
+		return Location{}, errInvalidLOC
 	}
 	if parts[8] == "W" {
 		lon = -lon
 	}
 
-	return lon, lat, nil
+	// Parse the altitude, size and precisions, falling back to the RFC 1876
+	// defaults for the optional ones.
+	location := Location{Point: NewPoint(lon, lat)}
+	var err error
+	if location.Altitude, err = strconv.ParseFloat(parts[9], 64); err != nil {
+		log.Errorf("altitude conversion failed")
+		return Location{}, errInvalidLOC
+	}
+	if location.Size, ok = parseLOCMeters(parts[10], defaultLOCSize); !ok {
+		log.Errorf("size conversion failed")
+		return Location{}, errInvalidLOC
+	}
+	if location.Precision, ok = parseLOCMeters(parts[11], defaultLOCPrecision); !ok {
+		log.Errorf("horizontal precision conversion failed")
+		return Location{}, errInvalidLOC
+	}
+	if location.VertPrecision, ok = parseLOCMeters(parts[12], defaultLOCVertPrecision); !ok {
+		log.Errorf("vertical precision conversion failed")
+		return Location{}, errInvalidLOC
+	}
+
+	return location, nil
+}
+
+// Parses an optional, non-negative LOC value in meters.
+func parseLOCMeters(s string, def float64) (float64, bool) {
+	if s == "" {
+		return def, true
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f < 0 {
+		return 0, false
+	}
+	return f, true
 }
 
 // Converts DMS (degree, minute, second) format to decimal degrees.
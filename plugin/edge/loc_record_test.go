@@ -0,0 +1,80 @@
+package edge
+
+import (
+	"math"
+	"testing"
+)
+
+// Decodes an RFC 1876 size byte into centimeters.
+func locSizeToCentimeters(b uint8) float64 {
+	return float64(b>>4) * math.Pow10(int(b&0x0F))
+}
+
+func TestMetersToLOCSize(t *testing.T) {
+	tests := []struct {
+		meters float64
+		size   uint8
+	}{
+		{-1, 0x00},
+		{0, 0x00},
+		{0.05, 0x50},
+		{0.09, 0x90},
+		{0.99, 0x12},
+		{1, 0x12},
+		{1.5, 0x22},
+		{10, 0x13},
+		{12.34, 0x23},
+		{10000000, 0x19},
+		{90000000, 0x99},
+
+		// Anything larger than 9e9 centimeters saturates.
+		{100000000, 0x99},
+	}
+	for _, test := range tests {
+		if size := metersToLOCSize(test.meters); size != test.size {
+			t.Errorf("%v m: expected %#02x, got %#02x", test.meters, test.size, size)
+		}
+	}
+}
+
+func TestMetersToLOCSizeRoundsUp(t *testing.T) {
+	// Sizes are rounded up to the next representable value, never down, so
+	// an uncertainty is never understated.
+	for cm := 1; cm < 100000; cm += 7 {
+		size := metersToLOCSize(float64(cm) / 100)
+		if size>>4 == 0 || size>>4 > 9 || size&0x0F > 9 {
+			t.Fatalf("%d cm: invalid size %#02x", cm, size)
+		}
+		got := locSizeToCentimeters(size)
+		if got < float64(cm) {
+			t.Fatalf("%d cm: rounded down to %v cm", cm, got)
+		}
+		if size>>4 > 1 && float64(size>>4-1)*math.Pow10(int(size&0x0F)) >= float64(cm) {
+			t.Fatalf("%d cm: rounded up further than needed to %v cm", cm, got)
+		}
+	}
+}
+
+func TestLOCRecordRoundTrip(t *testing.T) {
+	l := Location{
+		Point:         NewPoint(-71.0636, 42.3581),
+		Altitude:      43,
+		Size:          30,
+		Precision:     1500,
+		VertPrecision: 10,
+	}
+	rr, err := convertLocationToLOC(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := convertLOCToLocation(rr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(got.Lat-l.Lat) > 1e-3 || math.Abs(got.Lon-l.Lon) > 1e-3 || math.Abs(got.Altitude-l.Altitude) > 0.01 {
+		t.Errorf("Expected %+v, got %+v", l, got)
+	}
+	if got.Size != 30 || got.Precision != 2000 || got.VertPrecision != 10 {
+		t.Errorf("Expected sizes 30, 2000 and 10, got %v, %v and %v", got.Size, got.Precision, got.VertPrecision)
+	}
+}
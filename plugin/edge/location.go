@@ -0,0 +1,140 @@
+package edge
+
+import (
+	"encoding/binary"
+	"math"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// The current version of the location option wire format.
+	locationOptionVersion = 2
+
+	// The size of the fixed part of a version 1 location option: the version,
+	// latitude, longitude, horizontal precision and site ID length.
+	locationOptionLen = 1 + 4 + 4 + 4 + 1
+
+	// The size of the fields added after the site ID in version 2: the
+	// altitude, size and vertical precision.
+	locationOptionV2Len = 4 + 4 + 4
+
+	// Coordinates are sent as integer multiples of this many degrees.
+	locationDegreeUnit = 1e-7
+)
+
+// edgeLocation is the location a request was forwarded from, as sent by the
+// downstream edge site in a local EDNS0 option.
+type edgeLocation struct {
+	Location
+
+	// The ID of the edge site that forwarded the request, empty if unknown.
+	SiteID string
+}
+
+// Encodes the location in the version 2 wire format:
+//
+//	byte 0:  version
+//	byte 1:  latitude, signed, in units of 1e-7 degrees
+//	byte 5:  longitude, signed, in units of 1e-7 degrees
+//	byte 9:  horizontal precision in meters
+//	byte 13: length of the site ID, followed by the site ID itself
+//
+// followed by the fields added in version 2:
+//
+//	altitude, signed, in centimeters
+//	size in meters
+//	vertical precision in meters
+func (l edgeLocation) pack() []byte {
+	id := l.SiteID
+	if len(id) > math.MaxUint8 {
+		id = id[:math.MaxUint8]
+	}
+	b := make([]byte, locationOptionLen+len(id)+locationOptionV2Len)
+	b[0] = locationOptionVersion
+	binary.BigEndian.PutUint32(b[1:], uint32(int32(math.Round(l.Lat/locationDegreeUnit))))
+	binary.BigEndian.PutUint32(b[5:], uint32(int32(math.Round(l.Lon/locationDegreeUnit))))
+	binary.BigEndian.PutUint32(b[9:], packMeters(l.Precision))
+	b[13] = uint8(len(id))
+	copy(b[locationOptionLen:], id)
+	v2 := b[locationOptionLen+len(id):]
+	binary.BigEndian.PutUint32(v2, uint32(int32(math.Round(l.Altitude*100))))
+	binary.BigEndian.PutUint32(v2[4:], packMeters(l.Size))
+	binary.BigEndian.PutUint32(v2[8:], packMeters(l.VertPrecision))
+	return b
+}
+
+// Rounds a non-negative distance in meters up to a uint32.
+func packMeters(m float64) uint32 {
+	return uint32(math.Min(math.Ceil(math.Max(m, 0)), math.MaxUint32))
+}
+
+// Decodes a location option. Options with a newer version are accepted as
+// long as they start with the fields of the versions we know, so sites can
+// be upgraded in any order. Version 1 options get the RFC 1876 defaults for
+// the fields they don't carry.
+func unpackLocation(b []byte) (edgeLocation, error) {
+	if len(b) < locationOptionLen || b[0] < 1 {
+		return edgeLocation{}, errInvalidLocation
+	}
+	idLen := int(b[13])
+	if len(b) < locationOptionLen+idLen {
+		return edgeLocation{}, errInvalidLocation
+	}
+	lat := float64(int32(binary.BigEndian.Uint32(b[1:]))) * locationDegreeUnit
+	lon := float64(int32(binary.BigEndian.Uint32(b[5:]))) * locationDegreeUnit
+	if math.Abs(lat) > 90 || math.Abs(lon) > 180 {
+		return edgeLocation{}, errInvalidLocation
+	}
+	l := edgeLocation{
+		Location: Location{
+			Point:         NewPoint(lon, lat),
+			Size:          defaultLOCSize,
+			Precision:     float64(binary.BigEndian.Uint32(b[9:])),
+			VertPrecision: defaultLOCVertPrecision,
+		},
+		SiteID: string(b[locationOptionLen : locationOptionLen+idLen]),
+	}
+	if b[0] < 2 {
+		return l, nil
+	}
+	v2 := b[locationOptionLen+idLen:]
+	if len(v2) < locationOptionV2Len {
+		return edgeLocation{}, errInvalidLocation
+	}
+	l.Altitude = float64(int32(binary.BigEndian.Uint32(v2))) / 100
+	l.Size = float64(binary.BigEndian.Uint32(v2[4:]))
+	l.VertPrecision = float64(binary.BigEndian.Uint32(v2[8:]))
+	return l, nil
+}
+
+// Parses and removes the location of the forwarding edge site from a DNS
+// message. The location option is preferred, but a legacy LOC record is
+// still accepted from sites that haven't been upgraded yet.
+func extractLocation(r *dns.Msg) (edgeLocation, bool) {
+
+	// Look for the EDNS0 option first.
+	if data, found := extractOption(r, locationOptionCode); found {
+		loc, err := unpackLocation(data)
+		if err != nil {
+			log.Errorf("unable to parse location option %x (%v)", data, err)
+		} else {
+			// Drop any LOC record sent alongside for older upstreams.
+			extractLocationRecord(r)
+			return loc, true
+		}
+	}
+
+	// Fall back to the LOC record.
+	location, found := extractLocationRecord(r)
+	if !found {
+		return edgeLocation{}, false
+	}
+	return edgeLocation{Location: location}, true
+}
+
+// Attaches the location of this edge site to a DNS message that's about to
+// be forwarded upstream. Returns true if an OPT record had to be added.
+func insertLocation(r *dns.Msg, loc edgeLocation) bool {
+	return insertOption(r, locationOptionCode, loc.pack())
+}
@@ -0,0 +1,85 @@
+package edge
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestLocationRoundTrip(t *testing.T) {
+	l := edgeLocation{
+		Location: Location{
+			Point:         NewPoint(-71.0636, 42.3581),
+			Altitude:      -24.5,
+			Size:          30,
+			Precision:     1000,
+			VertPrecision: 20,
+		},
+		SiteID: "edge-1",
+	}
+	got, err := unpackLocation(l.pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != l {
+		t.Errorf("Expected %+v, got %+v", l, got)
+	}
+}
+
+// Packs a location in the version 1 wire format, which ends with the site ID.
+func packLocationV1(lat, lon int32, precision uint32, id string) []byte {
+	b := make([]byte, locationOptionLen+len(id))
+	b[0] = 1
+	binary.BigEndian.PutUint32(b[1:], uint32(lat))
+	binary.BigEndian.PutUint32(b[5:], uint32(lon))
+	binary.BigEndian.PutUint32(b[9:], precision)
+	b[13] = uint8(len(id))
+	copy(b[locationOptionLen:], id)
+	return b
+}
+
+func TestUnpackLocationV1(t *testing.T) {
+	got, err := unpackLocation(packLocationV1(423581000, -710636000, 1000, "edge-1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := edgeLocation{
+		Location: Location{
+			Point:         NewPoint(-71.0636, 42.3581),
+			Size:          defaultLOCSize,
+			Precision:     1000,
+			VertPrecision: defaultLOCVertPrecision,
+		},
+		SiteID: "edge-1",
+	}
+	if got != want {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestUnpackLocationInvalid(t *testing.T) {
+	v2 := edgeLocation{Location: Location{Point: NewPoint(1, 2)}, SiteID: "edge-1"}.pack()
+
+	// A newer version is accepted as long as it starts with the fields we know.
+	v3 := append(append([]byte(nil), v2...), 0xFF, 0xFF)
+	v3[0] = 3
+	if _, err := unpackLocation(v3); err != nil {
+		t.Errorf("Expected a newer version to be accepted, got %v", err)
+	}
+
+	truncatedID := packLocationV1(0, 0, 0, "edge-1")
+	truncatedID = truncatedID[:len(truncatedID)-2]
+	tests := map[string][]byte{
+		"empty":           nil,
+		"short":           v2[:locationOptionLen-1],
+		"version 0":       append([]byte{0}, v2[1:]...),
+		"truncated id":    truncatedID,
+		"truncated v2":    v2[:len(v2)-1],
+		"latitude > 90":   packLocationV1(900000001, 0, 0, ""),
+		"longitude > 180": packLocationV1(0, -1800000001, 0, ""),
+	}
+	for name, b := range tests {
+		if _, err := unpackLocation(b); err != errInvalidLocation {
+			t.Errorf("%s: expected %v, got %v", name, errInvalidLocation, err)
+		}
+	}
+}
@@ -49,9 +49,14 @@ func (e *Edge) Forward(state request.Request) (*dns.Msg, error) {
 		// Make the connection and receive the response.
 		ret, err := proxy.connect(context.Background(), state, e.forceTCP, true)
 
-		ret, err = truncated(ret, err)
+		ret, err = truncated(state, ret, err)
 		upstreamErr = err
 
+		// Transparently retry truncated UDP replies over TCP.
+		if err == nil && !e.forceTCP {
+			ret = proxy.retryTruncated(context.Background(), state, ret)
+		}
+
 		if err != nil {
 			if fails < len(e.proxies) {
 				continue
@@ -0,0 +1,45 @@
+package edge
+
+import (
+	"sync"
+
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Variables declared for monitoring.
+var (
+	TruncatedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "truncated_count_total",
+		Help:      "Counter of truncated UDP replies received per upstream.",
+	}, []string{"to"})
+	TCPRetryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "tcp_retry_count_total",
+		Help:      "Counter of truncated UDP replies retried over TCP per upstream and result.",
+	}, []string{"to", "result"})
+	RejectedUpdateCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "rejected_update_count_total",
+		Help:      "Counter of table updates from downstream edge sites rejected by authorization, per reason.",
+	}, []string{"reason"})
+	OutboxDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "outbox_depth",
+		Help:      "Gauge of service event batches waiting to be pushed per upstream.",
+	}, []string{"to"})
+	OutboxDropCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "outbox_drop_count_total",
+		Help:      "Counter of service event batches dropped from a full outbox or rejected per upstream.",
+	}, []string{"to"})
+)
+
+var once sync.Once
@@ -0,0 +1,305 @@
+package edge
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	defaultOutboxSize = 1024
+	minPushBackoff    = time.Second
+	maxPushBackoff    = 5 * time.Minute
+
+	// The number of removals an outbox journal may hold before it's compacted,
+	// however short the queue is.
+	minOutboxCompaction = 64
+)
+
+// Matches the characters of an upstream address that can't be used in a file name.
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9.-]`)
+
+// outbox is a bounded queue of service event batches waiting to be pushed to
+// an upstream. Batches are delivered one at a time in the order they were
+// queued, backing off exponentially while the upstream is unreachable. If
+// the outbox has a directory, every change to the queue is appended to a
+// journal there and synced to disk, so undelivered batches survive a restart.
+type outbox struct {
+	sync.Mutex
+	queue []ServiceTableBatch
+	max   int
+
+	// The sequence number of the batch at the front of the queue. Batches are
+	// numbered in the order they're queued, and the front moves on whenever
+	// one is delivered or dropped, so a batch that was dropped while being
+	// sent can't take a later batch down with it.
+	head uint64
+
+	// The journal the queue is persisted to, if any, and the number of
+	// removals it holds. The journal is rewritten with just the queued
+	// batches once it holds more removals than batches.
+	path    string
+	journal *os.File
+	removed int
+
+	// The upstream the batches are delivered to, used to label metrics.
+	to string
+
+	// Signalled when a batch is queued, and closed to stop delivering.
+	wake chan struct{}
+	stop chan struct{}
+}
+
+// An entry in an outbox journal: either a batch added to the back of the
+// queue, or the removal of the batch at the front.
+type outboxRecord struct {
+	Batch  *ServiceTableBatch `json:"batch,omitempty"`
+	Remove bool               `json:"remove,omitempty"`
+}
+
+// Creates a new outbox for an upstream, holding at most max batches. The
+// batches are persisted in the given directory, or only kept in memory if
+// it's empty.
+func newOutbox(dir, to string, max int) *outbox {
+	o := &outbox{
+		max:  max,
+		to:   to,
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+	}
+	if dir != "" {
+		o.path = filepath.Join(dir, unsafeFileChars.ReplaceAllString(to, "_")+".journal")
+	}
+	return o
+}
+
+// Loads the batches left over from a previous run by replaying the journal.
+func (o *outbox) load() {
+	o.Lock()
+	defer o.Unlock()
+	if o.path == "" {
+		return
+	}
+	f, err := os.Open(o.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("unable to read outbox %s: %v", o.path, err)
+		}
+		return
+	}
+	defer f.Close()
+	o.queue = nil
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var rec outboxRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			// Only the last record can be cut short, by a crash while it
+			// was being written.
+			log.Errorf("ignoring unreadable record in outbox %s: %v", o.path, err)
+			continue
+		}
+		if rec.Batch != nil {
+			o.queue = append(o.queue, *rec.Batch)
+		} else if rec.Remove && len(o.queue) > 0 {
+			o.queue = o.queue[1:]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Errorf("unable to read outbox %s: %v", o.path, err)
+	}
+	if len(o.queue) > o.max {
+		o.queue = o.queue[len(o.queue)-o.max:]
+	}
+	o.compact()
+	OutboxDepth.WithLabelValues(o.to).Set(float64(len(o.queue)))
+	log.Infof("loaded %d undelivered batches for upstream %s", len(o.queue), o.to)
+}
+
+// Appends a record to the journal and syncs it to disk, compacting the
+// journal first if it holds too many removals. Must be called with the lock
+// held.
+func (o *outbox) record(rec outboxRecord) {
+	if o.path == "" {
+		return
+	}
+	if rec.Remove {
+		if o.removed++; o.removed > minOutboxCompaction && o.removed > len(o.queue) {
+			o.compact()
+			return
+		}
+	}
+	if o.journal == nil {
+		if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+			log.Errorf("unable to create outbox directory: %v", err)
+			return
+		}
+		f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Errorf("unable to open outbox %s: %v", o.path, err)
+			return
+		}
+		o.journal = f
+	}
+	jsn, err := json.Marshal(rec)
+	if err != nil {
+		log.Errorf("unable to marshal outbox record: %v", err)
+		return
+	}
+	if _, err = o.journal.Write(append(jsn, '\n')); err == nil {
+		err = o.journal.Sync()
+	}
+	if err != nil {
+		log.Errorf("unable to write outbox %s: %v", o.path, err)
+	}
+}
+
+// Rewrites the journal with just the batches that are queued. The new
+// journal is synced before it replaces the old one, so a crash leaves one or
+// the other behind. Must be called with the lock held.
+func (o *outbox) compact() {
+	if err := os.MkdirAll(filepath.Dir(o.path), 0700); err != nil {
+		log.Errorf("unable to create outbox directory: %v", err)
+		return
+	}
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Errorf("unable to write outbox %s: %v", o.path, err)
+		return
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for i := range o.queue {
+		if err = enc.Encode(outboxRecord{Batch: &o.queue[i]}); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, o.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		log.Errorf("unable to write outbox %s: %v", o.path, err)
+		return
+	}
+	if o.journal != nil {
+		o.journal.Close()
+	}
+	o.journal, o.removed = f, 0
+}
+
+// Enqueue adds a batch to the back of the queue. If the queue is full, the
+// oldest batch is dropped; the next full sync repairs whatever it carried.
+func (o *outbox) Enqueue(batch ServiceTableBatch) {
+	o.Lock()
+	if len(o.queue) >= o.max {
+		o.queue = o.queue[1:]
+		o.head++
+		OutboxDropCount.WithLabelValues(o.to).Inc()
+		log.Warningf("outbox for upstream %s is full, dropping oldest batch", o.to)
+		o.record(outboxRecord{Remove: true})
+	}
+	o.queue = append(o.queue, batch)
+	o.record(outboxRecord{Batch: &batch})
+	OutboxDepth.WithLabelValues(o.to).Set(float64(len(o.queue)))
+	o.Unlock()
+
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Len returns the number of batches waiting to be pushed.
+func (o *outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.queue)
+}
+
+// Returns the batch at the front of the queue along with its sequence number.
+func (o *outbox) peek() (ServiceTableBatch, uint64, bool) {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.queue) == 0 {
+		return ServiceTableBatch{}, 0, false
+	}
+	return o.queue[0], o.head, true
+}
+
+// Removes the batch with the given sequence number once it's been delivered,
+// unless it has already been dropped to make room for newer ones.
+func (o *outbox) pop(seq uint64) {
+	o.Lock()
+	defer o.Unlock()
+	if len(o.queue) == 0 || seq != o.head {
+		return
+	}
+	o.queue = o.queue[1:]
+	o.head++
+	o.record(outboxRecord{Remove: true})
+	OutboxDepth.WithLabelValues(o.to).Set(float64(len(o.queue)))
+}
+
+// Starts delivering queued batches with the given send function.
+func (o *outbox) start(send func(ServiceTableBatch) error) {
+	o.load()
+	go func() {
+		backoff := minPushBackoff
+		for {
+			batch, seq, found := o.peek()
+			if !found {
+				select {
+				case <-o.wake:
+					continue
+				case <-o.stop:
+					return
+				}
+			}
+			err := send(batch)
+			if _, rejected := err.(rejectedError); rejected {
+				log.Errorf("dropping batch for upstream %s: %v", o.to, err)
+				OutboxDropCount.WithLabelValues(o.to).Inc()
+				o.pop(seq)
+				continue
+			}
+			if err != nil {
+				log.Errorf("unable to push batch to upstream %s: %v (trying again in %s)", o.to, err, backoff)
+				select {
+				case <-time.After(backoff):
+				case <-o.stop:
+					return
+				}
+				if backoff *= 2; backoff > maxPushBackoff {
+					backoff = maxPushBackoff
+				}
+				continue
+			}
+			backoff = minPushBackoff
+			o.pop(seq)
+		}
+	}()
+}
+
+// Stops delivering batches. Anything still queued stays on disk.
+func (o *outbox) close() {
+	close(o.stop)
+	o.Lock()
+	defer o.Unlock()
+	if o.journal != nil {
+		o.journal.Close()
+		o.journal = nil
+	}
+}
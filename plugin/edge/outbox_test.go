@@ -0,0 +1,139 @@
+package edge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestOutboxDropWhileSending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutbox(dir, "upstream", 2)
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/a"}}})
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/b"}}})
+
+	// Start sending a, then fill up the queue so a gets dropped.
+	sending, seq, _ := o.peek()
+	if sending.Events[0].Service != "default/a" {
+		t.Fatalf("Expected a at the front, got %+v", sending)
+	}
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/c"}}})
+
+	// Delivering a mustn't remove b, which was never sent.
+	o.pop(seq)
+	if o.Len() != 2 {
+		t.Fatalf("Expected 2 batches left, got %d", o.Len())
+	}
+	next, seq, _ := o.peek()
+	if next.Events[0].Service != "default/b" {
+		t.Errorf("Expected b at the front, got %+v", next)
+	}
+	o.pop(seq)
+	if next, _, _ := o.peek(); next.Events[0].Service != "default/c" {
+		t.Errorf("Expected c at the front, got %+v", next)
+	}
+}
+
+func TestOutboxReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutbox(dir, "upstream:8053", 4)
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/a"}}})
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/b"}}})
+
+	reloaded := newOutbox(dir, "upstream:8053", 1)
+	reloaded.load()
+	if reloaded.Len() != 1 {
+		t.Fatalf("Expected 1 batch after reloading, got %d", reloaded.Len())
+	}
+	if next, _, _ := reloaded.peek(); next.Events[0].Service != "default/b" {
+		t.Errorf("Expected the newest batch to be kept, got %+v", next)
+	}
+}
+
+func TestOutboxJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutbox(dir, "upstream", 2*minOutboxCompaction)
+	defer o.close()
+	for i := 0; i < 2*minOutboxCompaction; i++ {
+		o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: fmt.Sprintf("default/%d", i)}}})
+	}
+
+	// Delivering most of the batches compacts the journal along the way,
+	// and a reload picks up right where delivery left off.
+	for i := 0; i < 2*minOutboxCompaction-3; i++ {
+		_, seq, _ := o.peek()
+		o.pop(seq)
+	}
+	if o.removed > minOutboxCompaction {
+		t.Errorf("Expected the journal to have been compacted, holding %d removals", o.removed)
+	}
+	reloaded := newOutbox(dir, "upstream", 2*minOutboxCompaction)
+	defer reloaded.close()
+	reloaded.load()
+	if reloaded.Len() != 3 {
+		t.Fatalf("Expected 3 batches after reloading, got %d", reloaded.Len())
+	}
+	if next, _, _ := reloaded.peek(); next.Events[0].Service != fmt.Sprintf("default/%d", 2*minOutboxCompaction-3) {
+		t.Errorf("Expected the first undelivered batch at the front, got %+v", next)
+	}
+}
+
+func TestOutboxTornRecord(t *testing.T) {
+	dir, err := ioutil.TempDir("", "outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := newOutbox(dir, "upstream", 4)
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/a"}}})
+	o.close()
+
+	// A crash in the middle of writing a record leaves it cut short.
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"batch":{"meta":`)
+	f.Close()
+
+	reloaded := newOutbox(dir, "upstream", 4)
+	defer reloaded.close()
+	reloaded.load()
+	if reloaded.Len() != 1 {
+		t.Fatalf("Expected 1 batch after reloading, got %d", reloaded.Len())
+	}
+
+	// And the rewritten journal carries on from there.
+	reloaded.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/b"}}})
+	again := newOutbox(dir, "upstream", 4)
+	again.load()
+	if again.Len() != 2 {
+		t.Errorf("Expected 2 batches after reloading again, got %d", again.Len())
+	}
+}
+
+func TestOutboxInMemory(t *testing.T) {
+	o := newOutbox("", "upstream", 4)
+	o.Enqueue(ServiceTableBatch{Events: []ServiceEvent{{Service: "default/a"}}})
+	o.load()
+	if o.path != "" || o.journal != nil || o.Len() != 1 {
+		t.Errorf("Expected the batch to be kept in memory only, got path %q and %d batches", o.path, o.Len())
+	}
+}
@@ -0,0 +1,108 @@
+package edge
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// The current version of the path option wire format.
+	pathOptionVersion = 1
+
+	// The default maximum number of edge sites a request may be forwarded through.
+	defaultMaxHops = 8
+)
+
+// forwardPath records the edge sites a request has already been forwarded
+// through, so that misconfigured upstreams can't bounce it around forever.
+type forwardPath struct {
+	Hops    uint8
+	Visited []string
+}
+
+// Encodes the path in the version 1 wire format: the version, the hop count,
+// and then each visited site ID prefixed by its length.
+func (p forwardPath) pack() []byte {
+	b := []byte{pathOptionVersion, p.Hops}
+	for _, id := range p.Visited {
+		if len(id) > math.MaxUint8 {
+			id = id[:math.MaxUint8]
+		}
+		b = append(b, uint8(len(id)))
+		b = append(b, id...)
+	}
+	return b
+}
+
+// Decodes a path option.
+func unpackPath(b []byte) (forwardPath, error) {
+	if len(b) < 2 || b[0] < pathOptionVersion {
+		return forwardPath{}, errInvalidPath
+	}
+	p := forwardPath{Hops: b[1]}
+	for i := 2; i < len(b); {
+		n := int(b[i])
+		if i+1+n > len(b) {
+			return forwardPath{}, errInvalidPath
+		}
+		p.Visited = append(p.Visited, string(b[i+1:i+1+n]))
+		i += 1 + n
+	}
+	return p, nil
+}
+
+// Contains returns true if the request has already passed through the given site.
+func (p forwardPath) Contains(siteID string) bool {
+	for _, id := range p.Visited {
+		if id == siteID {
+			return true
+		}
+	}
+	return false
+}
+
+// Next returns the path extended by one hop through the given site.
+func (p forwardPath) Next(siteID string) forwardPath {
+	hops := p.Hops
+	if hops < math.MaxUint8 {
+		hops++
+	}
+	visited := make([]string, len(p.Visited), len(p.Visited)+1)
+	copy(visited, p.Visited)
+	return forwardPath{Hops: hops, Visited: append(visited, siteID)}
+}
+
+// Parses and removes the forwarding path from a DNS message. Requests that
+// come straight from clients have an empty path.
+func extractPath(r *dns.Msg) forwardPath {
+	data, found := extractOption(r, pathOptionCode)
+	if !found {
+		return forwardPath{}
+	}
+	p, err := unpackPath(data)
+	if err != nil {
+		log.Errorf("unable to parse path option %x (%v)", data, err)
+		return forwardPath{}
+	}
+	return p
+}
+
+// Attaches the forwarding path to a DNS message that's about to be forwarded
+// upstream. Returns true if an OPT record had to be added.
+func insertPath(r *dns.Msg, p forwardPath) bool {
+	return insertOption(r, pathOptionCode, p.pack())
+}
+
+// Checks whether forwarding a request along the given path would loop,
+// returning a description of the problem if it would.
+func (e *Edge) checkPath(p forwardPath) (string, bool) {
+	if p.Contains(e.siteID) {
+		return fmt.Sprintf("forwarding loop detected at site %s (path %v)", e.siteID, p.Visited), false
+	}
+	if int(p.Hops) >= e.maxHops {
+		return fmt.Sprintf("maximum of %d forwarding hops exceeded (path %v)", e.maxHops, p.Visited), false
+	}
+	return "", true
+}
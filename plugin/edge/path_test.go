@@ -0,0 +1,108 @@
+package edge
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestPathRoundTrip(t *testing.T) {
+	tests := []forwardPath{
+		{},
+		{Hops: 1, Visited: []string{"edge-1"}},
+		{Hops: 3, Visited: []string{"edge-1", "", "relay-us-east"}},
+	}
+	for _, p := range tests {
+		got, err := unpackPath(p.pack())
+		if err != nil {
+			t.Errorf("%+v: unexpected error %v", p, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, p) {
+			t.Errorf("Expected %+v, got %+v", p, got)
+		}
+	}
+
+	// Site IDs too long for their length prefix are cut short rather than
+	// corrupting the rest of the option.
+	long := strings.Repeat("a", 300)
+	got, err := unpackPath(forwardPath{Hops: 2, Visited: []string{long, "edge-1"}}.pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := forwardPath{Hops: 2, Visited: []string{long[:255], "edge-1"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %+v, got %+v", want, got)
+	}
+}
+
+func TestUnpackPathInvalid(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":        nil,
+		"short":        {pathOptionVersion},
+		"version 0":    {0, 1},
+		"truncated id": {pathOptionVersion, 1, 6, 'e', 'd', 'g', 'e'},
+	}
+	for name, b := range tests {
+		if _, err := unpackPath(b); err != errInvalidPath {
+			t.Errorf("%s: expected %v, got %v", name, errInvalidPath, err)
+		}
+	}
+}
+
+func TestPathNext(t *testing.T) {
+	p := forwardPath{Hops: 1, Visited: make([]string, 1, 4)}
+	p.Visited[0] = "edge-1"
+
+	a, b := p.Next("edge-2"), p.Next("edge-3")
+	if a.Hops != 2 || !reflect.DeepEqual(a.Visited, []string{"edge-1", "edge-2"}) {
+		t.Errorf("Unexpected next path %+v", a)
+	}
+	// Extending the same path twice mustn't share the visited list.
+	if !reflect.DeepEqual(b.Visited, []string{"edge-1", "edge-3"}) || len(p.Visited) != 1 {
+		t.Errorf("Extending a path modified another: %+v, %+v, %+v", p, a, b)
+	}
+
+	if got := (forwardPath{Hops: 255}).Next("edge-1").Hops; got != 255 {
+		t.Errorf("Expected the hop count to saturate at 255, got %d", got)
+	}
+}
+
+func TestCheckPath(t *testing.T) {
+	e := New()
+	e.siteID = "edge-2"
+	e.maxHops = 3
+
+	tests := []struct {
+		name string
+		path forwardPath
+		ok   bool
+	}{
+		{"client", forwardPath{}, true},
+		{"other sites", forwardPath{Hops: 2, Visited: []string{"edge-1", "edge-3"}}, true},
+		{"self in path", forwardPath{Hops: 1, Visited: []string{"edge-2"}}, false},
+		{"hop limit", forwardPath{Hops: 3, Visited: []string{"edge-1", "edge-3", "edge-4"}}, false},
+		{"hop limit without visited", forwardPath{Hops: 200}, false},
+	}
+	for _, test := range tests {
+		if reason, ok := e.checkPath(test.path); ok != test.ok {
+			t.Errorf("%s: expected %v, got %v (%s)", test.name, test.ok, ok, reason)
+		}
+	}
+}
+
+func TestExtractPathMalformed(t *testing.T) {
+	r := new(dns.Msg)
+	r.SetQuestion("svc.default.svc.cluster.external.", dns.TypeA)
+	insertOption(r, pathOptionCode, []byte{pathOptionVersion, 1, 9, 'x'})
+
+	// A malformed option is treated as an empty path and is still removed.
+	if p := extractPath(r); !reflect.DeepEqual(p, forwardPath{}) {
+		t.Errorf("Expected an empty path, got %+v", p)
+	}
+	if _, found := extractOption(r, pathOptionCode); found {
+		t.Error("Expected the malformed path option to be removed")
+	}
+}
@@ -0,0 +1,1019 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: edge.proto
+
+package pb
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type Event_Type int32
+
+const (
+	Event_ADD    Event_Type = 0
+	Event_DELETE Event_Type = 1
+)
+
+var Event_Type_name = map[int32]string{
+	0: "ADD",
+	1: "DELETE",
+}
+
+var Event_Type_value = map[string]int32{
+	"ADD":    0,
+	"DELETE": 1,
+}
+
+func (x Event_Type) String() string {
+	return proto.EnumName(Event_Type_name, int32(x))
+}
+
+func (Event_Type) EnumDescriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{1, 0}
+}
+
+type Site struct {
+	Id                   string            `protobuf:"bytes,1,opt,name=id,proto3" json:"id,omitempty"`
+	Ip                   []byte            `protobuf:"bytes,2,opt,name=ip,proto3" json:"ip,omitempty"`
+	Lat                  float64           `protobuf:"fixed64,3,opt,name=lat,proto3" json:"lat,omitempty"`
+	Lon                  float64           `protobuf:"fixed64,4,opt,name=lon,proto3" json:"lon,omitempty"`
+	Alt                  float64           `protobuf:"fixed64,5,opt,name=alt,proto3" json:"alt,omitempty"`
+	Size                 float64           `protobuf:"fixed64,6,opt,name=size,proto3" json:"size,omitempty"`
+	Hp                   float64           `protobuf:"fixed64,7,opt,name=hp,proto3" json:"hp,omitempty"`
+	Vp                   float64           `protobuf:"fixed64,8,opt,name=vp,proto3" json:"vp,omitempty"`
+	Name                 string            `protobuf:"bytes,9,opt,name=name,proto3" json:"name,omitempty"`
+	Region               string            `protobuf:"bytes,10,opt,name=region,proto3" json:"region,omitempty"`
+	Labels               map[string]string `protobuf:"bytes,11,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Contact              string            `protobuf:"bytes,12,opt,name=contact,proto3" json:"contact,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *Site) Reset()         { *m = Site{} }
+func (m *Site) String() string { return proto.CompactTextString(m) }
+func (*Site) ProtoMessage()    {}
+func (*Site) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{0}
+}
+
+func (m *Site) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Site.Unmarshal(m, b)
+}
+func (m *Site) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Site.Marshal(b, m, deterministic)
+}
+func (m *Site) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Site.Merge(m, src)
+}
+func (m *Site) XXX_Size() int {
+	return xxx_messageInfo_Site.Size(m)
+}
+func (m *Site) XXX_DiscardUnknown() {
+	xxx_messageInfo_Site.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Site proto.InternalMessageInfo
+
+func (m *Site) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Site) GetIp() []byte {
+	if m != nil {
+		return m.Ip
+	}
+	return nil
+}
+
+func (m *Site) GetLat() float64 {
+	if m != nil {
+		return m.Lat
+	}
+	return 0
+}
+
+func (m *Site) GetLon() float64 {
+	if m != nil {
+		return m.Lon
+	}
+	return 0
+}
+
+func (m *Site) GetAlt() float64 {
+	if m != nil {
+		return m.Alt
+	}
+	return 0
+}
+
+func (m *Site) GetSize() float64 {
+	if m != nil {
+		return m.Size
+	}
+	return 0
+}
+
+func (m *Site) GetHp() float64 {
+	if m != nil {
+		return m.Hp
+	}
+	return 0
+}
+
+func (m *Site) GetVp() float64 {
+	if m != nil {
+		return m.Vp
+	}
+	return 0
+}
+
+func (m *Site) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Site) GetRegion() string {
+	if m != nil {
+		return m.Region
+	}
+	return ""
+}
+
+func (m *Site) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *Site) GetContact() string {
+	if m != nil {
+		return m.Contact
+	}
+	return ""
+}
+
+type Event struct {
+	Type                 Event_Type `protobuf:"varint,1,opt,name=type,proto3,enum=edge.Event_Type" json:"type,omitempty"`
+	Service              string     `protobuf:"bytes,2,opt,name=service,proto3" json:"service,omitempty"`
+	Generation           uint64     `protobuf:"varint,3,opt,name=generation,proto3" json:"generation,omitempty"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *Event) Reset()         { *m = Event{} }
+func (m *Event) String() string { return proto.CompactTextString(m) }
+func (*Event) ProtoMessage()    {}
+func (*Event) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{1}
+}
+
+func (m *Event) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Event.Unmarshal(m, b)
+}
+func (m *Event) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Event.Marshal(b, m, deterministic)
+}
+func (m *Event) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Event.Merge(m, src)
+}
+func (m *Event) XXX_Size() int {
+	return xxx_messageInfo_Event.Size(m)
+}
+func (m *Event) XXX_DiscardUnknown() {
+	xxx_messageInfo_Event.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Event proto.InternalMessageInfo
+
+func (m *Event) GetType() Event_Type {
+	if m != nil {
+		return m.Type
+	}
+	return Event_ADD
+}
+
+func (m *Event) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *Event) GetGeneration() uint64 {
+	if m != nil {
+		return m.Generation
+	}
+	return 0
+}
+
+type Register struct {
+	Meta                 *Site    `protobuf:"bytes,1,opt,name=meta,proto3" json:"meta,omitempty"`
+	FeedInterval         uint32   `protobuf:"varint,2,opt,name=feed_interval,json=feedInterval,proto3" json:"feed_interval,omitempty"`
+	FeedRadius           float64  `protobuf:"fixed64,3,opt,name=feed_radius,json=feedRadius,proto3" json:"feed_radius,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Register) Reset()         { *m = Register{} }
+func (m *Register) String() string { return proto.CompactTextString(m) }
+func (*Register) ProtoMessage()    {}
+func (*Register) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{2}
+}
+
+func (m *Register) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Register.Unmarshal(m, b)
+}
+func (m *Register) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Register.Marshal(b, m, deterministic)
+}
+func (m *Register) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Register.Merge(m, src)
+}
+func (m *Register) XXX_Size() int {
+	return xxx_messageInfo_Register.Size(m)
+}
+func (m *Register) XXX_DiscardUnknown() {
+	xxx_messageInfo_Register.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Register proto.InternalMessageInfo
+
+func (m *Register) GetMeta() *Site {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+func (m *Register) GetFeedInterval() uint32 {
+	if m != nil {
+		return m.FeedInterval
+	}
+	return 0
+}
+
+func (m *Register) GetFeedRadius() float64 {
+	if m != nil {
+		return m.FeedRadius
+	}
+	return 0
+}
+
+type Batch struct {
+	Meta                 *Site    `protobuf:"bytes,1,opt,name=meta,proto3" json:"meta,omitempty"`
+	Events               []*Event `protobuf:"bytes,2,rep,name=events,proto3" json:"events,omitempty"`
+	Path                 []string `protobuf:"bytes,3,rep,name=path,proto3" json:"path,omitempty"`
+	Seq                  uint64   `protobuf:"varint,4,opt,name=seq,proto3" json:"seq,omitempty"`
+	Run                  string   `protobuf:"bytes,5,opt,name=run,proto3" json:"run,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Batch) Reset()         { *m = Batch{} }
+func (m *Batch) String() string { return proto.CompactTextString(m) }
+func (*Batch) ProtoMessage()    {}
+func (*Batch) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{3}
+}
+
+func (m *Batch) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Batch.Unmarshal(m, b)
+}
+func (m *Batch) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Batch.Marshal(b, m, deterministic)
+}
+func (m *Batch) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Batch.Merge(m, src)
+}
+func (m *Batch) XXX_Size() int {
+	return xxx_messageInfo_Batch.Size(m)
+}
+func (m *Batch) XXX_DiscardUnknown() {
+	xxx_messageInfo_Batch.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Batch proto.InternalMessageInfo
+
+func (m *Batch) GetMeta() *Site {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+func (m *Batch) GetEvents() []*Event {
+	if m != nil {
+		return m.Events
+	}
+	return nil
+}
+
+func (m *Batch) GetPath() []string {
+	if m != nil {
+		return m.Path
+	}
+	return nil
+}
+
+func (m *Batch) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+func (m *Batch) GetRun() string {
+	if m != nil {
+		return m.Run
+	}
+	return ""
+}
+
+type Heartbeat struct {
+	Meta                 *Site    `protobuf:"bytes,1,opt,name=meta,proto3" json:"meta,omitempty"`
+	Ttl                  uint32   `protobuf:"varint,2,opt,name=ttl,proto3" json:"ttl,omitempty"`
+	Path                 []string `protobuf:"bytes,3,rep,name=path,proto3" json:"path,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Heartbeat) Reset()         { *m = Heartbeat{} }
+func (m *Heartbeat) String() string { return proto.CompactTextString(m) }
+func (*Heartbeat) ProtoMessage()    {}
+func (*Heartbeat) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{4}
+}
+
+func (m *Heartbeat) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Heartbeat.Unmarshal(m, b)
+}
+func (m *Heartbeat) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Heartbeat.Marshal(b, m, deterministic)
+}
+func (m *Heartbeat) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Heartbeat.Merge(m, src)
+}
+func (m *Heartbeat) XXX_Size() int {
+	return xxx_messageInfo_Heartbeat.Size(m)
+}
+func (m *Heartbeat) XXX_DiscardUnknown() {
+	xxx_messageInfo_Heartbeat.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Heartbeat proto.InternalMessageInfo
+
+func (m *Heartbeat) GetMeta() *Site {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+func (m *Heartbeat) GetTtl() uint32 {
+	if m != nil {
+		return m.Ttl
+	}
+	return 0
+}
+
+func (m *Heartbeat) GetPath() []string {
+	if m != nil {
+		return m.Path
+	}
+	return nil
+}
+
+type Sync struct {
+	Meta                 *Site    `protobuf:"bytes,1,opt,name=meta,proto3" json:"meta,omitempty"`
+	Services             []string `protobuf:"bytes,2,rep,name=services,proto3" json:"services,omitempty"`
+	Digest               string   `protobuf:"bytes,3,opt,name=digest,proto3" json:"digest,omitempty"`
+	Path                 []string `protobuf:"bytes,4,rep,name=path,proto3" json:"path,omitempty"`
+	Full                 bool     `protobuf:"varint,5,opt,name=full,proto3" json:"full,omitempty"`
+	Generation           uint64   `protobuf:"varint,6,opt,name=generation,proto3" json:"generation,omitempty"`
+	Run                  string   `protobuf:"bytes,7,opt,name=run,proto3" json:"run,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Sync) Reset()         { *m = Sync{} }
+func (m *Sync) String() string { return proto.CompactTextString(m) }
+func (*Sync) ProtoMessage()    {}
+func (*Sync) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{5}
+}
+
+func (m *Sync) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Sync.Unmarshal(m, b)
+}
+func (m *Sync) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Sync.Marshal(b, m, deterministic)
+}
+func (m *Sync) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Sync.Merge(m, src)
+}
+func (m *Sync) XXX_Size() int {
+	return xxx_messageInfo_Sync.Size(m)
+}
+func (m *Sync) XXX_DiscardUnknown() {
+	xxx_messageInfo_Sync.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Sync proto.InternalMessageInfo
+
+func (m *Sync) GetMeta() *Site {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+func (m *Sync) GetServices() []string {
+	if m != nil {
+		return m.Services
+	}
+	return nil
+}
+
+func (m *Sync) GetDigest() string {
+	if m != nil {
+		return m.Digest
+	}
+	return ""
+}
+
+func (m *Sync) GetPath() []string {
+	if m != nil {
+		return m.Path
+	}
+	return nil
+}
+
+func (m *Sync) GetFull() bool {
+	if m != nil {
+		return m.Full
+	}
+	return false
+}
+
+func (m *Sync) GetGeneration() uint64 {
+	if m != nil {
+		return m.Generation
+	}
+	return 0
+}
+
+func (m *Sync) GetRun() string {
+	if m != nil {
+		return m.Run
+	}
+	return ""
+}
+
+type Entry struct {
+	Service              string   `protobuf:"bytes,1,opt,name=service,proto3" json:"service,omitempty"`
+	Sites                []*Site  `protobuf:"bytes,2,rep,name=sites,proto3" json:"sites,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Entry) Reset()         { *m = Entry{} }
+func (m *Entry) String() string { return proto.CompactTextString(m) }
+func (*Entry) ProtoMessage()    {}
+func (*Entry) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{6}
+}
+
+func (m *Entry) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Entry.Unmarshal(m, b)
+}
+func (m *Entry) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Entry.Marshal(b, m, deterministic)
+}
+func (m *Entry) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Entry.Merge(m, src)
+}
+func (m *Entry) XXX_Size() int {
+	return xxx_messageInfo_Entry.Size(m)
+}
+func (m *Entry) XXX_DiscardUnknown() {
+	xxx_messageInfo_Entry.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Entry proto.InternalMessageInfo
+
+func (m *Entry) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *Entry) GetSites() []*Site {
+	if m != nil {
+		return m.Sites
+	}
+	return nil
+}
+
+type Snapshot struct {
+	Meta                 *Site    `protobuf:"bytes,1,opt,name=meta,proto3" json:"meta,omitempty"`
+	Entries              []*Entry `protobuf:"bytes,2,rep,name=entries,proto3" json:"entries,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Snapshot) Reset()         { *m = Snapshot{} }
+func (m *Snapshot) String() string { return proto.CompactTextString(m) }
+func (*Snapshot) ProtoMessage()    {}
+func (*Snapshot) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{7}
+}
+
+func (m *Snapshot) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Snapshot.Unmarshal(m, b)
+}
+func (m *Snapshot) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Snapshot.Marshal(b, m, deterministic)
+}
+func (m *Snapshot) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Snapshot.Merge(m, src)
+}
+func (m *Snapshot) XXX_Size() int {
+	return xxx_messageInfo_Snapshot.Size(m)
+}
+func (m *Snapshot) XXX_DiscardUnknown() {
+	xxx_messageInfo_Snapshot.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Snapshot proto.InternalMessageInfo
+
+func (m *Snapshot) GetMeta() *Site {
+	if m != nil {
+		return m.Meta
+	}
+	return nil
+}
+
+func (m *Snapshot) GetEntries() []*Entry {
+	if m != nil {
+		return m.Entries
+	}
+	return nil
+}
+
+type Ack struct {
+	Seq                  uint64   `protobuf:"varint,1,opt,name=seq,proto3" json:"seq,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Ack) Reset()         { *m = Ack{} }
+func (m *Ack) String() string { return proto.CompactTextString(m) }
+func (*Ack) ProtoMessage()    {}
+func (*Ack) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{8}
+}
+
+func (m *Ack) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Ack.Unmarshal(m, b)
+}
+func (m *Ack) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Ack.Marshal(b, m, deterministic)
+}
+func (m *Ack) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Ack.Merge(m, src)
+}
+func (m *Ack) XXX_Size() int {
+	return xxx_messageInfo_Ack.Size(m)
+}
+func (m *Ack) XXX_DiscardUnknown() {
+	xxx_messageInfo_Ack.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Ack proto.InternalMessageInfo
+
+func (m *Ack) GetSeq() uint64 {
+	if m != nil {
+		return m.Seq
+	}
+	return 0
+}
+
+type Up struct {
+	// Types that are valid to be assigned to Msg:
+	//	*Up_Register
+	//	*Up_Batch
+	//	*Up_Heartbeat
+	//	*Up_Sync
+	Msg                  isUp_Msg `protobuf_oneof:"msg"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *Up) Reset()         { *m = Up{} }
+func (m *Up) String() string { return proto.CompactTextString(m) }
+func (*Up) ProtoMessage()    {}
+func (*Up) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{9}
+}
+
+func (m *Up) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Up.Unmarshal(m, b)
+}
+func (m *Up) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Up.Marshal(b, m, deterministic)
+}
+func (m *Up) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Up.Merge(m, src)
+}
+func (m *Up) XXX_Size() int {
+	return xxx_messageInfo_Up.Size(m)
+}
+func (m *Up) XXX_DiscardUnknown() {
+	xxx_messageInfo_Up.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Up proto.InternalMessageInfo
+
+type isUp_Msg interface {
+	isUp_Msg()
+}
+
+type Up_Register struct {
+	Register *Register `protobuf:"bytes,1,opt,name=register,proto3,oneof"`
+}
+
+type Up_Batch struct {
+	Batch *Batch `protobuf:"bytes,2,opt,name=batch,proto3,oneof"`
+}
+
+type Up_Heartbeat struct {
+	Heartbeat *Heartbeat `protobuf:"bytes,3,opt,name=heartbeat,proto3,oneof"`
+}
+
+type Up_Sync struct {
+	Sync *Sync `protobuf:"bytes,4,opt,name=sync,proto3,oneof"`
+}
+
+func (*Up_Register) isUp_Msg() {}
+
+func (*Up_Batch) isUp_Msg() {}
+
+func (*Up_Heartbeat) isUp_Msg() {}
+
+func (*Up_Sync) isUp_Msg() {}
+
+func (m *Up) GetMsg() isUp_Msg {
+	if m != nil {
+		return m.Msg
+	}
+	return nil
+}
+
+func (m *Up) GetRegister() *Register {
+	if x, ok := m.GetMsg().(*Up_Register); ok {
+		return x.Register
+	}
+	return nil
+}
+
+func (m *Up) GetBatch() *Batch {
+	if x, ok := m.GetMsg().(*Up_Batch); ok {
+		return x.Batch
+	}
+	return nil
+}
+
+func (m *Up) GetHeartbeat() *Heartbeat {
+	if x, ok := m.GetMsg().(*Up_Heartbeat); ok {
+		return x.Heartbeat
+	}
+	return nil
+}
+
+func (m *Up) GetSync() *Sync {
+	if x, ok := m.GetMsg().(*Up_Sync); ok {
+		return x.Sync
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*Up) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*Up_Register)(nil),
+		(*Up_Batch)(nil),
+		(*Up_Heartbeat)(nil),
+		(*Up_Sync)(nil),
+	}
+}
+
+type Down struct {
+	// Types that are valid to be assigned to Msg:
+	//	*Down_Ack
+	//	*Down_Snapshot
+	//	*Down_Resync
+	Msg                  isDown_Msg `protobuf_oneof:"msg"`
+	XXX_NoUnkeyedLiteral struct{}   `json:"-"`
+	XXX_unrecognized     []byte     `json:"-"`
+	XXX_sizecache        int32      `json:"-"`
+}
+
+func (m *Down) Reset()         { *m = Down{} }
+func (m *Down) String() string { return proto.CompactTextString(m) }
+func (*Down) ProtoMessage()    {}
+func (*Down) Descriptor() ([]byte, []int) {
+	return fileDescriptor_cab1176173a95651, []int{10}
+}
+
+func (m *Down) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_Down.Unmarshal(m, b)
+}
+func (m *Down) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_Down.Marshal(b, m, deterministic)
+}
+func (m *Down) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_Down.Merge(m, src)
+}
+func (m *Down) XXX_Size() int {
+	return xxx_messageInfo_Down.Size(m)
+}
+func (m *Down) XXX_DiscardUnknown() {
+	xxx_messageInfo_Down.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_Down proto.InternalMessageInfo
+
+type isDown_Msg interface {
+	isDown_Msg()
+}
+
+type Down_Ack struct {
+	Ack *Ack `protobuf:"bytes,1,opt,name=ack,proto3,oneof"`
+}
+
+type Down_Snapshot struct {
+	Snapshot *Snapshot `protobuf:"bytes,2,opt,name=snapshot,proto3,oneof"`
+}
+
+type Down_Resync struct {
+	Resync *Sync `protobuf:"bytes,3,opt,name=resync,proto3,oneof"`
+}
+
+func (*Down_Ack) isDown_Msg() {}
+
+func (*Down_Snapshot) isDown_Msg() {}
+
+func (*Down_Resync) isDown_Msg() {}
+
+func (m *Down) GetMsg() isDown_Msg {
+	if m != nil {
+		return m.Msg
+	}
+	return nil
+}
+
+func (m *Down) GetAck() *Ack {
+	if x, ok := m.GetMsg().(*Down_Ack); ok {
+		return x.Ack
+	}
+	return nil
+}
+
+func (m *Down) GetSnapshot() *Snapshot {
+	if x, ok := m.GetMsg().(*Down_Snapshot); ok {
+		return x.Snapshot
+	}
+	return nil
+}
+
+func (m *Down) GetResync() *Sync {
+	if x, ok := m.GetMsg().(*Down_Resync); ok {
+		return x.Resync
+	}
+	return nil
+}
+
+// XXX_OneofWrappers is for the internal use of the proto package.
+func (*Down) XXX_OneofWrappers() []interface{} {
+	return []interface{}{
+		(*Down_Ack)(nil),
+		(*Down_Snapshot)(nil),
+		(*Down_Resync)(nil),
+	}
+}
+
+func init() {
+	proto.RegisterEnum("edge.Event_Type", Event_Type_name, Event_Type_value)
+	proto.RegisterType((*Site)(nil), "edge.Site")
+	proto.RegisterMapType((map[string]string)(nil), "edge.Site.LabelsEntry")
+	proto.RegisterType((*Event)(nil), "edge.Event")
+	proto.RegisterType((*Register)(nil), "edge.Register")
+	proto.RegisterType((*Batch)(nil), "edge.Batch")
+	proto.RegisterType((*Heartbeat)(nil), "edge.Heartbeat")
+	proto.RegisterType((*Sync)(nil), "edge.Sync")
+	proto.RegisterType((*Entry)(nil), "edge.Entry")
+	proto.RegisterType((*Snapshot)(nil), "edge.Snapshot")
+	proto.RegisterType((*Ack)(nil), "edge.Ack")
+	proto.RegisterType((*Up)(nil), "edge.Up")
+	proto.RegisterType((*Down)(nil), "edge.Down")
+}
+
+func init() { proto.RegisterFile("edge.proto", fileDescriptor_cab1176173a95651) }
+
+var fileDescriptor_cab1176173a95651 = []byte{
+	// 752 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x8c, 0x54, 0x4d, 0x6f, 0xe3, 0x36,
+	0x10, 0xb5, 0x24, 0xfa, 0x43, 0xe3, 0x24, 0x35, 0x88, 0x22, 0x25, 0x52, 0x34, 0x35, 0x94, 0x14,
+	0xf0, 0xa1, 0x75, 0x0b, 0xf7, 0xd2, 0xf6, 0x96, 0xd4, 0x06, 0x5c, 0x20, 0x97, 0xd0, 0xc9, 0xa5,
+	0x97, 0x82, 0x96, 0x19, 0x5b, 0xb0, 0x42, 0xa9, 0x12, 0xed, 0xc2, 0x3d, 0xed, 0x61, 0xff, 0xd0,
+	0x02, 0xfb, 0x07, 0xf6, 0x9f, 0x2d, 0x66, 0x44, 0x39, 0x4e, 0x10, 0x20, 0x7b, 0x9b, 0x79, 0x33,
+	0x24, 0xe7, 0xbd, 0x79, 0x12, 0x80, 0x5e, 0x2c, 0xf5, 0x30, 0x2f, 0x32, 0x9b, 0x71, 0x86, 0x71,
+	0xf4, 0xc9, 0x07, 0x36, 0x4b, 0xac, 0xe6, 0x27, 0xe0, 0x27, 0x0b, 0xe1, 0xf5, 0xbd, 0x41, 0x28,
+	0xfd, 0x64, 0x41, 0x79, 0x2e, 0xfc, 0xbe, 0x37, 0x38, 0x92, 0x7e, 0x92, 0xf3, 0x1e, 0x04, 0xa9,
+	0xb2, 0x22, 0xe8, 0x7b, 0x03, 0x4f, 0x62, 0x48, 0x48, 0x66, 0x04, 0x73, 0x48, 0x66, 0x10, 0x51,
+	0xa9, 0x15, 0xcd, 0x0a, 0x51, 0xa9, 0xe5, 0x1c, 0x58, 0x99, 0xfc, 0xaf, 0x45, 0x8b, 0x20, 0x8a,
+	0xf1, 0xe6, 0x55, 0x2e, 0xda, 0x84, 0xf8, 0xab, 0x1c, 0xf3, 0x6d, 0x2e, 0x3a, 0x55, 0xbe, 0xcd,
+	0xf1, 0x8c, 0x51, 0x8f, 0x5a, 0x84, 0x34, 0x0b, 0xc5, 0xfc, 0x14, 0x5a, 0x85, 0x5e, 0x26, 0x99,
+	0x11, 0x40, 0xa8, 0xcb, 0xf8, 0x10, 0x5a, 0xa9, 0x9a, 0xeb, 0xb4, 0x14, 0xdd, 0x7e, 0x30, 0xe8,
+	0x8e, 0x4e, 0x87, 0xc4, 0x10, 0x19, 0x0d, 0x6f, 0xa8, 0x30, 0x31, 0xb6, 0xd8, 0x49, 0xd7, 0xc5,
+	0x05, 0xb4, 0xe3, 0xcc, 0x58, 0x15, 0x5b, 0x71, 0x44, 0x17, 0xd5, 0xe9, 0xd9, 0xef, 0xd0, 0x3d,
+	0x38, 0x80, 0x54, 0xd6, 0x7a, 0xe7, 0xf4, 0xc0, 0x90, 0x7f, 0x0d, 0xcd, 0xad, 0x4a, 0x37, 0x9a,
+	0x34, 0x09, 0x65, 0x95, 0xfc, 0xe1, 0xff, 0xe6, 0x45, 0xef, 0x3d, 0x68, 0x4e, 0xb6, 0xda, 0x58,
+	0x7e, 0x09, 0xcc, 0xee, 0x72, 0x4d, 0xc7, 0x4e, 0x46, 0xbd, 0x6a, 0x18, 0x2a, 0x0d, 0xef, 0x76,
+	0xb9, 0x96, 0x54, 0xc5, 0x21, 0x4a, 0x5d, 0x6c, 0x93, 0xb8, 0xbe, 0xab, 0x4e, 0xf9, 0x39, 0xc0,
+	0x52, 0x1b, 0x5d, 0x28, 0x8b, 0x54, 0x51, 0x6b, 0x26, 0x0f, 0x90, 0xe8, 0x5b, 0x60, 0x78, 0x0f,
+	0x6f, 0x43, 0x70, 0x35, 0x1e, 0xf7, 0x1a, 0x1c, 0xa0, 0x35, 0x9e, 0xdc, 0x4c, 0xee, 0x26, 0x3d,
+	0x2f, 0xca, 0xa1, 0x23, 0xf5, 0x32, 0x29, 0xad, 0x2e, 0xf8, 0x39, 0xb0, 0x47, 0x6d, 0x15, 0x0d,
+	0xd2, 0x1d, 0xc1, 0x93, 0x2a, 0x92, 0x70, 0x7e, 0x01, 0xc7, 0x0f, 0x5a, 0x2f, 0xfe, 0x49, 0x8c,
+	0xd5, 0xc5, 0x56, 0xa5, 0x34, 0xc8, 0xb1, 0x3c, 0x42, 0xf0, 0x2f, 0x87, 0xf1, 0xef, 0xa1, 0x4b,
+	0x4d, 0x85, 0x5a, 0x24, 0x9b, 0xd2, 0xad, 0x1e, 0x10, 0x92, 0x84, 0x10, 0xf1, 0x6b, 0x65, 0xe3,
+	0xd5, 0x17, 0xbc, 0xd7, 0xd2, 0x28, 0x43, 0x29, 0x7c, 0xda, 0x53, 0xf7, 0x40, 0x1a, 0xe9, 0x4a,
+	0xb8, 0xf8, 0x5c, 0xd9, 0x95, 0x08, 0xfa, 0x01, 0x2e, 0x1e, 0x63, 0xdc, 0x43, 0xa9, 0xff, 0x25,
+	0x93, 0x31, 0x89, 0x21, 0x22, 0xc5, 0xc6, 0x90, 0xc9, 0x42, 0x89, 0x61, 0x74, 0x0b, 0xe1, 0x54,
+	0xab, 0xc2, 0xce, 0xb5, 0xb2, 0x6f, 0x4e, 0xd2, 0x83, 0xc0, 0xda, 0x9a, 0x2f, 0x86, 0xaf, 0x3d,
+	0x1b, 0x7d, 0xf4, 0x80, 0xcd, 0x76, 0x26, 0x7e, 0xf3, 0xba, 0x33, 0xe8, 0xb8, 0xe5, 0x55, 0xd4,
+	0x42, 0xb9, 0xcf, 0xd1, 0xb4, 0x8b, 0x64, 0xa9, 0xcb, 0xea, 0xab, 0x09, 0xa5, 0xcb, 0xf6, 0x0f,
+	0xb2, 0x03, 0x9e, 0x1c, 0xd8, 0xc3, 0x26, 0x4d, 0x89, 0x56, 0x47, 0x52, 0xfc, 0xc2, 0x0d, 0xad,
+	0x97, 0x6e, 0xa8, 0x95, 0x68, 0x3f, 0x29, 0xf1, 0x27, 0x34, 0x2b, 0xfb, 0x1e, 0x58, 0xcc, 0x7b,
+	0x6e, 0xb1, 0x3e, 0x34, 0xcb, 0xc4, 0xea, 0x7a, 0x11, 0x87, 0x8c, 0xaa, 0x42, 0x74, 0x0b, 0x9d,
+	0x99, 0x51, 0x79, 0xb9, 0xca, 0xde, 0x56, 0xf3, 0x07, 0x68, 0x6b, 0x63, 0x8b, 0x44, 0xbf, 0x5c,
+	0x2c, 0x7d, 0x75, 0x75, 0x2d, 0xfa, 0x06, 0x82, 0xab, 0x78, 0x5d, 0x2f, 0xd3, 0xdb, 0x2f, 0x33,
+	0xfa, 0xe0, 0x81, 0x7f, 0x9f, 0xf3, 0x1f, 0xa1, 0x53, 0x38, 0xeb, 0xba, 0xa7, 0x4e, 0xaa, 0x7b,
+	0x6a, 0x43, 0x4f, 0x1b, 0x72, 0xdf, 0xc1, 0x2f, 0xa0, 0x39, 0x47, 0xd7, 0xd1, 0x12, 0xf7, 0x4f,
+	0x92, 0x11, 0xa7, 0x0d, 0x59, 0xd5, 0xf8, 0xcf, 0x10, 0xae, 0x6a, 0x53, 0x90, 0xfe, 0xdd, 0xd1,
+	0x57, 0x55, 0xe3, 0xde, 0x2b, 0xd3, 0x86, 0x7c, 0xea, 0xe1, 0x7d, 0x60, 0xe5, 0xce, 0xc4, 0x82,
+	0x3d, 0xa3, 0xba, 0x33, 0xf1, 0xb4, 0x21, 0xa9, 0x72, 0xdd, 0x84, 0xe0, 0xb1, 0x5c, 0x46, 0xef,
+	0x3c, 0x60, 0xe3, 0xec, 0x3f, 0xc3, 0xbf, 0x83, 0x40, 0xc5, 0x6b, 0x37, 0x70, 0x58, 0x1d, 0xb8,
+	0x8a, 0xd7, 0xd3, 0x86, 0x44, 0x1c, 0x49, 0x95, 0x4e, 0x47, 0xe1, 0x1f, 0x92, 0xaa, 0xd5, 0x45,
+	0x52, 0x75, 0x07, 0xbf, 0xc4, 0x3f, 0x1c, 0x0d, 0x10, 0xbc, 0x32, 0x80, 0xab, 0xb9, 0x11, 0x46,
+	0x3f, 0x01, 0x9b, 0x2c, 0x96, 0x1a, 0xe5, 0x9f, 0xe9, 0xb2, 0x44, 0x33, 0x74, 0xaa, 0xfe, 0xfb,
+	0xfc, 0xcc, 0x9d, 0xc4, 0x11, 0xa3, 0xc6, 0xc0, 0xfb, 0xc5, 0xbb, 0x66, 0x7f, 0xfb, 0xf9, 0x7c,
+	0xde, 0xa2, 0xff, 0xfe, 0xaf, 0x9f, 0x07, 0x00, 0xe2, 0x02, 0x8b, 0x07, 0x05, 0x06, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// EdgeClient is the client API for Edge service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type EdgeClient interface {
+	Session(ctx context.Context, opts ...grpc.CallOption) (Edge_SessionClient, error)
+}
+
+type edgeClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewEdgeClient(cc *grpc.ClientConn) EdgeClient {
+	return &edgeClient{cc}
+}
+
+func (c *edgeClient) Session(ctx context.Context, opts ...grpc.CallOption) (Edge_SessionClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Edge_serviceDesc.Streams[0], "/edge.Edge/Session", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &edgeSessionClient{stream}
+	return x, nil
+}
+
+type Edge_SessionClient interface {
+	Send(*Up) error
+	Recv() (*Down, error)
+	grpc.ClientStream
+}
+
+type edgeSessionClient struct {
+	grpc.ClientStream
+}
+
+func (x *edgeSessionClient) Send(m *Up) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *edgeSessionClient) Recv() (*Down, error) {
+	m := new(Down)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// EdgeServer is the server API for Edge service.
+type EdgeServer interface {
+	Session(Edge_SessionServer) error
+}
+
+// UnimplementedEdgeServer can be embedded to have forward compatible implementations.
+type UnimplementedEdgeServer struct {
+}
+
+func (*UnimplementedEdgeServer) Session(srv Edge_SessionServer) error {
+	return status.Errorf(codes.Unimplemented, "method Session not implemented")
+}
+
+func RegisterEdgeServer(s *grpc.Server, srv EdgeServer) {
+	s.RegisterService(&_Edge_serviceDesc, srv)
+}
+
+func _Edge_Session_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(EdgeServer).Session(&edgeSessionServer{stream})
+}
+
+type Edge_SessionServer interface {
+	Send(*Down) error
+	Recv() (*Up, error)
+	grpc.ServerStream
+}
+
+type edgeSessionServer struct {
+	grpc.ServerStream
+}
+
+func (x *edgeSessionServer) Send(m *Down) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *edgeSessionServer) Recv() (*Up, error) {
+	m := new(Up)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+var _Edge_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "edge.Edge",
+	HandlerType: (*EdgeServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Session",
+			Handler:       _Edge_Session_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "edge.proto",
+}
@@ -0,0 +1,173 @@
+package edge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	defaultPersistInterval = time.Minute
+	defaultStaleTimeout    = 5 * time.Minute
+)
+
+// persistedTable is the on-disk form of the table.
+type persistedTable struct {
+	Taken time.Time       `json:"taken"`
+	Sites []persistedSite `json:"sites"`
+}
+
+// persistedSite holds the entries of a single downstream site, along with the
+// lease it held when the table was persisted.
+type persistedSite struct {
+	Meta     Site     `json:"meta"`
+	Services []string `json:"services"`
+
+	// The lease TTL in seconds, zero if the site didn't hold a lease.
+	LeaseTTL uint32 `json:"lease_ttl,omitempty"`
+
+	// When the services expire, if they were loaded from the persist file and
+	// haven't been confirmed since.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Writes the entries pushed by downstream sites to the persist file, along
+// with the stale entries loaded from it that are still waiting to be
+// confirmed. Entries learned from upstreams and this site's own services are
+// left out, since they're rebuilt on their own after a restart.
+func (e *Edge) persistTable() {
+	persisted := persistedTable{Taken: time.Now()}
+	own := hashOf(e.site)
+	sites := e.table.Sites()
+	for hash, site := range sites {
+		if hash == own {
+			continue
+		}
+		persisted.Sites = append(persisted.Sites, persistedSite{
+			Meta:     site.Meta,
+			Services: site.Services,
+			LeaseTTL: uint32(e.leases.TTLOf(site.Meta) / time.Second),
+		})
+	}
+	for hash, site := range e.table.ExpiringSites() {
+		if !e.staleSites[hash] {
+			continue
+		}
+
+		// Stale entries keep their deadline, so they don't live on forever
+		// when the edge site restarts more often than the stale timeout.
+		var stale persistedSite
+		for serviceName, expires := range site.Expires {
+			expires := expires
+			if stale.Expires == nil || expires.Before(*stale.Expires) {
+				stale.Expires = &expires
+			}
+			stale.Services = append(stale.Services, serviceName)
+		}
+		sort.Strings(stale.Services)
+		stale.Meta = site.Meta
+		if _, found := sites[hash]; !found {
+			stale.LeaseTTL = uint32(e.leases.TTLOf(site.Meta) / time.Second)
+		}
+		persisted.Sites = append(persisted.Sites, stale)
+	}
+	jsn, err := json.Marshal(persisted)
+	if err != nil {
+		log.Errorf("unable to marshal table: %v", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(e.persistPath), 0700); err != nil {
+		log.Errorf("unable to create table directory: %v", err)
+		return
+	}
+	tmp := e.persistPath + ".tmp"
+	if err = ioutil.WriteFile(tmp, jsn, 0600); err != nil {
+		log.Errorf("unable to write table to %s: %v", e.persistPath, err)
+		return
+	}
+	if err = os.Rename(tmp, e.persistPath); err != nil {
+		log.Errorf("unable to write table to %s: %v", e.persistPath, err)
+	}
+}
+
+// Loads the table persisted by a previous run. The loaded entries are stale:
+// they're dropped after e.staleTimeout, or whatever was left of it when they
+// were persisted, unless a sync from their site confirms them first.
+func (e *Edge) loadTable() {
+	jsn, err := ioutil.ReadFile(e.persistPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Errorf("unable to read table from %s: %v", e.persistPath, err)
+		}
+		return
+	}
+	persisted := persistedTable{}
+	if err = json.Unmarshal(jsn, &persisted); err != nil {
+		log.Errorf("unable to parse table from %s: %v", e.persistPath, err)
+		return
+	}
+	own := hashOf(e.site)
+	now := time.Now()
+	e.staleSites = make(map[uint64]bool)
+	for _, site := range persisted.Sites {
+		hash := hashOf(site.Meta)
+		if hash == own {
+			continue
+		}
+		stale := now.Add(e.staleTimeout)
+		if site.Expires != nil {
+			if !now.Before(*site.Expires) {
+				continue
+			}
+			if site.Expires.Before(stale) {
+				stale = *site.Expires
+			}
+		}
+		e.staleSites[hash] = true
+		for _, serviceName := range site.Services {
+			e.table.AddWithExpiry(site.Meta, serviceName, stale)
+		}
+		if site.LeaseTTL > 0 {
+			e.leases.Grant(site.Meta, time.Duration(site.LeaseTTL)*time.Second)
+		}
+	}
+	log.Infof("loaded %d sites from table persisted at %s", len(persisted.Sites), persisted.Taken)
+}
+
+// Periodically persists the table.
+func (e *Edge) startPersistingTable() {
+	if e.persistPath == "" {
+		return
+	}
+	e.loadTable()
+	if e.persistInterval <= 0 {
+		return
+	}
+	e.persistStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(e.persistInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.persistTable()
+			case <-e.persistStop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops persisting the table, persisting it one last time.
+func (e *Edge) stopPersistingTable() {
+	if e.persistPath == "" {
+		return
+	}
+	if e.persistStop != nil {
+		close(e.persistStop)
+	}
+	e.persistTable()
+}
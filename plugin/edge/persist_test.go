@@ -0,0 +1,58 @@
+package edge
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistOff(t *testing.T) {
+	e := New()
+	if e.persistPath != "" {
+		t.Errorf("Expected persistence to be off by default, got %s", e.persistPath)
+	}
+}
+
+func TestPersistStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "persist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "table.json")
+	site := Site{ID: "downstream", IP: net.ParseIP("10.0.0.1")}
+
+	first := New()
+	first.persistPath = path
+	first.table.Add(site, "default/a")
+	first.persistTable()
+
+	// Entries loaded from the file are stale...
+	second := New()
+	second.persistPath = path
+	second.loadTable()
+	if !second.table.Expiring(site) {
+		t.Fatal("Expected loaded entries to be stale")
+	}
+
+	// ...and survive being persisted again, keeping their deadline.
+	second.persistTable()
+	third := New()
+	third.persistPath = path
+	third.staleTimeout = time.Hour
+	third.loadTable()
+	expiring := third.table.ExpiringSites()[hashOf(site)]
+	if expiring == nil {
+		t.Fatal("Expected stale entries to be persisted again")
+	}
+	expires, found := expiring.Expires["default/a"]
+	if !found {
+		t.Fatalf("Expected default/a to be stale, got %v", expiring.Expires)
+	}
+	if time.Until(expires) > defaultStaleTimeout {
+		t.Errorf("Expected the stale deadline to be kept, got %s", time.Until(expires))
+	}
+}
@@ -23,162 +23,326 @@ package edge
 import (
 	"crypto/tls"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/miekg/dns"
 )
 
+const (
+	defaultMaxIdleConns = 32
+	defaultMaxOpenConns = 0
+	minReapInterval     = time.Second
+)
+
+// The protocols for which a transport keeps a separate pool of connections.
+const (
+	udpShard = iota
+	tcpShard
+	tlsShard
+	numShards
+)
+
 // persistConn holds the dns.Conn and the last used time.
 type persistConn struct {
 	c    *dns.Conn
 	used time.Time
 }
 
-// connErr is used to communicate the connection manager.
-type connErr struct {
-	c   *dns.Conn
-	err error
+// connPool is a bounded pool of connections to the same upstream, all using
+// the same protocol. Idle connections are kept in a LIFO stack so the most
+// recently used (and therefore least likely to have expired) are reused first.
+type connPool struct {
+	sync.Mutex
+
+	// The idle connections, ordered from least to most recently used.
+	idle []*persistConn
+
+	// The number of connections currently open, both idle and in use.
+	open int
+
+	// Closed and replaced whenever a connection is returned or released, to
+	// wake up callers waiting for an open slot.
+	wait chan struct{}
 }
 
 // transport holds the persistent cache.
 type transport struct {
-	conns     map[string][]*persistConn //  Buckets for udp, tcp and tcp-tls.
-	expire    time.Duration             //  After this duration a connection is expired.
+	shards    [numShards]*connPool
+	expire    time.Duration //  After this duration a connection is expired.
+	maxIdle   int           //  The maximum number of idle connections per protocol.
+	maxOpen   int           //  The maximum number of open connections per protocol, 0 for no limit.
 	addr      string
 	tlsConfig *tls.Config
 
-	dial  chan string
-	yield chan connErr
-	ret   chan connErr
-
-	// Aid in testing, gets length of cache in data-race safe manner.
-	lenc    chan bool
-	lencOut chan int
+	// The secrets for signing requests, set on every new connection.
+	tsigSecret map[string]string
 
-	stop chan bool
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
-// Initializes a new transport channel and manages it in a goroutine.
+// Initializes a new transport with an empty pool for each protocol.
 func newTransport(addr string, tlsConfig *tls.Config) *transport {
 	t := &transport{
-		conns:   make(map[string][]*persistConn),
-		expire:  defaultExpire,
-		addr:    addr,
-		dial:    make(chan string),
-		yield:   make(chan connErr),
-		ret:     make(chan connErr),
-		stop:    make(chan bool),
-		lenc:    make(chan bool),
-		lencOut: make(chan int),
-	}
-	go t.connManager()
+		expire:    defaultExpire,
+		maxIdle:   defaultMaxIdleConns,
+		maxOpen:   defaultMaxOpenConns,
+		addr:      addr,
+		tlsConfig: tlsConfig,
+		stop:      make(chan struct{}),
+	}
+	for i := range t.shards {
+		t.shards[i] = &connPool{wait: make(chan struct{})}
+	}
 	return t
 }
 
-// len returns the number of connections, used for metrics. Can only be safely
-// used inside connManager() because of data races.
-func (t *transport) len() int {
-	l := 0
-	for _, conns := range t.conns {
-		l += len(conns)
+// Returns the shard for the given protocol.
+func (t *transport) shard(proto string) *connPool {
+	switch proto {
+	case "udp":
+		return t.shards[udpShard]
+	case tcpTLS:
+		return t.shards[tlsShard]
 	}
-	return l
+	return t.shards[tcpShard]
 }
 
-// Len returns the number of connections in the cache.
+// Infers which shard a connection belongs to from its type and the transport config.
+func (t *transport) shardOf(c *dns.Conn) *connPool {
+	if _, ok := c.Conn.(*net.UDPConn); ok {
+		return t.shards[udpShard]
+	}
+	if t.tlsConfig == nil {
+		return t.shards[tcpShard]
+	}
+	return t.shards[tlsShard]
+}
+
+// Len returns the number of idle connections in the cache.
 func (t *transport) Len() int {
-	t.lenc <- true
-	l := <-t.lencOut
+	l := 0
+	for _, pool := range t.shards {
+		pool.Lock()
+		l += len(pool.idle)
+		pool.Unlock()
+	}
 	return l
 }
 
-// connManagers manages the persistent connection cache for UDP and TCP.
-func (t *transport) connManager() {
+// Dial dials the address configured in transport, potentially reusing a
+// connection or creating a new one. If the maximum number of open
+// connections has been reached, Dial waits up to dialTimeout for one to be
+// returned before giving up.
+func (t *transport) Dial(proto string) (*dns.Conn, error) {
+
+	// If tls has been configured, use it.
+	if t.tlsConfig != nil {
+		proto = tcpTLS
+	}
 
-Wait:
+	pool := t.shard(proto)
+	deadline := time.Now().Add(dialTimeout)
 	for {
-		select {
-		case proto := <-t.dial:
-			// Yes O(n), shouldn't put millions in here. We walk all connection until we find the first
-			// one that is usable.
-			var i int
-			for i = 0; i < len(t.conns[proto]); i++ {
-				pc := t.conns[proto][i]
-				if time.Since(pc.used) < t.expire {
-					// Found one, remove from pool and return this conn.
-					t.conns[proto] = t.conns[proto][i+1:]
-					t.ret <- connErr{pc.c, nil}
-					continue Wait
-				}
-				// This conn has expired. Close it.
-				pc.c.Close()
-			}
+		pool.Lock()
 
-			// Not conns were found. Connect to the upstream to create one.
-			t.conns[proto] = t.conns[proto][i:]
-
-			go func() {
-				if proto != tcpTLS {
-					c, err := dns.DialTimeout(proto, t.addr, dialTimeout)
-					t.ret <- connErr{c, err}
-					return
-				}
-				c, err := dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, dialTimeout)
-				t.ret <- connErr{c, err}
-			}()
-
-		case conn := <-t.yield:
-
-			// no proto here, infer from config and conn
-			if _, ok := conn.c.Conn.(*net.UDPConn); ok {
-				t.conns["udp"] = append(t.conns["udp"], &persistConn{conn.c, time.Now()})
-				continue Wait
+		// Reuse the most recently used connection, closing any that have expired.
+		for len(pool.idle) > 0 {
+			pc := pool.idle[len(pool.idle)-1]
+			pool.idle = pool.idle[:len(pool.idle)-1]
+			if time.Since(pc.used) < t.expire {
+				pool.Unlock()
+				return pc.c, nil
 			}
+			pc.c.Close()
+			pool.open--
+		}
 
-			if t.tlsConfig == nil {
-				t.conns["tcp"] = append(t.conns["tcp"], &persistConn{conn.c, time.Now()})
-				continue Wait
+		// No idle conns were found. Connect to the upstream to create one, as
+		// long as we're not over the limit.
+		if t.maxOpen <= 0 || pool.open < t.maxOpen {
+			pool.open++
+			pool.Unlock()
+			c, err := t.dial(proto)
+			if err != nil {
+				t.release(pool)
 			}
+			return c, err
+		}
 
-			t.conns[tcpTLS] = append(t.conns[tcpTLS], &persistConn{conn.c, time.Now()})
-
+		// Otherwise wait for a connection to be yielded or released.
+		wait := pool.wait
+		pool.Unlock()
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, errPoolExhausted
+		}
+		timer := time.NewTimer(remaining)
+		select {
+		case <-wait:
+			timer.Stop()
+		case <-timer.C:
+			return nil, errPoolExhausted
 		case <-t.stop:
-			return
-
-		case <-t.lenc:
-			l := 0
-			for _, conns := range t.conns {
-				l += len(conns)
-			}
-			t.lencOut <- l
+			timer.Stop()
+			return nil, errPoolExhausted
 		}
 	}
 }
 
-// Dial dials the address configured in transport, potentially reusing a connection or creating a new one.
-func (t *transport) Dial(proto string) (*dns.Conn, error) {
+// Opens a new connection to the upstream.
+func (t *transport) dial(proto string) (*dns.Conn, error) {
+	var c *dns.Conn
+	var err error
+	if proto != tcpTLS {
+		c, err = dns.DialTimeout(proto, t.addr, dialTimeout)
+	} else {
+		c, err = dns.DialTimeoutWithTLS("tcp", t.addr, t.tlsConfig, dialTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c.TsigSecret = t.tsigSecret
+	return c, nil
+}
 
-	// If tls has been configured, use it.
-	if t.tlsConfig != nil {
-		proto = tcpTLS
+// Yield returns the connection to transport for reuse. If the pool already
+// holds the maximum number of idle connections, the connection is closed.
+func (t *transport) Yield(c *dns.Conn) {
+	pool := t.shardOf(c)
+	pool.Lock()
+	select {
+	case <-t.stop:
+		pool.Unlock()
+		c.Close()
+		t.release(pool)
+		return
+	default:
 	}
+	if len(pool.idle) >= t.maxIdle {
+		pool.Unlock()
+		c.Close()
+		t.release(pool)
+		return
+	}
+	pool.idle = append(pool.idle, &persistConn{c, time.Now()})
+	pool.notify()
+	pool.Unlock()
+}
 
-	t.dial <- proto
-	c := <-t.ret
+// Discard closes a connection that was handed out by Dial but can't be
+// reused, freeing up its slot in the pool.
+func (t *transport) Discard(c *dns.Conn) {
+	c.Close()
+	t.release(t.shardOf(c))
+}
 
-	return c.c, c.err
+// Takes an open connection slot in the given pool without waiting, for
+// connections that are managed outside of it. Returns false if the pool is
+// already at the maximum number of open connections.
+func (t *transport) reserve(pool *connPool) bool {
+	pool.Lock()
+	defer pool.Unlock()
+	if t.maxOpen > 0 && pool.open >= t.maxOpen {
+		return false
+	}
+	pool.open++
+	return true
 }
 
-// Yield returns the connection to transport for reuse.
-func (t *transport) Yield(c *dns.Conn) {
-	t.yield <- connErr{c, nil}
+// Frees up an open connection slot in the given pool.
+func (t *transport) release(pool *connPool) {
+	pool.Lock()
+	pool.open--
+	pool.notify()
+	pool.Unlock()
 }
 
-// Stop stops the transport's connection manager.
-func (t *transport) Stop() { t.stop <- true }
+// Wakes up everyone waiting on the pool. Must be called with the lock held.
+func (pool *connPool) notify() {
+	close(pool.wait)
+	pool.wait = make(chan struct{})
+}
+
+// Start starts the background reaper that closes expired idle connections.
+func (t *transport) Start() { go t.reap() }
+
+// Returns how often idle connections are checked for expiry: twice per expire
+// duration, but no more than once every minReapInterval.
+func (t *transport) reapInterval() time.Duration {
+	interval := t.expire / 2
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	return interval
+}
+
+// Periodically closes idle connections that have outlived the expire duration.
+func (t *transport) reap() {
+	ticker := time.NewTicker(t.reapInterval())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			for _, pool := range t.shards {
+				t.reapPool(pool)
+			}
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Closes the expired connections in a single pool. Since idle is ordered by
+// last use, the expired connections are always at the front.
+func (t *transport) reapPool(pool *connPool) {
+	pool.Lock()
+	defer pool.Unlock()
+	i := 0
+	for ; i < len(pool.idle); i++ {
+		if time.Since(pool.idle[i].used) < t.expire {
+			break
+		}
+		pool.idle[i].c.Close()
+		pool.idle[i] = nil
+		pool.open--
+	}
+	if i > 0 {
+		pool.idle = pool.idle[i:]
+		pool.notify()
+	}
+}
+
+// Stop stops the reaper and closes all idle connections.
+func (t *transport) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+		for _, pool := range t.shards {
+			pool.Lock()
+			for _, pc := range pool.idle {
+				pc.c.Close()
+				pool.open--
+			}
+			pool.idle = nil
+			pool.notify()
+			pool.Unlock()
+		}
+	})
+}
 
 // SetExpire sets the connection expire time in transport.
 func (t *transport) SetExpire(expire time.Duration) { t.expire = expire }
 
 // SetTLSConfig sets the TLS config in transport.
 func (t *transport) SetTLSConfig(cfg *tls.Config) { t.tlsConfig = cfg }
+
+// SetTsigSecret sets the TSIG secrets used to sign requests in transport.
+func (t *transport) SetTsigSecret(secret map[string]string) { t.tsigSecret = secret }
+
+// SetLimits sets the maximum number of idle and open connections kept per
+// protocol. A maxOpen of 0 means there is no limit on open connections.
+func (t *transport) SetLimits(maxIdle, maxOpen int) {
+	t.maxIdle = maxIdle
+	t.maxOpen = maxOpen
+}
@@ -0,0 +1,335 @@
+package edge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/miekg/dns"
+)
+
+// Starts a DNS server that answers every request with an empty reply.
+func newEchoServer() *dnstest.Server {
+	return dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+}
+
+func TestCached(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, _ := tr.Dial("udp")
+	c2, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	tr.Yield(c2)
+
+	// The most recently yielded connection is reused first.
+	c3, _ := tr.Dial("udp")
+	if c3 != c2 {
+		t.Error("Expected c2 == c3")
+	}
+	tr.Yield(c3)
+
+	// Other protocols have their own pools.
+	c4, _ := tr.Dial("tcp")
+	if c4 == c1 || c4 == c2 {
+		t.Error("Expected a new tcp connection (c4)")
+	}
+	tr.Yield(c4)
+	if l := tr.Len(); l != 3 {
+		t.Errorf("Expected 3 idle connections, got %d", l)
+	}
+}
+
+func TestMaxIdle(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetLimits(1, 0)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, _ := tr.Dial("udp")
+	c2, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	tr.Yield(c2)
+	if l := tr.Len(); l != 1 {
+		t.Errorf("Expected 1 idle connection, got %d", l)
+	}
+	if open := tr.shard("udp").open; open != 1 {
+		t.Errorf("Expected 1 open connection, got %d", open)
+	}
+}
+
+func TestMaxOpen(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetLimits(1, 1)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A second dial waits until the first connection is returned.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tr.Yield(c1)
+	}()
+	start := time.Now()
+	c2, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2 != c1 {
+		t.Error("Expected the yielded connection to be handed out again")
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Expected the second dial to wait for a free slot")
+	}
+
+	// Discarding the connection frees up its slot for a new one.
+	tr.Discard(c2)
+	c3, err := tr.Dial("udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c3 == c2 {
+		t.Error("Expected a new connection after discarding c2")
+	}
+	tr.Yield(c3)
+}
+
+func TestMaxOpenStop(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetLimits(1, 1)
+	tr.Start()
+
+	c1, _ := tr.Dial("udp")
+	defer c1.Close()
+
+	// Waiting dials give up as soon as the transport is stopped.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		tr.Stop()
+	}()
+	if _, err := tr.Dial("udp"); err != errPoolExhausted {
+		t.Errorf("Expected %v, got %v", errPoolExhausted, err)
+	}
+}
+
+func TestCleanupByTimer(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetExpire(100 * time.Millisecond)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, _ := tr.Dial("udp")
+	c2, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	time.Sleep(10 * time.Millisecond)
+	tr.Yield(c2)
+
+	time.Sleep(120 * time.Millisecond)
+	tr.reapPool(tr.shard("udp"))
+	if l := tr.Len(); l != 0 {
+		t.Errorf("Expected no idle connections, got %d", l)
+	}
+	if open := tr.shard("udp").open; open != 0 {
+		t.Errorf("Expected no open connections, got %d", open)
+	}
+}
+
+func TestReapInterval(t *testing.T) {
+	tests := []struct {
+		expire   time.Duration
+		interval time.Duration
+	}{
+		{0, minReapInterval},
+		{100 * time.Millisecond, minReapInterval},
+		{2 * time.Second, time.Second},
+		{10 * time.Second, 5 * time.Second},
+	}
+	for _, test := range tests {
+		tr := newTransport("127.0.0.1:53", nil /* no TLS */)
+		tr.SetExpire(test.expire)
+		if interval := tr.reapInterval(); interval != test.interval {
+			t.Errorf("Expected an interval of %s for expire %s, got %s", test.interval, test.expire, interval)
+		}
+	}
+}
+
+func TestCleanupByReaper(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetExpire(100 * time.Millisecond)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, _ := tr.Dial("udp")
+	tr.Yield(c1)
+
+	// The connection has expired, but the reaper doesn't run before its
+	// minimum interval is up.
+	time.Sleep(minReapInterval / 2)
+	if l := tr.Len(); l != 1 {
+		t.Errorf("Expected 1 idle connection before the reaper runs, got %d", l)
+	}
+
+	// Once it has, the connection is gone.
+	time.Sleep(minReapInterval)
+	if l := tr.Len(); l != 0 {
+		t.Errorf("Expected no idle connections after the reaper ran, got %d", l)
+	}
+	pool := tr.shard("udp")
+	pool.Lock()
+	open := pool.open
+	pool.Unlock()
+	if open != 0 {
+		t.Errorf("Expected no open connections, got %d", open)
+	}
+}
+
+func TestReapKeepsFresh(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetExpire(100 * time.Millisecond)
+	tr.Start()
+	defer tr.Stop()
+
+	c1, _ := tr.Dial("udp")
+	c2, _ := tr.Dial("udp")
+	tr.Yield(c1)
+	time.Sleep(120 * time.Millisecond)
+	tr.Yield(c2)
+
+	// Only the expired connection is closed.
+	tr.reapPool(tr.shard("udp"))
+	if l := tr.Len(); l != 1 {
+		t.Errorf("Expected 1 idle connection, got %d", l)
+	}
+	c3, _ := tr.Dial("udp")
+	if c3 != c2 {
+		t.Error("Expected c2 == c3")
+	}
+	tr.Yield(c3)
+}
+
+// chanTransport is the channel-driven connection manager the pools replaced,
+// kept to compare their throughput.
+type chanTransport struct {
+	conns  map[string][]*persistConn
+	expire time.Duration
+	addr   string
+	dial   chan string
+	yield  chan *dns.Conn
+	ret    chan *dns.Conn
+	stop   chan bool
+}
+
+func newChanTransport(addr string) *chanTransport {
+	t := &chanTransport{
+		conns:  make(map[string][]*persistConn),
+		expire: defaultExpire,
+		addr:   addr,
+		dial:   make(chan string),
+		yield:  make(chan *dns.Conn),
+		ret:    make(chan *dns.Conn),
+		stop:   make(chan bool),
+	}
+	go t.connManager()
+	return t
+}
+
+func (t *chanTransport) connManager() {
+Wait:
+	for {
+		select {
+		case proto := <-t.dial:
+			var i int
+			for i = 0; i < len(t.conns[proto]); i++ {
+				pc := t.conns[proto][i]
+				if time.Since(pc.used) < t.expire {
+					t.conns[proto] = t.conns[proto][i+1:]
+					t.ret <- pc.c
+					continue Wait
+				}
+				pc.c.Close()
+			}
+			t.conns[proto] = t.conns[proto][i:]
+			go func() {
+				c, _ := dns.DialTimeout(proto, t.addr, dialTimeout)
+				t.ret <- c
+			}()
+		case c := <-t.yield:
+			if _, ok := c.Conn.(*net.UDPConn); ok {
+				t.conns["udp"] = append(t.conns["udp"], &persistConn{c, time.Now()})
+				continue Wait
+			}
+			t.conns["tcp"] = append(t.conns["tcp"], &persistConn{c, time.Now()})
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+func (t *chanTransport) Dial(proto string) (*dns.Conn, error) {
+	t.dial <- proto
+	return <-t.ret, nil
+}
+
+func (t *chanTransport) Yield(c *dns.Conn) { t.yield <- c }
+
+func (t *chanTransport) Stop() { t.stop <- true }
+
+func BenchmarkDialYield(b *testing.B) {
+	s := newEchoServer()
+	defer s.Close()
+
+	b.Run("pool", func(b *testing.B) {
+		tr := newTransport(s.Addr, nil /* no TLS */)
+		tr.Start()
+		defer tr.Stop()
+		benchmarkDialYield(b, tr.Dial, tr.Yield)
+	})
+	b.Run("connManager", func(b *testing.B) {
+		tr := newChanTransport(s.Addr)
+		defer tr.Stop()
+		benchmarkDialYield(b, tr.Dial, tr.Yield)
+	})
+}
+
+func benchmarkDialYield(b *testing.B, dial func(string) (*dns.Conn, error), yield func(*dns.Conn)) {
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			c, err := dial("udp")
+			if err != nil || c == nil {
+				b.Fatal("dial failed:", err)
+			}
+			yield(c)
+		}
+	})
+}
@@ -0,0 +1,360 @@
+package edge
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+const (
+	defaultPipelineConns    = 2
+	defaultPipelineInFlight = 128
+)
+
+// pipeline multiplexes queries to a single upstream over a small number of
+// persistent TCP or TLS connections, as described in RFC 7766 section 6.2.1.
+// Queries are written as soon as they arrive and replies are matched back to
+// their queries by message ID, so they may arrive in any order.
+type pipeline struct {
+	sync.Mutex
+	conns       []*pipeConn
+	maxConns    int
+	maxInFlight int
+	transport   *transport
+
+	// The number of connections being dialed, which count towards maxConns.
+	dialing int
+
+	// How long to wait for room on a connection once all of them are at the
+	// in-flight limit.
+	wait time.Duration
+
+	// Closed and replaced whenever a dial or a query finishes while callers
+	// are waiting for room on a connection, to wake them up.
+	changed chan struct{}
+	waiting int
+}
+
+// pipeConn is a single stream connection shared by many in-flight queries.
+type pipeConn struct {
+	conn *dns.Conn
+
+	// Frees up the slot of the connection in its transport's pool.
+	release func()
+
+	// Called whenever a query on the connection finishes.
+	finished func()
+
+	// Serializes writes to the connection.
+	wmu sync.Mutex
+
+	// Guards everything below.
+	mu      sync.Mutex
+	pending map[uint16]*pendingQuery
+	nextID  uint16
+	closed  bool
+
+	// Closed when the read loop exits.
+	done chan struct{}
+}
+
+// pendingQuery is a query waiting for its reply.
+type pendingQuery struct {
+	id    uint16
+	reply chan *dns.Msg
+}
+
+// Creates a new pipeline that dials connections through the given transport.
+func newPipeline(t *transport, maxConns, maxInFlight int) *pipeline {
+	return &pipeline{
+		maxConns:    maxConns,
+		maxInFlight: maxInFlight,
+		transport:   t,
+		wait:        dialTimeout,
+		changed:     make(chan struct{}),
+	}
+}
+
+// Exchange sends a query over one of the pipelined connections and waits for
+// the matching reply. The returned message carries the original query ID.
+func (pl *pipeline) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	pc, pq, err := pl.get()
+	if err != nil {
+		return nil, err
+	}
+	return pc.exchange(ctx, m, pq)
+}
+
+// Registers a query on the least loaded connection with room for it, opening
+// a new connection if all existing connections are at the in-flight limit and
+// more connections are allowed. Otherwise it waits for a query to finish or a
+// dial to complete, and fails with errPipelineFull if none does in time.
+// Pipelined connections count towards the open connection limit of the
+// transport, and are dialed without holding the lock so a slow handshake
+// doesn't hold up queries that can use the existing connections.
+func (pl *pipeline) get() (*pipeConn, *pendingQuery, error) {
+	proto := "tcp"
+	if pl.transport.tlsConfig != nil {
+		proto = tcpTLS
+	}
+	pool := pl.transport.shard(proto)
+	deadline := time.Now().Add(pl.wait)
+	for {
+		pl.Lock()
+
+		// Drop connections that have been closed.
+		live := pl.conns[:0]
+		for _, pc := range pl.conns {
+			if !pc.isClosed() {
+				live = append(live, pc)
+			}
+		}
+		pl.conns = live
+
+		var best *pipeConn
+		bestLoad := 0
+		for _, pc := range pl.conns {
+			if load := pc.load(); best == nil || load < bestLoad {
+				best, bestLoad = pc, load
+			}
+		}
+		if best != nil && bestLoad < pl.maxInFlight {
+			pq, err := best.register()
+			pl.Unlock()
+			if err != nil {
+				// Closed in the meantime, so it's dropped on the next pass.
+				continue
+			}
+			return best, pq, nil
+		}
+
+		// Open another connection if allowed, reserving its slot in the
+		// transport's pool first.
+		if len(pl.conns)+pl.dialing < pl.maxConns && pl.transport.reserve(pool) {
+			pl.dialing++
+			pl.Unlock()
+
+			conn, err := pl.transport.dial(proto)
+
+			pl.Lock()
+			pl.dialing--
+			pl.wake()
+			if err != nil {
+				pl.Unlock()
+				pl.transport.release(pool)
+				return nil, nil, err
+			}
+			pc := newPipeConn(conn, pl.transport.expire, func() { pl.transport.release(pool) }, pl.notify)
+			pl.conns = append(pl.conns, pc)
+			pq, err := pc.register()
+			pl.Unlock()
+			if err != nil {
+				continue
+			}
+			return pc, pq, nil
+		}
+
+		// Without any connection to wait for, the transport is at its limit.
+		if len(pl.conns) == 0 && pl.dialing == 0 {
+			pl.Unlock()
+			return nil, nil, errPoolExhausted
+		}
+
+		// Wait for a query to finish or a dial to complete.
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			pl.Unlock()
+			return nil, nil, errPipelineFull
+		}
+		wait := pl.changed
+		pl.waiting++
+		pl.Unlock()
+		timer := time.NewTimer(remaining)
+		select {
+		case <-wait:
+		case <-timer.C:
+		}
+		timer.Stop()
+		pl.Lock()
+		pl.waiting--
+		pl.Unlock()
+	}
+}
+
+// Wakes up callers waiting for room on a connection. Must be called with the
+// lock held.
+func (pl *pipeline) wake() {
+	if pl.waiting == 0 {
+		return
+	}
+	close(pl.changed)
+	pl.changed = make(chan struct{})
+}
+
+// Wakes up callers waiting for room on a connection, once a query finished.
+func (pl *pipeline) notify() {
+	pl.Lock()
+	pl.wake()
+	pl.Unlock()
+}
+
+// Closes all pipelined connections.
+func (pl *pipeline) close() {
+	pl.Lock()
+	defer pl.Unlock()
+	for _, pc := range pl.conns {
+		pc.close()
+	}
+	pl.conns = nil
+}
+
+// Wraps a connection and starts reading replies off of it. The release
+// function is called once the connection is closed, and finished whenever a
+// query on it finishes.
+func newPipeConn(conn *dns.Conn, expire time.Duration, release, finished func()) *pipeConn {
+	pc := &pipeConn{
+		conn:     conn,
+		release:  release,
+		finished: finished,
+		pending:  make(map[uint16]*pendingQuery),
+		nextID:   dns.Id(),
+		done:     make(chan struct{}),
+	}
+	go pc.readLoop(expire)
+	return pc
+}
+
+// Returns the number of in-flight queries on this connection.
+func (pc *pipeConn) load() int {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return len(pc.pending)
+}
+
+// Returns true if the connection can no longer be used.
+func (pc *pipeConn) isClosed() bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	return pc.closed
+}
+
+// Sends a single query, registered under an ID that is unique on this
+// connection, and waits for its reply.
+func (pc *pipeConn) exchange(ctx context.Context, m *dns.Msg, pq *pendingQuery) (*dns.Msg, error) {
+	defer pc.unregister(pq.id)
+
+	// Send a copy of the query with the connection-local ID, so the caller's
+	// message is left untouched.
+	out := m.Copy()
+	out.Id = pq.id
+
+	// A signed query is sent with the ID recorded in its TSIG record, which
+	// the signature covers, so that has to be the connection-local ID too.
+	if t := out.IsTsig(); t != nil {
+		t.OrigId = pq.id
+	}
+	pc.wmu.Lock()
+	pc.conn.SetWriteDeadline(time.Now().Add(timeout))
+	err := pc.conn.WriteMsg(out)
+	pc.wmu.Unlock()
+	if err != nil {
+		pc.close()
+		return nil, err
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case ret := <-pq.reply:
+		ret.Id = m.Id
+		return ret, nil
+	case <-pc.done:
+		return nil, io.EOF
+	case <-timer.C:
+		return nil, errPipelineTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Allocates a free message ID for a new query.
+func (pc *pipeConn) register() (*pendingQuery, error) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return nil, io.EOF
+	}
+	if len(pc.pending) >= 0xFFFF {
+		return nil, errPipelineFull
+	}
+	for {
+		pc.nextID++
+		if _, taken := pc.pending[pc.nextID]; !taken {
+			break
+		}
+	}
+	pq := &pendingQuery{id: pc.nextID, reply: make(chan *dns.Msg, 1)}
+	pc.pending[pq.id] = pq
+	return pq, nil
+}
+
+// Forgets about a query, whether or not it was answered.
+func (pc *pipeConn) unregister(id uint16) {
+	pc.mu.Lock()
+	delete(pc.pending, id)
+	pc.mu.Unlock()
+	if pc.finished != nil {
+		pc.finished()
+	}
+}
+
+// Reads replies off the connection and hands them to the matching queries.
+// The connection is closed once it has been idle for the expire duration, if
+// one is set, or on the first read error.
+func (pc *pipeConn) readLoop(expire time.Duration) {
+	defer close(pc.done)
+	defer pc.close()
+	for {
+		if expire > 0 {
+			pc.conn.SetReadDeadline(time.Now().Add(expire))
+		}
+		ret, err := pc.conn.ReadMsg()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() && pc.load() > 0 {
+				continue
+			}
+			return
+		}
+		pc.mu.Lock()
+		pq, found := pc.pending[ret.Id]
+		if found {
+			delete(pc.pending, ret.Id)
+		}
+		pc.mu.Unlock()
+		if !found {
+			log.Debugf("dropping pipelined reply with unknown id %d", ret.Id)
+			continue
+		}
+		pq.reply <- ret
+	}
+}
+
+// Closes the underlying connection. Queries on a closed connection fail with
+// io.EOF, just like a remote close, so callers retry them. Any queries still waiting are woken up
+// once the read loop exits.
+func (pc *pipeConn) close() {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	if pc.closed {
+		return
+	}
+	pc.closed = true
+	pc.conn.Close()
+	if pc.release != nil {
+		pc.release()
+	}
+}
@@ -0,0 +1,208 @@
+package edge
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestPipelineExchange(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.Start()
+	defer tr.Stop()
+	pl := newPipeline(tr, defaultPipelineConns, defaultPipelineInFlight)
+	defer pl.close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	ret, err := pl.Exchange(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Id != m.Id {
+		t.Errorf("Expected reply ID %d, got %d", m.Id, ret.Id)
+	}
+}
+
+func TestPipelineMaxOpen(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetLimits(1, 1)
+	tr.Start()
+	defer tr.Stop()
+	pl := newPipeline(tr, 2, 1)
+	pl.wait = 100 * time.Millisecond
+
+	// Fill up the first connection, so another one would be opened if the
+	// transport allowed it.
+	pc1, pq1, err := pl.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Since it doesn't, the next query waits for room and gives up.
+	if _, _, err := pl.get(); err != errPipelineFull {
+		t.Errorf("Expected %v, got %v", errPipelineFull, err)
+	}
+	if open := tr.shard("tcp").open; open != 1 {
+		t.Errorf("Expected 1 open connection, got %d", open)
+	}
+
+	// Until the first query finishes.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pc1.unregister(pq1.id)
+	}()
+	pc2, _, err := pl.get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pc2 != pc1 {
+		t.Error("Expected the freed up connection to be used")
+	}
+
+	// Closing the pipeline frees up its slots.
+	pl.close()
+	if open := tr.shard("tcp").open; open != 0 {
+		t.Errorf("Expected no open connections, got %d", open)
+	}
+}
+
+func TestPipelineInFlight(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.Start()
+	defer tr.Stop()
+	pl := newPipeline(tr, 2, 2)
+	defer pl.close()
+
+	// Each connection carries up to 2 queries, after which another one is
+	// opened.
+	seen := make(map[*pipeConn]int)
+	for i := 0; i < 4; i++ {
+		pc, _, err := pl.get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[pc]++
+	}
+	if len(seen) != 2 {
+		t.Fatalf("Expected 2 connections, got %d", len(seen))
+	}
+	for pc, n := range seen {
+		if n != 2 || pc.load() != 2 {
+			t.Errorf("Expected 2 queries per connection, got %d", pc.load())
+		}
+	}
+}
+
+// Starts a TCP server that reads n queries off each connection before
+// answering all of them in reverse order.
+func newReversingServer(t *testing.T, n int) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				conn := &dns.Conn{Conn: c}
+				var queries []*dns.Msg
+				for len(queries) < n {
+					m, err := conn.ReadMsg()
+					if err != nil {
+						return
+					}
+					queries = append(queries, m)
+				}
+				for i := len(queries) - 1; i >= 0; i-- {
+					ret := new(dns.Msg)
+					ret.SetReply(queries[i])
+					conn.WriteMsg(ret)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestPipelineOutOfOrder(t *testing.T) {
+	const n = 8
+	addr, stop := newReversingServer(t, n)
+	defer stop()
+
+	tr := newTransport(addr, nil /* no TLS */)
+	tr.Start()
+	defer tr.Stop()
+	pl := newPipeline(tr, 1, n)
+	defer pl.close()
+
+	// All queries share a single connection, and each gets the reply to its
+	// own question even though they arrive in reverse order.
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m := new(dns.Msg)
+			m.SetQuestion(fmt.Sprintf("q%d.example.org.", i), dns.TypeA)
+			ret, err := pl.Exchange(context.Background(), m)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if ret.Id != m.Id || ret.Question[0].Name != m.Question[0].Name {
+				errs <- fmt.Errorf("query %d for %s got reply %d for %s", m.Id, m.Question[0].Name, ret.Id, ret.Question[0].Name)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func TestPipelineNoExpire(t *testing.T) {
+	s := newEchoServer()
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetExpire(0)
+	tr.Start()
+	defer tr.Stop()
+	pl := newPipeline(tr, 1, 1)
+	defer pl.close()
+
+	// Without an expire duration, replies are still read, and the
+	// connection is kept open once it's idle.
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	if _, err := pl.Exchange(context.Background(), m); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	pl.Lock()
+	defer pl.Unlock()
+	if len(pl.conns) != 1 || pl.conns[0].isClosed() {
+		t.Error("Expected the idle connection to stay open")
+	}
+}
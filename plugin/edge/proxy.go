@@ -28,10 +28,15 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/coredns/coredns/plugin/pkg/up"
+	"github.com/optikon/coredns/plugin/edge/pb"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"github.com/miekg/dns"
 )
@@ -41,9 +46,10 @@ const (
 	dialTimeout         = 4 * time.Second
 	timeout             = 2 * time.Second
 	healthCheckDuration = 500 * time.Millisecond
-	servicePushDuration = 10 * time.Second
+	pushTimeout         = 10 * time.Second
 	pushPort            = "8053"
 	pushProtocol        = "http"
+	pushTLSProtocol     = "https"
 )
 
 // Proxy defines an upstream host.
@@ -55,13 +61,26 @@ type Proxy struct {
 	expire    time.Duration
 	transport *transport
 
+	// Query pipelining over stream connections, nil if disabled.
+	pipeline *pipeline
+
+	// The key used to sign requests forwarded to this proxy, nil if unsigned.
+	tsigKey *tsigKey
+
 	// Health checking.
 	probe *up.Probe
 	fails uint32
 
-	// Service push connection.
-	pushAddr string
-	pushChan chan struct{}
+	// Service push connection, along with the batches waiting to be pushed.
+	pushAddr      string
+	pushTransport http.RoundTripper
+	pushTLS       *tls.Config
+	pushKey       *hmacKey
+	outbox        *outbox
+
+	// The gRPC session used for pushing instead while it's open, nil if disabled.
+	grpcAddr string
+	session  *session
 }
 
 // NewProxy returns a new proxy.
@@ -80,12 +99,14 @@ func NewProxy(addr string, tlsConfig *tls.Config) *Proxy {
 		}
 	}
 	p := &Proxy{
-		addr:      addr,
-		fails:     0,
-		probe:     up.New(),
-		transport: newTransport(addr, tlsConfig),
-		pushAddr:  newPushAddr(host),
-		pushChan:  make(chan struct{}),
+		addr:          addr,
+		fails:         0,
+		probe:         up.New(),
+		transport:     newTransport(addr, tlsConfig),
+		pushAddr:      newPushAddr(pushProtocol, host),
+		pushTransport: http.DefaultTransport,
+		grpcAddr:      net.JoinHostPort(host, grpcPort),
+		outbox:        newOutbox("", addr, defaultOutboxSize),
 	}
 	p.client = dnsClient(tlsConfig)
 	return p
@@ -116,6 +137,74 @@ func (p *Proxy) Dial(proto string) (*dns.Conn, error) { return p.transport.Dial(
 // Yield returns the connection to the pool.
 func (p *Proxy) Yield(c *dns.Conn) { p.transport.Yield(c) }
 
+// Discard closes a connection that can't be returned to the pool.
+func (p *Proxy) Discard(c *dns.Conn) { p.transport.Discard(c) }
+
+// EnablePipelining multiplexes TCP and TLS queries over at most maxConns
+// connections, each carrying up to maxInFlight queries at once.
+func (p *Proxy) EnablePipelining(maxConns, maxInFlight int) {
+	p.pipeline = newPipeline(p.transport, maxConns, maxInFlight)
+}
+
+// SetTsigKey signs all requests forwarded to this proxy with the given key.
+func (p *Proxy) SetTsigKey(key *tsigKey) {
+	p.tsigKey = key
+	p.transport.SetTsigSecret(map[string]string{key.name: key.secret})
+}
+
+// SetOutbox keeps the batches waiting to be pushed to this proxy in the given
+// directory, or only in memory if it's empty, holding at most max of them.
+func (p *Proxy) SetOutbox(dir string, max int) { p.outbox = newOutbox(dir, p.addr, max) }
+
+// EnableSession pushes to this proxy over a gRPC session while one is open,
+// registering with the given message whenever it's opened.
+func (p *Proxy) EnableSession(register *pb.Register, opts []grpc.DialOption, onSnapshot func(ServiceTableSnapshot), onResync func(ServiceTableSync)) {
+	p.session = newSession(p.grpcAddr, register, opts, onSnapshot, onResync)
+}
+
+// Returns the options sessions with this proxy are dialed with, which carry
+// the same credentials as HTTP pushes.
+func (p *Proxy) sessionDialOptions() []grpc.DialOption {
+	var opts []grpc.DialOption
+	if p.pushTLS != nil {
+		opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(p.pushTLS)))
+	} else {
+		opts = append(opts, grpc.WithInsecure())
+	}
+	if p.pushKey != nil {
+		opts = append(opts, grpc.WithPerRPCCredentials(hmacCredentials{key: p.pushKey, secure: p.pushTLS != nil}))
+	}
+	return opts
+}
+
+// SetPushTLS pushes to this proxy over TLS, presenting the client
+// certificate in the given config.
+func (p *Proxy) SetPushTLS(cfg *tls.Config) {
+	u, err := url.Parse(p.pushAddr)
+	if err != nil {
+		return
+	}
+	p.pushAddr = newPushAddr(pushTLSProtocol, u.Hostname())
+	p.pushTLS = cfg
+	p.pushTransport = &http.Transport{TLSClientConfig: cfg}
+}
+
+// SetPushURL pushes to this proxy at the given URL instead of the one derived
+// from its address, and opens gRPC sessions with grpcAddr if it's not empty.
+// Any path in the URL is prefixed to the paths pushes are made to.
+func (p *Proxy) SetPushURL(pushURL, grpcAddr string) {
+	p.pushAddr = strings.TrimSuffix(pushURL, "/")
+	if grpcAddr != "" {
+		p.grpcAddr = grpcAddr
+	}
+}
+
+// SetPushKey signs every push to this proxy with the given HMAC key.
+func (p *Proxy) SetPushKey(key *hmacKey) { p.pushKey = key }
+
+// SetPoolLimits sets the idle and open connection limits in the lower p.transport.
+func (p *Proxy) SetPoolLimits(maxIdle, maxOpen int) { p.transport.SetLimits(maxIdle, maxOpen) }
+
 // Healthcheck kicks off a round of health checks for this proxy.
 func (p *Proxy) Healthcheck() { p.probe.Do(p.Check) }
 
@@ -130,58 +219,132 @@ func (p *Proxy) Down(maxUpstreamFails uint32) bool {
 
 // Stops the health checking and service pushing goroutines.
 func (p *Proxy) close() {
-	close(p.pushChan)
+	p.outbox.close()
+	if p.session != nil {
+		p.session.close()
+	}
 	p.probe.Stop()
+	if p.pipeline != nil {
+		p.pipeline.close()
+	}
 	p.transport.Stop()
 }
 
-// Starts the proxy's healthchecking.
+// Starts the proxy's healthchecking, connection reaping, gRPC session and
+// service pushing.
 func (p *Proxy) start(healthCheckDuration time.Duration) {
 	p.probe.Start(healthCheckDuration)
+	p.transport.Start()
+	if p.session != nil {
+		p.session.start()
+	}
+	p.outbox.start(p.deliverBatch)
 }
 
 // Creates the network address for pushing service updates.
-func newPushAddr(host string) string {
-	return fmt.Sprintf("%s://%s:%s", pushProtocol, host, pushPort)
+func newPushAddr(scheme, host string) string {
+	return fmt.Sprintf("%s://%s", scheme, net.JoinHostPort(host, pushPort))
+}
+
+// Queues a batch of service events to be pushed upstream.
+func (p *Proxy) pushServiceBatch(batch ServiceTableBatch) {
+	p.outbox.Enqueue(batch)
 }
 
-// Pushes service events upstream.
-func (p *Proxy) pushServiceEvent(meta Site, event ServiceEvent) error {
-	update := ServiceTableUpdate{
-		Meta:  meta,
-		Event: event,
+// Delivers a batch over the gRPC session while it's open, falling back to HTTP.
+func (p *Proxy) deliverBatch(batch ServiceTableBatch) error {
+	if p.session.Up() {
+		err := p.session.SendBatch(batch)
+		if err == nil {
+			return nil
+		}
+		log.Warningf("unable to push batch over session with upstream %s, falling back to HTTP: %v", p.addr, err)
+	}
+	return p.postJSON(batchPath, batch)
+}
+
+// Sends a heartbeat over the gRPC session while it's open, falling back to HTTP.
+func (p *Proxy) sendHeartbeat(hb Heartbeat) error {
+	if p.session.Up() && p.session.SendHeartbeat(hb) == nil {
+		return nil
+	}
+	return p.postJSON(heartbeatPath, hb)
+}
+
+// Sends a sync over the gRPC session while it's open, falling back to HTTP.
+// Returns errSyncNeedsServices if the upstream asks for the full set of
+// services over HTTP.
+func (p *Proxy) sendSync(sync ServiceTableSync) error {
+	if p.session.Up() && p.session.SendSync(sync) == nil {
+		return nil
+	}
+	err := p.postJSON(syncPath, sync)
+	if se, ok := err.(statusError); ok && se.status == http.StatusConflict {
+		return errSyncNeedsServices
 	}
-	jsn, err := json.Marshal(update)
+	return err
+}
+
+// Sends a single JSON request to the given path on the upstream's push
+// endpoint, without retrying.
+func (p *Proxy) postJSON(path string, v interface{}) error {
+	jsn, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", p.pushAddr, bytes.NewBuffer(jsn))
+	req, err := p.newPushRequest(http.MethodPost, path, jsn)
 	if err != nil {
 		return err
 	}
+	client := &http.Client{Timeout: pushTimeout, Transport: p.pushTransport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return rejectedError{url: p.pushAddr + path, status: resp.StatusCode}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return statusError{url: p.pushAddr + path, status: resp.StatusCode}
+	}
+	return nil
+}
+
+// rejectedError is returned when an upstream refuses to accept a push from
+// me at all, so sending it again won't help.
+type rejectedError struct {
+	url    string
+	status int
+}
+
+func (e rejectedError) Error() string {
+	return fmt.Sprintf("upstream %s rejected push with %d", e.url, e.status)
+}
+
+// statusError is returned when an upstream fails a push with any other
+// status, which may succeed if it's sent again.
+type statusError struct {
+	url    string
+	status int
+}
+
+func (e statusError) Error() string {
+	return fmt.Sprintf("upstream %s responded with %d", e.url, e.status)
+}
+
+// Creates a request to the given path on the upstream's push endpoint,
+// signed if an HMAC key is set.
+func (p *Proxy) newPushRequest(method, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequest(method, p.pushAddr+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	ticker := time.NewTicker(servicePushDuration)
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				resp, err := client.Do(req)
-				if err != nil {
-					log.Errorf("received error while making upstream push request: %v (trying again)", err)
-					continue
-				}
-				if resp.StatusCode != 200 {
-					log.Errorf("received a not-OK response from upstream: %d", resp.StatusCode)
-				}
-				resp.Body.Close()
-				ticker.Stop()
-				return
-			case <-p.pushChan:
-				ticker.Stop()
-				return
-			}
+	if p.pushKey != nil {
+		for header, val := range p.pushKey.sign(method, path, body) {
+			req.Header.Set(header, val)
 		}
-	}()
-	return nil
+	}
+	return req, nil
 }
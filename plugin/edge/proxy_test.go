@@ -0,0 +1,48 @@
+package edge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPostJSONStatus(t *testing.T) {
+	var status int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(atomic.LoadInt32(&status)))
+	}))
+	defer s.Close()
+
+	p := NewProxy("10.0.0.2:53", nil /* no TLS */)
+	p.SetPushURL(s.URL, "")
+
+	// Only a refusal to accept pushes from me at all is permanent.
+	tests := []struct {
+		status   int32
+		rejected bool
+	}{
+		{http.StatusUnauthorized, true},
+		{http.StatusForbidden, true},
+		{http.StatusBadRequest, false},
+		{http.StatusTooManyRequests, false},
+		{http.StatusServiceUnavailable, false},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&status, test.status)
+		err := p.postJSON(batchPath, ServiceTableBatch{})
+		if err == nil {
+			t.Errorf("%d: expected an error", test.status)
+			continue
+		}
+		if _, rejected := err.(rejectedError); rejected != test.rejected {
+			t.Errorf("%d: expected rejected %v, got %v", test.status, test.rejected, err)
+		}
+	}
+
+	// A conflict on a sync asks for the full set of services.
+	atomic.StoreInt32(&status, http.StatusConflict)
+	if err := p.sendSync(ServiceTableSync{}); err != errSyncNeedsServices {
+		t.Errorf("Expected %v, got %v", errSyncNeedsServices, err)
+	}
+}
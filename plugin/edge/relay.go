@@ -0,0 +1,73 @@
+package edge
+
+// Returns the path to relay an update that has travelled the given path
+// further upstream with, and false if it shouldn't be relayed: because I
+// have no upstreams, because it already passed through me, or because it
+// has travelled too far.
+func (e *Edge) relayPath(path []string) ([]string, bool) {
+	if len(e.proxies) == 0 || len(path) >= e.maxHops {
+		return nil, false
+	}
+	for _, id := range path {
+		if id == e.siteID {
+			return nil, false
+		}
+	}
+	return append(append([]string(nil), path...), e.siteID), true
+}
+
+// Relays a batch of events received from a downstream site to my upstreams,
+// so every tier above me sees the sites beneath me.
+func (e *Edge) relayBatch(batch ServiceTableBatch) {
+	if len(batch.Events) == 0 {
+		return
+	}
+	path, ok := e.relayPath(batch.Path)
+	if !ok {
+		return
+	}
+	batch.Path = path
+	for _, p := range e.proxies {
+		p.pushServiceBatch(batch)
+	}
+}
+
+// Relays a heartbeat received from a downstream site to my upstreams. Like
+// syncs, heartbeats are sent again periodically, so they're sent once without
+// queueing.
+func (e *Edge) relayHeartbeat(hb Heartbeat) {
+	path, ok := e.relayPath(hb.Path)
+	if !ok {
+		return
+	}
+	hb.Path = path
+	for _, p := range e.proxies {
+		go func(p *Proxy) {
+			if err := p.sendHeartbeat(hb); err != nil {
+				log.Errorf("unable to relay heartbeat of site %s to upstream %s: %v", hb.Meta.IP, p.addr, err)
+			}
+		}(p)
+	}
+}
+
+// Relays a sync received from a downstream site to my upstreams. Syncs are
+// sent again periodically, so they're sent once without queueing. Only the
+// digest of the site's services in my table is relayed, and if an upstream
+// asks for the services they're taken from my table too.
+func (e *Edge) relaySync(sync ServiceTableSync) {
+	path, ok := e.relayPath(sync.Path)
+	if !ok {
+		return
+	}
+	sync.Path = path
+	sync.Digest = digestServices(e.table.ServicesOf(sync.Meta))
+	sync.Services = nil
+	sync.Full = false
+	for _, p := range e.proxies {
+		go func(p *Proxy) {
+			if err := e.sendSync(p, sync); err != nil {
+				log.Errorf("unable to relay sync of site %s to upstream %s: %v", sync.Meta.IP, p.addr, err)
+			}
+		}(p)
+	}
+}
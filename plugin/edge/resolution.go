@@ -0,0 +1,263 @@
+package edge
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// The current version of the resolution option wire format.
+	resolutionOptionVersion = 1
+
+	// The size of the header of a resolution option: the version, the index
+	// of the chosen site and the number of candidates.
+	resolutionHeaderLen = 1 + 2 + 2
+
+	// The size of the fixed part of each candidate: the latitude, longitude,
+	// altitude and horizontal precision.
+	resolutionSiteLen = 4 + 4 + 4 + 4
+
+	// The size of the code and length that precede the data of an EDNS0 option.
+	optionHeaderLen = 2 + 2
+)
+
+// resolution describes how an upstream edge site resolved a service for a
+// downstream one: the sites that could have been the closest, and which of
+// them it picked. When sent downstream, it also carries as many of the other
+// sites the upstream knew to be running the service as fit in the reply,
+// nearest first. Downstream sites use this to answer later requests for the
+// same service themselves.
+type resolution struct {
+	Chosen     int
+	Candidates []Site
+}
+
+// Encodes the resolution in the version 1 wire format: the version, the index
+// of the chosen candidate, the number of candidates, and then for each
+// candidate its length-prefixed ID, its length-prefixed IP address, its
+// latitude and longitude in units of 1e-7 degrees, its altitude in
+// centimeters and its horizontal precision in meters.
+func (res resolution) pack() []byte {
+	candidates := res.Candidates
+	if len(candidates) > math.MaxUint16 {
+		candidates = candidates[:math.MaxUint16]
+	}
+	b := make([]byte, resolutionHeaderLen, resolutionHeaderLen+len(candidates)*(resolutionSiteLen+32))
+	b[0] = resolutionOptionVersion
+	binary.BigEndian.PutUint16(b[1:], uint16(res.Chosen))
+	binary.BigEndian.PutUint16(b[3:], uint16(len(candidates)))
+	for _, site := range candidates {
+		id := site.ID
+		if len(id) > math.MaxUint8 {
+			id = id[:math.MaxUint8]
+		}
+		b = append(b, uint8(len(id)))
+		b = append(b, id...)
+		b = append(b, uint8(len(site.IP)))
+		b = append(b, site.IP...)
+		var fixed [resolutionSiteLen]byte
+		binary.BigEndian.PutUint32(fixed[0:], uint32(int32(math.Round(site.GeoCoords.Lat/locationDegreeUnit))))
+		binary.BigEndian.PutUint32(fixed[4:], uint32(int32(math.Round(site.GeoCoords.Lon/locationDegreeUnit))))
+		binary.BigEndian.PutUint32(fixed[8:], uint32(int32(math.Round(site.GeoCoords.Altitude*100))))
+		binary.BigEndian.PutUint32(fixed[12:], packMeters(site.GeoCoords.Precision))
+		b = append(b, fixed[:]...)
+	}
+	return b
+}
+
+// Returns the number of bytes a candidate takes up in the wire format.
+func packedSiteLen(site Site) int {
+	idLen := len(site.ID)
+	if idLen > math.MaxUint8 {
+		idLen = math.MaxUint8
+	}
+	return 1 + idLen + 1 + len(site.IP) + resolutionSiteLen
+}
+
+// Returns the resolution with every other site in the index added to its
+// candidates, after the ones that were already there, nearest to the given
+// location first.
+func (res resolution) including(index *siteIndex, from Location) resolution {
+	seen := make(map[uint64]bool, len(res.Candidates))
+	for _, site := range res.Candidates {
+		seen[hashOf(site)] = true
+	}
+	type other struct {
+		site Site
+		dist float64
+	}
+	others := make([]other, 0, len(index.sites))
+	for hash, val := range index.sites {
+		if !seen[hash] {
+			site := val.(Site)
+			others = append(others, other{site, from.Distance(site.GeoCoords)})
+		}
+	}
+	sort.Slice(others, func(i, j int) bool { return others[i].dist < others[j].dist })
+	candidates := append(make([]Site, 0, len(res.Candidates)+len(others)), res.Candidates...)
+	for _, o := range others {
+		candidates = append(candidates, o.site)
+	}
+	return resolution{Chosen: res.Chosen, Candidates: candidates}
+}
+
+// Returns the resolution cut down to the leading candidates that fit in an
+// option of at most the given number of bytes. The chosen site is always
+// kept, on its own if the candidates before it don't fit.
+func (res resolution) within(room int) resolution {
+	if room > math.MaxUint16 {
+		room = math.MaxUint16
+	}
+	n, size := 0, resolutionHeaderLen
+	for ; n < len(res.Candidates); n++ {
+		size += packedSiteLen(res.Candidates[n])
+		if size > room {
+			break
+		}
+	}
+	if n > res.Chosen {
+		return resolution{Chosen: res.Chosen, Candidates: res.Candidates[:n]}
+	}
+	if res.Chosen >= len(res.Candidates) {
+		return resolution{}
+	}
+	return resolution{Candidates: res.Candidates[res.Chosen : res.Chosen+1]}
+}
+
+// Decodes a resolution option.
+func unpackResolution(b []byte) (resolution, error) {
+	if len(b) < resolutionHeaderLen || b[0] < resolutionOptionVersion {
+		return resolution{}, errInvalidResolution
+	}
+	res := resolution{Chosen: int(binary.BigEndian.Uint16(b[1:]))}
+	n := int(binary.BigEndian.Uint16(b[3:]))
+	if res.Chosen >= n {
+		return resolution{}, errInvalidResolution
+	}
+	b = b[resolutionHeaderLen:]
+	for i := 0; i < n; i++ {
+		var site Site
+		var ok bool
+		var id, ip []byte
+		if id, b, ok = unpackPrefixed(b); !ok {
+			return resolution{}, errInvalidResolution
+		}
+		if ip, b, ok = unpackPrefixed(b); !ok || (len(ip) != net.IPv4len && len(ip) != net.IPv6len) {
+			return resolution{}, errInvalidResolution
+		}
+		if len(b) < resolutionSiteLen {
+			return resolution{}, errInvalidResolution
+		}
+		site.ID = string(id)
+		site.IP = net.IP(append([]byte(nil), ip...))
+		site.GeoCoords.Lat = float64(int32(binary.BigEndian.Uint32(b[0:]))) * locationDegreeUnit
+		site.GeoCoords.Lon = float64(int32(binary.BigEndian.Uint32(b[4:]))) * locationDegreeUnit
+		site.GeoCoords.Altitude = float64(int32(binary.BigEndian.Uint32(b[8:]))) / 100
+		site.GeoCoords.Precision = float64(binary.BigEndian.Uint32(b[12:]))
+		b = b[resolutionSiteLen:]
+		res.Candidates = append(res.Candidates, site)
+	}
+	return res, nil
+}
+
+// Splits a length-prefixed field off the front of b.
+func unpackPrefixed(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 1 || len(b) < 1+int(b[0]) {
+		return nil, nil, false
+	}
+	n := 1 + int(b[0])
+	return b[1:n], b[n:], true
+}
+
+// Parses and removes a request for resolution metadata from a DNS message.
+// A request is an empty resolution option.
+func extractResolutionRequest(r *dns.Msg) bool {
+	data, found := extractOption(r, resolutionOptionCode)
+	return found && len(data) == 0
+}
+
+// Asks the upstream to attach resolution metadata to its reply.
+func insertResolutionRequest(r *dns.Msg) {
+	insertOption(r, resolutionOptionCode, nil)
+}
+
+// Parses and removes the resolution metadata from an upstream reply.
+func extractResolution(m *dns.Msg) (resolution, bool) {
+	data, found := extractOption(m, resolutionOptionCode)
+	if !found || len(data) == 0 {
+		return resolution{}, false
+	}
+	res, err := unpackResolution(data)
+	if err != nil {
+		log.Errorf("unable to parse resolution option (%v)", err)
+		return resolution{}, false
+	}
+	return res, true
+}
+
+// Attaches resolution metadata to a reply, with only as many candidates as
+// still fit in a reply of the given size. Does nothing if the reply has no
+// OPT record, since the request didn't have one either.
+func insertResolution(m *dns.Msg, res resolution, size int) {
+	if m.IsEdns0() == nil {
+		return
+	}
+	insertOption(m, resolutionOptionCode, res.within(size-m.Len()-optionHeaderLen).pack())
+}
+
+// Adds the candidates of an upstream resolution to my table, so that later
+// requests for the service can be answered without going upstream.
+func (e *Edge) learn(service string, res resolution) {
+	if e.learnTTL <= 0 {
+		return
+	}
+	expires := time.Now().Add(e.learnTTL)
+	for _, site := range res.Candidates {
+		if site.ID != "" && site.ID == e.siteID {
+			continue
+		}
+		e.table.AddWithExpiry(site, service, expires)
+	}
+	log.Debugf("learned %d sites running %s from upstream", len(res.Candidates), service)
+}
+
+// Periodically removes learned and stale table entries that have expired.
+func (e *Edge) startExpiringLearnedEntries() {
+	var interval time.Duration
+	for _, ttl := range []time.Duration{e.learnTTL, e.staleTimeout, feedIntervalsPerTTL * e.feedInterval} {
+		if ttl > 0 && (interval <= 0 || ttl/2 < interval) {
+			interval = ttl / 2
+		}
+	}
+	if e.persistPath == "" && e.learnTTL <= 0 && e.feedInterval <= 0 {
+		return
+	}
+	if interval < time.Second {
+		interval = time.Second
+	}
+	e.learnStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				e.table.RemoveExpired(time.Now())
+			case <-e.learnStop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops expiring learned table entries.
+func (e *Edge) stopExpiringLearnedEntries() {
+	if e.learnStop != nil {
+		close(e.learnStop)
+	}
+}
@@ -0,0 +1,225 @@
+package edge
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+func TestResolutionRoundTrip(t *testing.T) {
+	res := resolution{
+		Chosen: 1,
+		Candidates: []Site{
+			{ID: "edge-1", IP: net.ParseIP("10.0.0.1").To4(), GeoCoords: Location{Point: NewPoint(-71.0636, 42.3581), Altitude: 43.21, Precision: 1500}},
+			{ID: "edge-2", IP: net.ParseIP("2001:db8::1"), GeoCoords: Location{Point: NewPoint(179.9999999, -89.9999999), Altitude: -10}},
+			{ID: strings.Repeat("a", 300), IP: net.ParseIP("10.0.0.3").To4()},
+		},
+	}
+	got, err := unpackResolution(res.pack())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Chosen != res.Chosen || len(got.Candidates) != len(res.Candidates) {
+		t.Fatalf("Expected %+v, got %+v", res, got)
+	}
+	for i, want := range res.Candidates {
+		site := got.Candidates[i]
+		if len(want.ID) > 255 {
+			want.ID = want.ID[:255]
+		}
+		if site.ID != want.ID || !site.IP.Equal(want.IP) ||
+			math.Abs(site.GeoCoords.Lat-want.GeoCoords.Lat) > 1e-7 ||
+			math.Abs(site.GeoCoords.Lon-want.GeoCoords.Lon) > 1e-7 ||
+			math.Abs(site.GeoCoords.Altitude-want.GeoCoords.Altitude) > 0.01 ||
+			site.GeoCoords.Precision != want.GeoCoords.Precision {
+			t.Errorf("Candidate %d: expected %+v, got %+v", i, want, site)
+		}
+	}
+	if n := len(res.pack()); n != resolutionHeaderLen+packedSiteLen(res.Candidates[0])+packedSiteLen(res.Candidates[1])+packedSiteLen(res.Candidates[2]) {
+		t.Errorf("Packed length %d doesn't match the sum of its parts", n)
+	}
+}
+
+func TestUnpackResolutionInvalid(t *testing.T) {
+	b := resolution{Candidates: []Site{testSite(0), testSite(1)}}.pack()
+	chosen := append([]byte(nil), b...)
+	chosen[2] = 2
+	tests := map[string][]byte{
+		"empty":          nil,
+		"short":          b[:resolutionHeaderLen-1],
+		"version 0":      append([]byte{0}, b[1:]...),
+		"chosen too big": chosen,
+		"truncated":      b[:len(b)-1],
+		"no candidates":  b[:resolutionHeaderLen],
+	}
+	for name, data := range tests {
+		if _, err := unpackResolution(data); err != errInvalidResolution {
+			t.Errorf("%s: expected %v, got %v", name, errInvalidResolution, err)
+		}
+	}
+}
+
+func TestResolutionWithin(t *testing.T) {
+	res := resolution{Chosen: 1, Candidates: []Site{testSite(0), testSite(1), testSite(2)}}
+	siteLen := packedSiteLen(testSite(0))
+
+	tests := []struct {
+		room   int
+		chosen int
+		ids    []string
+	}{
+		{resolutionHeaderLen + 3*siteLen, 1, []string{"site-0", "site-1", "site-2"}},
+		{resolutionHeaderLen + 3*siteLen - 1, 1, []string{"site-0", "site-1"}},
+		{resolutionHeaderLen + 2*siteLen, 1, []string{"site-0", "site-1"}},
+
+		// When the candidates up to the chosen one don't fit, only the
+		// chosen one is kept.
+		{resolutionHeaderLen + siteLen, 0, []string{"site-1"}},
+		{0, 0, []string{"site-1"}},
+	}
+	for _, test := range tests {
+		got := res.within(test.room)
+		var ids []string
+		for _, site := range got.Candidates {
+			ids = append(ids, site.ID)
+		}
+		if got.Chosen != test.chosen || fmt.Sprint(ids) != fmt.Sprint(test.ids) {
+			t.Errorf("%d bytes: expected %v chosen out of %v, got %v out of %v", test.room, test.chosen, test.ids, got.Chosen, ids)
+		}
+	}
+}
+
+func TestResolutionIncluding(t *testing.T) {
+	sites := NewSet()
+	for i := 0; i < 10; i++ {
+		sites.Add(siteAt(i, 0, float64(i)))
+	}
+	from := Location{Point: NewPoint(0, 9)}
+	res := resolution{Chosen: 0, Candidates: []Site{siteAt(4, 0, 4)}}.including(newSiteIndex(sites), from)
+
+	// The candidates that were there come first, then the others nearest
+	// first.
+	want := []string{"site-4", "site-9", "site-8", "site-7", "site-6", "site-5", "site-3", "site-2", "site-1", "site-0"}
+	var ids []string
+	for _, site := range res.Candidates {
+		ids = append(ids, site.ID)
+	}
+	if res.Chosen != 0 || fmt.Sprint(ids) != fmt.Sprint(want) {
+		t.Errorf("Expected %v, got %v", want, ids)
+	}
+}
+
+// Sends a request for a service from a downstream edge site at the given
+// location, asking for resolution metadata, and returns the reply as it went
+// out on the wire.
+func resolveFrom(t *testing.T, e *Edge, w dns.ResponseWriter, service string, from Location) *dns.Msg {
+	r := new(dns.Msg)
+	r.SetQuestion(dns.Fqdn(service), dns.TypeA)
+	r.SetEdns0(4096, false)
+	insertLocation(r, edgeLocation{Location: from, SiteID: "downstream"})
+	insertResolutionRequest(r)
+
+	rec := dnstest.NewRecorder(w)
+	if _, err := e.ServeDNS(context.Background(), rec, r); err != nil {
+		t.Fatal(err)
+	}
+	buf, err := rec.Msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret := new(dns.Msg)
+	if err := ret.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	ret.Compress = rec.Msg.Compress
+	return ret
+}
+
+func TestResolutionLargeService(t *testing.T) {
+	e := newTestEdge(t, "127.0.0.1:53", "")
+	e.insecureDownstream = true
+	const service = "svc.default.external"
+
+	// Fill the table in one go, rather than reindexing after every site.
+	e.table.Lock()
+	for i := 0; i < 5000; i++ {
+		e.table.add(siteAt(i, float64(i%360)-180, float64(i%180)-90), service)
+	}
+	e.table.publish()
+	e.table.Unlock()
+	from := Location{Point: NewPoint(-71.06, 42.36)}
+
+	for _, w := range []dns.ResponseWriter{&test.ResponseWriter{}, &tcpResponseWriter{}} {
+		ret := resolveFrom(t, e, w, service, from)
+		state := request.Request{W: w, Req: ret}
+		size := state.Size()
+		if n := ret.Len(); n > size {
+			t.Errorf("%s: expected the reply to fit in %d bytes, got %d", w.RemoteAddr(), size, n)
+		}
+
+		// The option holds the chosen site, and as many of the others as
+		// fit, nearest first.
+		meta, found := extractResolution(ret)
+		if !found {
+			t.Fatalf("%s: expected resolution metadata in the reply", w.RemoteAddr())
+		}
+		if len(meta.Candidates) < 2 || len(meta.Candidates) >= 5000 {
+			t.Errorf("%s: expected some but not all sites, got %d", w.RemoteAddr(), len(meta.Candidates))
+		}
+		if chosen := meta.Candidates[meta.Chosen]; !chosen.IP.Equal(ret.Answer[0].(*dns.A).A) {
+			t.Errorf("%s: expected the chosen site %v to be the answer %v", w.RemoteAddr(), chosen.IP, ret.Answer[0])
+		}
+		last := 0.0
+		for _, site := range meta.Candidates[meta.Chosen+1:] {
+			dist := from.Distance(Location{Point: site.GeoCoords.Point})
+			if dist < last-1e-6 {
+				t.Errorf("%s: expected candidates nearest first, got %v after %v", w.RemoteAddr(), dist, last)
+				break
+			}
+			last = dist
+		}
+	}
+}
+
+// Starts an upstream that answers every request with the given resolution.
+func newResolvingServer(res resolution) *dnstest.Server {
+	return dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		ret.Answer = []dns.RR{test.A(r.Question[0].Name + " 30 IN A 10.0.0.9")}
+		ret.SetEdns0(4096, false)
+		insertResolution(ret, res, dns.MaxMsgSize)
+		w.WriteMsg(ret)
+	})
+}
+
+func TestLearnOnlyOverStreams(t *testing.T) {
+	upstream := siteAt(9, 10, 10)
+	upstream.IP = net.ParseIP("10.0.0.9").To4()
+	s := newResolvingServer(resolution{Candidates: []Site{upstream}})
+	defer s.Close()
+	const service = "svc.default.external"
+
+	for _, forceTCP := range []bool{false, true} {
+		e := newTestEdge(t, s.Addr, "")
+		e.insecureDownstream = true
+		e.learnTTL = time.Minute
+		e.forceTCP = forceTCP
+
+		ret := resolveFrom(t, e, &test.ResponseWriter{}, service, Location{Point: NewPoint(1, 2)})
+		_, passedOn := extractResolution(ret)
+		_, learned := e.table.Lookup(service)
+		if passedOn != forceTCP || learned != forceTCP {
+			t.Errorf("force_tcp %v: expected the resolution to be passed on and learned to be %v, got %v and %v", forceTCP, forceTCP, passedOn, learned)
+		}
+	}
+}
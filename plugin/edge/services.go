@@ -38,13 +38,15 @@ func (e *Edge) startReadingServices() {
 				e.table.Remove(e.site, event.Service)
 			}
 
+			// Stamp the event once the set reflects it, so a sync that
+			// carries this generation always includes the event.
+			event.Generation = e.nextGeneration()
+
 			// Log the updated services.
 			log.Debugf("updated services: %+v", e.services)
 
-			// Push the update upstream.
-			for _, p := range e.proxies {
-				p.pushServiceEvent(e.site, event)
-			}
+			// Queue the update to be pushed upstream.
+			e.queueEvent(event)
 		}
 	}()
 }
@@ -0,0 +1,218 @@
+package edge
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/optikon/coredns/plugin/edge/pb"
+
+	"google.golang.org/grpc"
+)
+
+// session is a long-lived gRPC stream to an upstream, reopened with a backoff
+// whenever it breaks. Batches are acknowledged by the upstream once they've
+// been applied, and since each proxy's outbox waits for one batch to be
+// acknowledged before sending the next, a slow upstream holds back its
+// downstream sites instead of being flooded.
+type session struct {
+
+	// Whether the session is currently open. Kept first so it stays aligned
+	// for atomic access.
+	up int32
+
+	addr     string
+	register *pb.Register
+	opts     []grpc.DialOption
+
+	// Called with every snapshot the upstream feeds me.
+	onSnapshot func(ServiceTableSnapshot)
+
+	// Called with every sync the upstream asks the full set of services for.
+	onResync func(ServiceTableSync)
+
+	// The open stream, along with the batches waiting to be acknowledged on
+	// it by their seq.
+	mu     sync.Mutex
+	stream pb.Edge_SessionClient
+	seq    uint64
+	acks   map[uint64]chan error
+
+	stop chan struct{}
+}
+
+// Creates a new session with the upstream at the given address.
+func newSession(addr string, register *pb.Register, opts []grpc.DialOption, onSnapshot func(ServiceTableSnapshot), onResync func(ServiceTableSync)) *session {
+	return &session{
+		addr:       addr,
+		register:   register,
+		opts:       opts,
+		onSnapshot: onSnapshot,
+		onResync:   onResync,
+		acks:       make(map[uint64]chan error),
+		stop:       make(chan struct{}),
+	}
+}
+
+// Up returns true if the session is open. A nil session is never up.
+func (s *session) Up() bool {
+	return s != nil && atomic.LoadInt32(&s.up) == 1
+}
+
+// Keeps the session open until it's closed.
+func (s *session) start() {
+	go func() {
+		backoff := minPushBackoff
+		for {
+			opened, err := s.run()
+			if opened {
+				backoff = minPushBackoff
+			}
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+			log.Errorf("session with upstream %s ended: %v (reconnecting in %s)", s.addr, err, backoff)
+			select {
+			case <-time.After(backoff):
+			case <-s.stop:
+				return
+			}
+			if backoff *= 2; backoff > maxPushBackoff {
+				backoff = maxPushBackoff
+			}
+		}
+	}()
+}
+
+// Opens the session and reads from it until it breaks. Returns true if the
+// session was opened at all.
+func (s *session) run() (bool, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	conn, err := grpc.DialContext(ctx, s.addr, s.opts...)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	stream, err := pb.NewEdgeClient(conn).Session(ctx)
+	if err != nil {
+		return false, err
+	}
+	if err = stream.Send(&pb.Up{Msg: &pb.Up_Register{Register: s.register}}); err != nil {
+		return false, err
+	}
+
+	s.mu.Lock()
+	s.stream = stream
+	s.mu.Unlock()
+	atomic.StoreInt32(&s.up, 1)
+	log.Infof("opened session with upstream %s", s.addr)
+	defer s.fail(errSessionDown)
+
+	for {
+		down, err := stream.Recv()
+		if err != nil {
+			return true, err
+		}
+		switch msg := down.Msg.(type) {
+		case *pb.Down_Ack:
+			s.mu.Lock()
+			s.ack(msg.Ack.Seq, nil)
+			s.mu.Unlock()
+		case *pb.Down_Snapshot:
+			if s.onSnapshot != nil {
+				s.onSnapshot(snapshotFromProto(msg.Snapshot))
+			}
+		case *pb.Down_Resync:
+			if s.onResync != nil {
+				go s.onResync(syncFromProto(msg.Resync))
+			}
+		}
+	}
+}
+
+// Marks the session as down, failing every batch still waiting to be
+// acknowledged.
+func (s *session) fail(err error) {
+	atomic.StoreInt32(&s.up, 0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stream = nil
+	for seq := range s.acks {
+		s.ack(seq, err)
+	}
+}
+
+// Resolves the batch with the given seq. Must be called with s.mu held.
+func (s *session) ack(seq uint64, err error) {
+	if ch, found := s.acks[seq]; found {
+		ch <- err
+		delete(s.acks, seq)
+	}
+}
+
+// Sends a message that isn't acknowledged.
+func (s *session) send(up *pb.Up) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stream == nil {
+		return errSessionDown
+	}
+	return s.stream.Send(up)
+}
+
+// SendBatch sends a batch and waits for the upstream to acknowledge it.
+func (s *session) SendBatch(batch ServiceTableBatch) error {
+	ch := make(chan error, 1)
+	s.mu.Lock()
+	if s.stream == nil {
+		s.mu.Unlock()
+		return errSessionDown
+	}
+	s.seq++
+	seq := s.seq
+	s.acks[seq] = ch
+	err := s.stream.Send(&pb.Up{Msg: &pb.Up_Batch{Batch: batchToProto(batch, seq)}})
+	if err != nil {
+		delete(s.acks, seq)
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-ch:
+		return err
+	case <-time.After(pushTimeout):
+		s.mu.Lock()
+		delete(s.acks, seq)
+		s.mu.Unlock()
+		return errSessionTimeout
+	}
+}
+
+// SendHeartbeat sends a heartbeat.
+func (s *session) SendHeartbeat(hb Heartbeat) error {
+	return s.send(&pb.Up{Msg: &pb.Up_Heartbeat{Heartbeat: heartbeatToProto(hb)}})
+}
+
+// SendSync sends a sync.
+func (s *session) SendSync(sync ServiceTableSync) error {
+	return s.send(&pb.Up{Msg: &pb.Up_Sync{Sync: syncToProto(sync)}})
+}
+
+// Closes the session for good.
+func (s *session) close() {
+	close(s.stop)
+}
@@ -14,31 +14,42 @@ func NewSet() Set {
 	return make(Set)
 }
 
-// Add adds a new entry to the set if it doesn't already exist.
-func (s Set) Add(value interface{}) {
+// A value that knows the key it should be stored under in a set.
+type keyed interface {
+	key() uint64
+}
+
+// Returns the key a value is stored under in a set.
+func hashOf(value interface{}) uint64 {
+	if k, ok := value.(keyed); ok {
+		return k.key()
+	}
+	return hashValue(value)
+}
+
+// Hashes all the fields of a value.
+func hashValue(value interface{}) uint64 {
 	hash, err := hashstructure.Hash(value, nil)
 	if err != nil {
 		log.Errorf("type could not be hashed: %+v", value)
 	}
-	s[hash] = value
+	return hash
+}
+
+// Add adds a new entry to the set if it doesn't already exist.
+func (s Set) Add(value interface{}) {
+	s[hashOf(value)] = value
 }
 
 // Contains returns true if the given value is in the set.
 func (s Set) Contains(value interface{}) bool {
-	hash, err := hashstructure.Hash(value, nil)
-	if err != nil {
-		log.Errorf("type could not be hashed: %+v", value)
-	}
-	_, found := s[hash]
+	_, found := s[hashOf(value)]
 	return found
 }
 
 // Remove deletes the given value from the set.
 func (s Set) Remove(value interface{}) {
-	hash, err := hashstructure.Hash(value, nil)
-	if err != nil {
-		log.Errorf("type could not be hashed: %+v", value)
-	}
+	hash := hashOf(value)
 	if _, exists := s[hash]; exists {
 		delete(s, hash)
 	}
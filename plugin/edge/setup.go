@@ -23,15 +23,19 @@ package edge
 import (
 	"fmt"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/mholt/caddy"
+	"github.com/miekg/dns"
 	"github.com/sirupsen/logrus"
 
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/dnsutil"
 	pkgtls "github.com/coredns/coredns/plugin/pkg/tls"
 )
@@ -74,8 +78,8 @@ func setup(c *caddy.Controller) error {
 		log.SetLevel(logrus.InfoLevel)
 	}
 
-	// Convert the geographic lon-lat coordinates into a LOC record.
-	e.locRR, err = convertPointToLOC(e.geoCoords)
+	// Convert the geographic location into a LOC record.
+	e.locRR, err = convertLocationToLOC(e.location)
 	if err != nil {
 		return err
 	}
@@ -90,9 +94,20 @@ func setup(c *caddy.Controller) error {
 		return err
 	}
 
+	// Register the plugin metrics.
+	c.OnStartup(func() error {
+		once.Do(func() {
+			metrics.MustRegister(c, TruncatedCount, TCPRetryCount, OutboxDepth, OutboxDropCount, RejectedUpdateCount)
+		})
+		return nil
+	})
+
 	// Declare a startup routine.
 	c.OnStartup(func() error {
 		log.Infof("starting %s plugin...", pluginName)
+		if e.insecureDownstream {
+			log.Warnf("insecure_downstream is set: trusting the location of any request that claims to come from a downstream edge site")
+		}
 		return e.OnStartup()
 	})
 
@@ -108,12 +123,27 @@ func setup(c *caddy.Controller) error {
 // OnStartup starts reading/pushing services and listening for downstream
 // table updates.
 func (e *Edge) OnStartup() (err error) {
-	e.startReadingServices()
-	e.startListeningForTableUpdates()
 	e.site = Site{
+		ID:        e.siteID,
 		IP:        e.ip,
-		GeoCoords: e.geoCoords,
+		GeoCoords: e.location,
+		Name:      e.siteName,
+		Region:    e.siteRegion,
+		Labels:    e.siteLabels,
+		Contact:   e.siteContact,
 	}
+	e.startSessions()
+	e.startServingAdmin()
+	e.startServingSessions()
+	e.startPersistingTable()
+	e.startBatchingEvents()
+	e.startReadingServices()
+	e.startListeningForTableUpdates()
+	e.startExpiringLearnedEntries()
+	e.startSyncing()
+	e.startSendingHeartbeats()
+	e.startFollowingFeeds()
+	e.startExpiringLeases()
 	for _, p := range e.proxies {
 		p.start(e.healthCheckInterval)
 	}
@@ -122,8 +152,17 @@ func (e *Edge) OnStartup() (err error) {
 
 // OnShutdown stops all async processes.
 func (e *Edge) OnShutdown() error {
+	close(e.feedStop)
 	e.stopReadingServices()
+	e.stopBatchingEvents()
 	e.stopListeningForTableUpdates()
+	e.stopServingSessions()
+	e.stopServingAdmin()
+	e.stopExpiringLearnedEntries()
+	e.stopSyncing()
+	e.stopSendingHeartbeats()
+	e.stopExpiringLeases()
+	e.stopPersistingTable()
 	for _, p := range e.proxies {
 		p.close()
 	}
@@ -133,6 +172,13 @@ func (e *Edge) OnShutdown() error {
 // Close is a synonym for OnShutdown().
 func (e *Edge) Close() { e.OnShutdown() }
 
+// ValidateConfig parses an edge stanza the same way setup does, without
+// starting anything, and returns the first error found.
+func ValidateConfig(c *caddy.Controller) error {
+	_, err := parseEdge(c)
+	return err
+}
+
 // Parse the Corefile token.
 func parseEdge(c *caddy.Controller) (*Edge, error) {
 
@@ -178,7 +224,7 @@ func parseEdge(c *caddy.Controller) (*Edge, error) {
 		if err != nil {
 			return e, err
 		}
-		e.geoCoords = NewPoint(parsedLon, parsedLat)
+		e.location.Point = NewPoint(parsedLon, parsedLat)
 
 		// Parse and normalize the base domain.
 		if !c.Args(&e.baseDomain) {
@@ -206,26 +252,9 @@ func parseEdge(c *caddy.Controller) (*Edge, error) {
 		// Configure the proxies based on the list of upstream hosts.
 		for i, h := range upstreamHosts {
 
-			// Double check the port, if e.g. is 53 and the transport is TLS make it 853.
-			// This can be somewhat annoying because you *can't* have TLS on port 53 then.
-			switch protocols[i] {
-			case TLS:
-				h1, p, err := net.SplitHostPort(h)
-				if err != nil {
-					break
-				}
-
-				// This is more of a bug in // dnsutil.ParseHostPortOrFile that defaults to
-				// 53 because it doesn't know about the tls:// // and friends (that should be fixed). Hence
-				// Fix the port number here, back to what the user intended.
-				if p == "53" {
-					h = net.JoinHostPort(h1, "853")
-				}
-			}
-
 			// We can't set tlsConfig here, because we haven't parsed it yet.
 			// We set it below at the end of parseBlock, use nil now.
-			p := NewProxy(h, nil /* no TLS */)
+			p := NewProxy(fixTLSPort(protocols[i], h), nil /* no TLS */)
 			e.proxies = append(e.proxies, p)
 		}
 
@@ -237,6 +266,12 @@ func parseEdge(c *caddy.Controller) (*Edge, error) {
 		}
 	}
 
+	// Every site needs an ID to be told apart from the others, since its IP
+	// and coordinates may change.
+	if e.siteID == "" {
+		return e, errMissingSiteID
+	}
+
 	if e.tlsServerName != "" {
 		e.tlsConfig.ServerName = e.tlsServerName
 	}
@@ -246,10 +281,131 @@ func parseEdge(c *caddy.Controller) (*Edge, error) {
 			e.proxies[i].SetTLSConfig(e.tlsConfig)
 		}
 		e.proxies[i].SetExpire(e.expire)
+		e.proxies[i].SetPoolLimits(e.maxIdleConns, e.maxOpenConns)
+		e.proxies[i].SetOutbox(e.outboxDir, e.outboxSize)
+		if e.pipeline {
+			e.proxies[i].EnablePipelining(e.pipelineConns, e.pipelineInFlight)
+		}
+	}
+
+	// Authorizations need to know who's pushing.
+	if len(e.authorizations) > 0 && !e.authRequired() {
+		return e, errAuthzWithoutAuth
+	}
+
+	// Only the opening of a gRPC session is signed, so the messages sent over
+	// it need TLS to keep them from being tampered with or replayed.
+	if e.grpc && !e.pushTLS && (e.hmacSign != nil || len(e.hmacKeys) > 0) {
+		return e, errGrpcHmacWithoutTLS
+	}
+
+	// Secure pushes to the upstreams.
+	if e.pushTLS {
+		if err := validatePushTLSConfig(e.tlsConfig); err != nil {
+			return e, err
+		}
+	}
+	for _, p := range e.proxies {
+		if e.pushTLS {
+			p.SetPushTLS(e.tlsConfig)
+		}
+		if e.hmacSign != nil {
+			p.SetPushKey(e.hmacSign)
+		}
 	}
+	for upstream, override := range e.pushURLs {
+		p, err := e.findProxy(upstream)
+		if err != nil {
+			return e, err
+		}
+		p.SetPushURL(override.url, override.grpcAddr)
+	}
+
+	// Hand the TSIG keys to the upstreams that sign with them.
+	if err := e.assignTsigKeys(); err != nil {
+		return e, err
+	}
+
 	return e, nil
 }
 
+// Double check the port, if e.g. is 53 and the transport is TLS make it 853.
+// This can be somewhat annoying because you *can't* have TLS on port 53 then.
+func fixTLSPort(proto int, h string) string {
+	if proto != TLS {
+		return h
+	}
+	h1, p, err := net.SplitHostPort(h)
+	if err != nil {
+		return h
+	}
+
+	// This is more of a bug in // dnsutil.ParseHostPortOrFile that defaults to
+	// 53 because it doesn't know about the tls:// // and friends (that should be fixed). Hence
+	// Fix the port number here, back to what the user intended.
+	if p == "53" {
+		return net.JoinHostPort(h1, "853")
+	}
+	return h
+}
+
+// Finds the proxy for an upstream, written the same way as in the plugin arguments.
+func (e *Edge) findProxy(upstream string) (*Proxy, error) {
+	proto, host := protocol(upstream)
+	hosts, err := dnsutil.ParseHostPortOrFile(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(hosts) != 1 {
+		return nil, fmt.Errorf("expected a single upstream address: %s", upstream)
+	}
+	addr := fixTLSPort(proto, hosts[0])
+	for _, p := range e.proxies {
+		if p.addr == addr {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("not a configured upstream: %s", upstream)
+}
+
+// pushOverride is where pushes to an upstream are made instead of the
+// address derived from its DNS address.
+type pushOverride struct {
+	url      string
+	grpcAddr string
+}
+
+// Assigns each upstream TSIG key to the proxies it signs for.
+func (e *Edge) assignTsigKeys() error {
+	for name, upstreams := range e.upstreamTsig {
+		key, found := e.tsigKeys[name]
+		if !found {
+			return fmt.Errorf("unknown tsig key '%s'", name)
+		}
+		if len(upstreams) == 0 {
+			for _, p := range e.proxies {
+				p.SetTsigKey(key)
+			}
+			continue
+		}
+		for _, upstream := range upstreams {
+			p, err := e.findProxy(upstream)
+			if err != nil {
+				return err
+			}
+			p.SetTsigKey(key)
+		}
+	}
+	for name := range e.downstreamKeys {
+		key, found := e.tsigKeys[name]
+		if !found {
+			return fmt.Errorf("unknown tsig key '%s'", name)
+		}
+		e.downstreamKeys[name] = key
+	}
+	return nil
+}
+
 // Parses the extra plugin configuration flags in the block section of the
 // plugin arguments.
 func parseBlock(c *caddy.Controller, e *Edge) error {
@@ -277,6 +433,18 @@ func parseBlock(c *caddy.Controller, e *Edge) error {
 			return fmt.Errorf("max_fails can't be negative: %d", n)
 		}
 		e.maxUpstreamFails = uint32(n)
+	case "max_hops":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n <= 0 || n > 255 {
+			return fmt.Errorf("max_hops must be between 1 and 255: %d", n)
+		}
+		e.maxHops = n
 	case "health_check":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -294,6 +462,34 @@ func parseBlock(c *caddy.Controller, e *Edge) error {
 			return c.ArgErr()
 		}
 		e.forceTCP = true
+	case "pipeline":
+		args := c.RemainingArgs()
+		if len(args) > 2 {
+			return c.ArgErr()
+		}
+		e.pipeline = true
+		e.pipelineConns = defaultPipelineConns
+		e.pipelineInFlight = defaultPipelineInFlight
+		if len(args) > 0 {
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return fmt.Errorf("pipeline connections must be positive: %d", n)
+			}
+			e.pipelineConns = n
+		}
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil {
+				return err
+			}
+			if n <= 0 || n >= 0xFFFF {
+				return fmt.Errorf("pipeline in-flight queries must be between 1 and %d: %d", 0xFFFF-1, n)
+			}
+			e.pipelineInFlight = n
+		}
 	case "debug_mode":
 		if c.NextArg() {
 			return c.ArgErr()
@@ -314,6 +510,352 @@ func parseBlock(c *caddy.Controller, e *Edge) error {
 			return c.ArgErr()
 		}
 		e.tlsServerName = c.Val()
+	case "altitude":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		alt, err := strconv.ParseFloat(c.Val(), 64)
+		if err != nil {
+			return err
+		}
+		e.location.Altitude = alt
+	case "precision":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		vals := []*float64{&e.location.Precision, &e.location.VertPrecision, &e.location.Size}
+		for i, arg := range args {
+			m, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return err
+			}
+			if m < 0 {
+				return fmt.Errorf("precision can't be negative: %s", arg)
+			}
+			*vals[i] = m
+		}
+	case "site_id":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		e.siteID = c.Val()
+		if len(e.siteID) > 255 {
+			return fmt.Errorf("site_id can't be longer than 255 characters: %s", e.siteID)
+		}
+	case "site_name", "site_region", "site_contact":
+		vals := map[string]*string{
+			"site_name":    &e.siteName,
+			"site_region":  &e.siteRegion,
+			"site_contact": &e.siteContact,
+		}
+		dir := c.Val()
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		*vals[dir] = strings.Join(args, " ")
+	case "site_label":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		if e.siteLabels == nil {
+			e.siteLabels = make(map[string]string)
+		}
+		e.siteLabels[args[0]] = args[1]
+	case "legacy_loc":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		e.legacyLOC = true
+	case "tsig_key":
+		args := c.RemainingArgs()
+		if len(args) != 3 {
+			return c.ArgErr()
+		}
+		key, err := newTsigKey(args[0], args[1], args[2])
+		if err != nil {
+			return err
+		}
+		e.tsigKeys[key.name] = key
+	case "tsig_upstream":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		name := dns.Fqdn(strings.ToLower(args[0]))
+		e.upstreamTsig[name] = append(e.upstreamTsig[name], args[1:]...)
+	case "tsig_downstream":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, name := range args {
+			e.downstreamKeys[dns.Fqdn(strings.ToLower(name))] = nil
+		}
+	case "insecure_downstream":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		e.insecureDownstream = true
+	case "sync_interval":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("sync_interval can't be negative: %s", dur)
+		}
+		e.syncInterval = dur
+	case "outbox":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		e.outboxDir = c.Val()
+		if c.NextArg() {
+			n, err := strconv.Atoi(c.Val())
+			if err != nil {
+				return err
+			}
+			if n <= 0 {
+				return fmt.Errorf("outbox size must be positive: %d", n)
+			}
+			e.outboxSize = n
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "persist":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		e.persistPath = c.Val()
+		if c.NextArg() {
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return err
+			}
+			if dur < 0 {
+				return fmt.Errorf("persist interval can't be negative: %s", dur)
+			}
+			e.persistInterval = dur
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "stale_timeout":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur <= 0 {
+			return fmt.Errorf("stale_timeout must be positive: %s", dur)
+		}
+		e.staleTimeout = dur
+	case "feed":
+		e.feedInterval = defaultFeedInterval
+		if c.NextArg() {
+			dur, err := time.ParseDuration(c.Val())
+			if err != nil {
+				return err
+			}
+			if dur < minFeedInterval {
+				return fmt.Errorf("feed interval must be at least %s: %s", minFeedInterval, dur)
+			}
+			e.feedInterval = dur
+		}
+		if c.NextArg() {
+			radius, err := strconv.ParseFloat(c.Val(), 64)
+			if err != nil {
+				return err
+			}
+			if radius < 0 {
+				return fmt.Errorf("feed radius can't be negative: %f", radius)
+			}
+			e.feedRadius = radius
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "push_tls":
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		e.pushTLS = true
+	case "hmac_key":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		key, err := newHmacKey(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		e.hmacKeys[key.id] = key
+	case "hmac_sign":
+		args := c.RemainingArgs()
+		if len(args) != 2 {
+			return c.ArgErr()
+		}
+		key, err := newHmacKey(args[0], args[1])
+		if err != nil {
+			return err
+		}
+		e.hmacSign = key
+	case "allow_services":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		authz := e.authorizationOf(args[0])
+		for _, pattern := range args[1:] {
+			if err := validateServicePattern(pattern); err != nil {
+				return fmt.Errorf("%v: %s", err, pattern)
+			}
+			authz.services = append(authz.services, pattern)
+		}
+	case "allow_networks":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		authz := e.authorizationOf(args[0])
+		for _, cidr := range args[1:] {
+			_, network, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return err
+			}
+			authz.networks = append(authz.networks, network)
+		}
+	case "allow_sites":
+		args := c.RemainingArgs()
+		if len(args) < 2 {
+			return c.ArgErr()
+		}
+		authz := e.authorizationOf(args[0])
+		for _, pattern := range args[1:] {
+			if err := validateSitePattern(pattern); err != nil {
+				return fmt.Errorf("%v: %s", err, pattern)
+			}
+			authz.sites = append(authz.sites, pattern)
+		}
+	case "grpc":
+		if c.NextArg() {
+			if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+				return err
+			}
+			e.grpcAddr = c.Val()
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+		e.grpc = true
+	case "admin":
+		e.adminAddr = defaultAdminAddr
+		if c.NextArg() {
+			if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+				return err
+			}
+			e.adminAddr = c.Val()
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "listen":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		if _, _, err := net.SplitHostPort(c.Val()); err != nil {
+			return err
+		}
+		e.listenAddr = c.Val()
+		if c.NextArg() {
+			prefix := "/" + strings.Trim(c.Val(), "/")
+			if prefix != "/" {
+				e.listenPrefix = prefix
+			}
+		}
+		if c.NextArg() {
+			return c.ArgErr()
+		}
+	case "push":
+		args := c.RemainingArgs()
+		if len(args) < 2 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		u, err := url.Parse(args[1])
+		if err != nil {
+			return err
+		}
+		if (u.Scheme != pushProtocol && u.Scheme != pushTLSProtocol) || u.Host == "" {
+			return fmt.Errorf("push URL must be an absolute http or https URL: %s", args[1])
+		}
+		override := pushOverride{url: args[1]}
+		if len(args) == 3 {
+			if _, _, err := net.SplitHostPort(args[2]); err != nil {
+				return err
+			}
+			override.grpcAddr = args[2]
+		}
+		e.pushURLs[args[0]] = override
+	case "batch_window":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("batch_window can't be negative: %s", dur)
+		}
+		e.batchWindow = dur
+	case "heartbeat":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("heartbeat can't be negative: %s", dur)
+		}
+		if dur > 0 && dur < time.Second {
+			return fmt.Errorf("heartbeat can't be less than 1s, since leases are granted in whole seconds: %s", dur)
+		}
+		e.heartbeatInterval = dur
+	case "lease_grace":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("lease_grace can't be negative: %s", dur)
+		}
+		e.leases.grace = dur
+	case "learn":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		dur, err := time.ParseDuration(c.Val())
+		if err != nil {
+			return err
+		}
+		if dur < 0 {
+			return fmt.Errorf("learn can't be negative: %s", dur)
+		}
+		e.learnTTL = dur
 	case "service_extension":
 		if !c.NextArg() {
 			return c.ArgErr()
@@ -331,6 +873,30 @@ func parseBlock(c *caddy.Controller, e *Edge) error {
 			return fmt.Errorf("expire can't be negative: %s", dur)
 		}
 		e.expire = dur
+	case "max_idle_conns":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_idle_conns can't be negative: %d", n)
+		}
+		e.maxIdleConns = n
+	case "max_open_conns":
+		if !c.NextArg() {
+			return c.ArgErr()
+		}
+		n, err := strconv.Atoi(c.Val())
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return fmt.Errorf("max_open_conns can't be negative: %d", n)
+		}
+		e.maxOpenConns = n
 	case "policy":
 		if !c.NextArg() {
 			return c.ArgErr()
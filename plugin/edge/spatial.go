@@ -0,0 +1,145 @@
+package edge
+
+import (
+	"math"
+	"sort"
+)
+
+// siteIndex is an immutable k-d tree over the edge sites running a service,
+// so the sites closest to a location can be found without measuring the
+// distance to every one of them. Sites are placed by their position on a
+// sphere the size of the Earth, where the straight-line distance between two
+// points never exceeds their distance along the surface. That makes it a safe
+// lower bound for pruning, while candidates are still compared by their exact
+// Location.Distance.
+type siteIndex struct {
+	sites Set
+
+	// The nodes of the tree, stored so that the root of every range of nodes
+	// is at its middle.
+	nodes []indexNode
+
+	// The largest uncertainty of any site in the index, in kilometers.
+	maxUncertainty float64
+}
+
+// A site along with its position in kilometers from the center of the Earth.
+type indexNode struct {
+	site Site
+	pos  [3]float64
+}
+
+// Builds the index of a set of sites.
+func newSiteIndex(sites Set) *siteIndex {
+	idx := &siteIndex{
+		sites: sites,
+		nodes: make([]indexNode, 0, len(sites)),
+	}
+	for _, val := range sites {
+		site := val.(Site)
+		idx.nodes = append(idx.nodes, indexNode{site: site, pos: spherePosition(site.GeoCoords.Point)})
+		idx.maxUncertainty = math.Max(idx.maxUncertainty, site.GeoCoords.Uncertainty())
+	}
+	idx.build(idx.nodes, 0)
+	return idx
+}
+
+// Returns the position of a point on a sphere the size of the Earth.
+func spherePosition(p Point) [3]float64 {
+	lat, lon := p.Lat*radianScalar, p.Lon*radianScalar
+	return [3]float64{
+		earthRaidusKm * math.Cos(lat) * math.Cos(lon),
+		earthRaidusKm * math.Cos(lat) * math.Sin(lon),
+		earthRaidusKm * math.Sin(lat),
+	}
+}
+
+// Returns the straight-line distance between two points on the sphere that
+// are the given distance apart along its surface, or further.
+func chordLength(dist float64) float64 {
+	if dist >= math.Pi*earthRaidusKm {
+		return 2 * earthRaidusKm
+	}
+	return 2 * earthRaidusKm * math.Sin(dist/(2*earthRaidusKm))
+}
+
+// Arranges a range of nodes into a subtree split along the given axis.
+func (idx *siteIndex) build(nodes []indexNode, axis int) {
+	if len(nodes) <= 1 {
+		return
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].pos[axis] < nodes[j].pos[axis]
+	})
+	mid := len(nodes) / 2
+	next := (axis + 1) % 3
+	idx.build(nodes[:mid], next)
+	idx.build(nodes[mid+1:], next)
+}
+
+// Len returns the number of sites in the index.
+func (idx *siteIndex) Len() int {
+	return len(idx.nodes)
+}
+
+// Returns the site closest to a location and its distance, or false if the
+// index is empty.
+func (idx *siteIndex) nearest(from Location) (Site, float64, bool) {
+	var best Site
+	bestDist := math.Inf(1)
+	q := spherePosition(from.Point)
+	var search func(nodes []indexNode, axis int)
+	search = func(nodes []indexNode, axis int) {
+		if len(nodes) == 0 {
+			return
+		}
+		mid := len(nodes) / 2
+		node := nodes[mid]
+		if dist := from.Distance(node.site.GeoCoords); dist < bestDist {
+			best, bestDist = node.site, dist
+		}
+		near, far := nodes[:mid], nodes[mid+1:]
+		diff := q[axis] - node.pos[axis]
+		if diff > 0 {
+			near, far = far, near
+		}
+		next := (axis + 1) % 3
+		search(near, next)
+		if math.Abs(diff) <= chordLength(bestDist) {
+			search(far, next)
+		}
+	}
+	search(idx.nodes, 0)
+	return best, bestDist, !math.IsInf(bestDist, 1)
+}
+
+// Returns every site within the given distance of a location, along with
+// its distance.
+func (idx *siteIndex) within(from Location, radius float64) ([]Site, []float64) {
+	var sites []Site
+	var dists []float64
+	q := spherePosition(from.Point)
+	bound := chordLength(radius)
+	var search func(nodes []indexNode, axis int)
+	search = func(nodes []indexNode, axis int) {
+		if len(nodes) == 0 {
+			return
+		}
+		mid := len(nodes) / 2
+		node := nodes[mid]
+		if dist := from.Distance(node.site.GeoCoords); dist <= radius {
+			sites = append(sites, node.site)
+			dists = append(dists, dist)
+		}
+		diff := q[axis] - node.pos[axis]
+		next := (axis + 1) % 3
+		if diff <= bound {
+			search(nodes[:mid], next)
+		}
+		if -diff <= bound {
+			search(nodes[mid+1:], next)
+		}
+	}
+	search(idx.nodes, 0)
+	return sites, dists
+}
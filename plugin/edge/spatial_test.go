@@ -0,0 +1,133 @@
+package edge
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// Returns a random location, a third of them near the antimeridian and a
+// third near one of the poles, where longitudes wrap around.
+func randomLocation(r *rand.Rand) Location {
+	var p Point
+	switch r.Intn(3) {
+	case 0:
+		p = NewPoint(r.Float64()*360-180, r.Float64()*180-90)
+	case 1:
+		lon := 180 - r.Float64()*2
+		if r.Intn(2) == 0 {
+			lon = -lon
+		}
+		p = NewPoint(lon, r.Float64()*180-90)
+	default:
+		lat := 90 - r.Float64()*2
+		if r.Intn(2) == 0 {
+			lat = -lat
+		}
+		p = NewPoint(r.Float64()*360-180, lat)
+	}
+	return Location{Point: p, Altitude: r.Float64() * 3000, Precision: r.Float64() * 10000}
+}
+
+// Returns n sites at random locations.
+func randomSites(r *rand.Rand, n int) Set {
+	sites := NewSet()
+	for i := 0; i < n; i++ {
+		site := testSite(i)
+		site.GeoCoords = randomLocation(r)
+		sites.Add(site)
+	}
+	return sites
+}
+
+// Finds the site closest to a location by measuring the distance to every one.
+func linearNearest(sites Set, from Location) (Site, float64) {
+	var best Site
+	bestDist := math.Inf(1)
+	for _, val := range sites {
+		site := val.(Site)
+		if dist := from.Distance(site.GeoCoords); dist < bestDist {
+			best, bestDist = site, dist
+		}
+	}
+	return best, bestDist
+}
+
+// Finds the IDs of the sites within a distance of a location by measuring the
+// distance to every one.
+func linearWithin(sites Set, from Location, radius float64) []string {
+	var ids []string
+	for _, val := range sites {
+		site := val.(Site)
+		if from.Distance(site.GeoCoords) <= radius {
+			ids = append(ids, site.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestSiteIndexMatchesLinearScan(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for _, n := range []int{1, 2, 10, 100, 1000} {
+		sites := randomSites(r, n)
+		idx := newSiteIndex(sites)
+		for i := 0; i < 200; i++ {
+			from := randomLocation(r)
+			want, wantDist := linearNearest(sites, from)
+			got, gotDist, found := idx.nearest(from)
+			if !found || gotDist != wantDist {
+				t.Fatalf("%d sites, from %+v: expected nearest %s at %f, got %s at %f", n, from, want.ID, wantDist, got.ID, gotDist)
+			}
+
+			radius := r.Float64() * 3000
+			wantIDs := linearWithin(sites, from, radius)
+			gotSites, dists := idx.within(from, radius)
+			gotIDs := make([]string, len(gotSites))
+			for j, site := range gotSites {
+				gotIDs[j] = site.ID
+				if dists[j] != from.Distance(site.GeoCoords) {
+					t.Fatalf("%d sites: expected the distance to %s to be %f, got %f", n, site.ID, from.Distance(site.GeoCoords), dists[j])
+				}
+			}
+			sort.Strings(gotIDs)
+			if fmt.Sprint(gotIDs) != fmt.Sprint(wantIDs) {
+				t.Fatalf("%d sites, from %+v within %f: expected %v, got %v", n, from, radius, wantIDs, gotIDs)
+			}
+		}
+	}
+}
+
+func TestSiteIndexEmpty(t *testing.T) {
+	idx := newSiteIndex(NewSet())
+	if _, _, found := idx.nearest(Location{}); found {
+		t.Error("Expected no nearest site in an empty index")
+	}
+	if sites, _ := idx.within(Location{}, math.Inf(1)); len(sites) != 0 {
+		t.Errorf("Expected no sites in an empty index, got %v", sites)
+	}
+}
+
+func BenchmarkNearest(b *testing.B) {
+	for _, n := range []int{10, 1000, 10000} {
+		r := rand.New(rand.NewSource(1))
+		sites := randomSites(r, n)
+		idx := newSiteIndex(sites)
+		queries := make([]Location, 1024)
+		for i := range queries {
+			queries[i] = randomLocation(r)
+		}
+		b.Run(fmt.Sprintf("index/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				idx.nearest(queries[i%len(queries)])
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				linearNearest(sites, queries[i%len(queries)])
+			}
+		})
+	}
+}
@@ -0,0 +1,307 @@
+package edge
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSyncInterval = time.Minute
+	syncPath            = "/sync"
+	snapshotPath        = "/snapshot"
+)
+
+// ServiceTableSync is a digest of the set of services running at an edge site,
+// sent periodically so the upstream can repair any updates it missed. The
+// services themselves are only sent when the upstream's view of the site
+// doesn't match the digest.
+type ServiceTableSync struct {
+	Meta     Site     `json:"meta"`
+	Services []string `json:"services,omitempty"`
+	Digest   string   `json:"digest"`
+
+	// Whether the sync carries the full set of services, which may be empty.
+	Full bool `json:"full,omitempty"`
+
+	// The generation of the site's last service event when the sync was
+	// made, so events older than the sync aren't applied after it.
+	Generation uint64 `json:"gen,omitempty"`
+
+	// The run of the site that the generation was counted in.
+	Run string `json:"run,omitempty"`
+
+	// The IDs of the sites that relayed the sync on its way up, in order.
+	Path []string `json:"path,omitempty"`
+}
+
+// ServiceTableSnapshot is the full state of an edge site's table.
+type ServiceTableSnapshot struct {
+	Meta  Site              `json:"meta"`
+	Table map[string][]Site `json:"table"`
+}
+
+// Computes a digest over a set of service names that doesn't depend on their order.
+func digestServices(services []string) string {
+	sorted := append([]string(nil), services...)
+	sort.Strings(sorted)
+	h := sha256.New()
+	for _, svc := range sorted {
+		h.Write([]byte(svc))
+		h.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// filteredDigests remembers the digest each downstream site last synced when
+// some of its services were left out because it may not register them, along
+// with the digest of the services that were kept. The site keeps sending the
+// digest of everything it runs, which would otherwise never match my table.
+type filteredDigests struct {
+	sync.Mutex
+	digests map[uint64][2]string
+}
+
+// Creates a new, empty set of filtered digests.
+func newFilteredDigests() *filteredDigests {
+	return &filteredDigests{digests: make(map[uint64][2]string)}
+}
+
+// Set records that a site synced the sent digest, of which only the services
+// with the kept digest were applied.
+func (fd *filteredDigests) Set(meta Site, sent, kept string) {
+	fd.Lock()
+	defer fd.Unlock()
+	fd.digests[hashOf(meta)] = [2]string{sent, kept}
+}
+
+// Kept returns the digest of the services that were applied the last time a
+// site synced the given digest, or the digest itself if nothing was left out.
+func (fd *filteredDigests) Kept(meta Site, sent string) string {
+	fd.Lock()
+	defer fd.Unlock()
+	if digests, found := fd.digests[hashOf(meta)]; found && digests[0] == sent {
+		return digests[1]
+	}
+	return sent
+}
+
+// Forget drops the digests recorded for a site.
+func (fd *filteredDigests) Forget(meta Site) {
+	fd.Lock()
+	defer fd.Unlock()
+	delete(fd.digests, hashOf(meta))
+}
+
+// Returns the names of the services currently running at this edge site.
+func (e *Edge) localServices() []string {
+	values := e.services.Values()
+	services := make([]string, 0, len(values))
+	for _, val := range values {
+		services = append(services, val.(string))
+	}
+	return services
+}
+
+// Returns a sync of a site that carries its full set of services: mine, or
+// the ones my table holds for a site beneath me.
+func (e *Edge) fullSync(sync ServiceTableSync) ServiceTableSync {
+	if sync.Meta.ID == e.siteID {
+		sync.Generation = e.currentGeneration()
+		sync.Run = e.run
+		sync.Services = e.localServices()
+	} else {
+		sync.Services = e.table.ServicesOf(sync.Meta)
+	}
+	sync.Digest = digestServices(sync.Services)
+	sync.Full = true
+	return sync
+}
+
+// Sends a sync to an upstream, following up with the full set of services if
+// the upstream's view of the site doesn't match the digest. Over a session,
+// the upstream asks for them with a message of its own instead.
+func (e *Edge) sendSync(p *Proxy, sync ServiceTableSync) error {
+	err := p.sendSync(sync)
+	if err == errSyncNeedsServices && !sync.Full {
+		return p.sendSync(e.fullSync(sync))
+	}
+	return err
+}
+
+// Periodically sends a digest of the local services to every upstream.
+func (e *Edge) startSyncing() {
+	if e.syncInterval <= 0 || len(e.proxies) == 0 {
+		return
+	}
+	e.syncStop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(e.syncInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sync := ServiceTableSync{
+					Meta:       e.site,
+					Generation: e.currentGeneration(),
+					Run:        e.run,
+				}
+				sync.Digest = digestServices(e.localServices())
+				for _, p := range e.proxies {
+					if err := e.sendSync(p, sync); err != nil {
+						log.Errorf("unable to sync services with upstream %s: %v", p.addr, err)
+					}
+				}
+			case <-e.syncStop:
+				return
+			}
+		}
+	}()
+}
+
+// Stops syncing with upstreams.
+func (e *Edge) stopSyncing() {
+	if e.syncStop != nil {
+		close(e.syncStop)
+	}
+}
+
+// Parse incoming syncs from edge sites, replacing everything the table knows
+// about the site if it has drifted. Digests that don't match are answered
+// with a conflict, to ask for the full set of services.
+func (e *Edge) parseTableSync(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	jsn, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Errorln("error while reading table sync:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	sync := ServiceTableSync{}
+	if err = json.Unmarshal(jsn, &sync); err != nil {
+		log.Errorln("error while unmarshalling JSON into table sync struct:", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err = e.applySync(identityFrom(r.Context()), sync); err == errSyncNeedsServices {
+		w.WriteHeader(http.StatusConflict)
+	} else if err == errSyncDigestMismatch {
+		log.Errorf("%v from %s", err, sync.Meta.IP)
+		w.WriteHeader(http.StatusBadRequest)
+	} else if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+	}
+}
+
+// Checks a sync pushed by the edge site with the given identity against my
+// view of the site, and relays it further upstream. A digest that doesn't
+// match fails with errSyncNeedsServices, and the full set of services that
+// follows replaces everything I know about the site, apart from services that
+// have seen events newer than the sync. Like events in a batch, services the
+// pushing site may not register are left out. Syncs from before the site
+// last restarted are ignored.
+func (e *Edge) applySync(identity string, sync ServiceTableSync) error {
+	if err := e.authorizeSite(identity, sync.Meta); err != nil {
+		return err
+	}
+	if !e.generations.CheckRun(sync.Meta, sync.Run) {
+		log.Debugf("ignoring sync from an earlier run of site %s", sync.Meta.IP)
+		return nil
+	}
+	current := e.table.ServicesOf(sync.Meta)
+	inSync := digestServices(current) == e.filteredDigests.Kept(sync.Meta, sync.Digest) && !e.table.Expiring(sync.Meta)
+	if !sync.Full {
+		if !inSync {
+			log.Debugf("table drifted from site %s (%s), asking for its services", sync.Meta.ID, sync.Meta.IP)
+			return errSyncNeedsServices
+		}
+		e.generations.AdvanceSite(sync.Meta, sync.Generation)
+		e.table.ConfirmSite(sync.Meta)
+		e.leases.Renew(sync.Meta)
+		e.relaySync(sync)
+		return nil
+	}
+	if digestServices(sync.Services) != sync.Digest {
+		return errSyncDigestMismatch
+	}
+	allowed := make([]string, 0, len(sync.Services))
+	for _, serviceName := range sync.Services {
+		if e.authorizeService(identity, sync.Meta, serviceName) == nil {
+			allowed = append(allowed, serviceName)
+		}
+	}
+	if len(allowed) < len(sync.Services) {
+		e.filteredDigests.Set(sync.Meta, sync.Digest, digestServices(allowed))
+	} else {
+		e.filteredDigests.Forget(sync.Meta)
+	}
+	sync.Services = allowed
+	services := e.syncedServices(sync, current)
+	e.generations.AdvanceSite(sync.Meta, sync.Generation)
+	if digestServices(services) == digestServices(current) && !e.table.Expiring(sync.Meta) {
+		e.table.ConfirmSite(sync.Meta)
+	} else {
+		log.Infof("table drifted from site %s (%s), replacing its %d services", sync.Meta.ID, sync.Meta.IP, len(services))
+		e.table.ReplaceSite(sync.Meta, services)
+	}
+	e.leases.Renew(sync.Meta)
+	e.relaySync(sync)
+	return nil
+}
+
+// Works out the services of a site after a full sync, one service at a time:
+// each takes its state from the sync, unless an event newer than the sync has
+// already been applied to it, in which case it keeps its current state.
+func (e *Edge) syncedServices(sync ServiceTableSync, current []string) []string {
+	listed := make(map[string]bool, len(sync.Services))
+	for _, serviceName := range sync.Services {
+		listed[serviceName] = true
+	}
+	running := make(map[string]bool, len(current))
+	for _, serviceName := range current {
+		running[serviceName] = true
+	}
+	var services []string
+	decide := func(serviceName string) {
+		state := running[serviceName]
+		if e.generations.Advance(sync.Meta, serviceName, sync.Generation) {
+			state = listed[serviceName]
+		}
+		if state {
+			services = append(services, serviceName)
+		}
+	}
+	for serviceName := range listed {
+		decide(serviceName)
+	}
+	for serviceName := range running {
+		if !listed[serviceName] {
+			decide(serviceName)
+		}
+	}
+	return services
+}
+
+// Serves the full state of the table.
+func (e *Edge) serveTableSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot := ServiceTableSnapshot{
+		Meta:  e.site,
+		Table: e.table.Snapshot(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(snapshot); err != nil {
+		log.Errorln("error while writing table snapshot:", err)
+	}
+}
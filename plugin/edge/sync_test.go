@@ -0,0 +1,175 @@
+package edge
+
+import (
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestApplySync(t *testing.T) {
+	e := New()
+	site := Site{ID: "downstream", IP: net.ParseIP("10.0.0.1")}
+	services := []string{"default/a", "default/b"}
+
+	// A digest the table doesn't match asks for the full set of services.
+	sync := ServiceTableSync{Meta: site, Digest: digestServices(services)}
+	if err := e.applySync("", sync); err != errSyncNeedsServices {
+		t.Fatalf("Expected %v, got %v", errSyncNeedsServices, err)
+	}
+
+	// Which then replace the site's entries.
+	full := sync
+	full.Services = services
+	full.Full = true
+	if err := e.applySync("", full); err != nil {
+		t.Fatal(err)
+	}
+	got := e.table.ServicesOf(site)
+	sort.Strings(got)
+	if len(got) != 2 || got[0] != "default/a" || got[1] != "default/b" {
+		t.Errorf("Expected %v, got %v", services, got)
+	}
+
+	// After which the digest alone is enough.
+	if err := e.applySync("", sync); err != nil {
+		t.Errorf("Expected matching digest to be accepted, got %v", err)
+	}
+
+	// Full syncs must match their own digest.
+	full.Services = services[:1]
+	if err := e.applySync("", full); err != errSyncDigestMismatch {
+		t.Errorf("Expected %v, got %v", errSyncDigestMismatch, err)
+	}
+}
+
+func TestFullSync(t *testing.T) {
+	e := New()
+	e.siteID = "me"
+	e.services.Add("default/mine")
+	child := Site{ID: "child", IP: net.ParseIP("10.0.0.2")}
+	e.table.Add(child, "default/theirs")
+
+	own := e.fullSync(ServiceTableSync{Meta: Site{ID: "me"}})
+	if !own.Full || len(own.Services) != 1 || own.Services[0] != "default/mine" {
+		t.Errorf("Expected my own services, got %+v", own)
+	}
+	relayed := e.fullSync(ServiceTableSync{Meta: child})
+	if len(relayed.Services) != 1 || relayed.Services[0] != "default/theirs" {
+		t.Errorf("Expected the child's services from the table, got %+v", relayed)
+	}
+	if relayed.Digest != digestServices(relayed.Services) {
+		t.Error("Expected the digest to match the services")
+	}
+}
+
+func TestApplySyncGeneration(t *testing.T) {
+	e := New()
+	site := Site{ID: "downstream", IP: net.ParseIP("10.0.0.1")}
+
+	// A sync at generation 10 says only a is running.
+	sync := ServiceTableSync{Meta: site, Services: []string{"default/a"}, Full: true, Generation: 10}
+	sync.Digest = digestServices(sync.Services)
+	if err := e.applySync("", sync); err != nil {
+		t.Fatal(err)
+	}
+
+	// An older batch adding b arrives late, and is discarded.
+	e.applyBatch("", ServiceTableBatch{Meta: site, Events: []ServiceEvent{{Type: Add, Service: "default/b", Generation: 9}}})
+	if services := e.table.ServicesOf(site); len(services) != 1 {
+		t.Errorf("Expected the stale batch to be discarded, got %v", services)
+	}
+
+	// A newer event for c survives an older sync that doesn't list it.
+	e.applyBatch("", ServiceTableBatch{Meta: site, Events: []ServiceEvent{{Type: Add, Service: "default/c", Generation: 20}}})
+	sync.Generation = 15
+	if err := e.applySync("", sync); err != nil {
+		t.Fatal(err)
+	}
+	services := e.table.ServicesOf(site)
+	sort.Strings(services)
+	if len(services) != 2 || services[1] != "default/c" {
+		t.Errorf("Expected a and c, got %v", services)
+	}
+}
+
+func TestApplySyncRestart(t *testing.T) {
+	e := New()
+	site := Site{ID: "downstream", IP: net.ParseIP("10.0.0.1")}
+
+	// The site's first run gets as far as generation 1000.
+	sync := ServiceTableSync{Meta: site, Services: []string{"default/a"}, Full: true, Generation: 1000, Run: "run-1"}
+	sync.Digest = digestServices(sync.Services)
+	if err := e.applySync("", sync); err != nil {
+		t.Fatal(err)
+	}
+
+	// It restarts with its clock behind, so its new generations are lower,
+	// but they're counted afresh since the run changed.
+	e.applyBatch("", ServiceTableBatch{Meta: site, Run: "run-2", Events: []ServiceEvent{{Type: Add, Service: "default/b", Generation: 10}}})
+	if services := e.table.ServicesOf(site); len(services) != 2 {
+		t.Errorf("Expected the event from the new run to be applied, got %v", services)
+	}
+
+	// A full sync from the new run repairs anything that drifted.
+	sync = ServiceTableSync{Meta: site, Services: []string{"default/b"}, Full: true, Generation: 20, Run: "run-2"}
+	sync.Digest = digestServices(sync.Services)
+	if err := e.applySync("", sync); err != nil {
+		t.Fatal(err)
+	}
+	if services := e.table.ServicesOf(site); len(services) != 1 || services[0] != "default/b" {
+		t.Errorf("Expected only b after the sync, got %v", services)
+	}
+
+	// A batch from the first run replayed late is dropped, however new its
+	// generations look.
+	e.applyBatch("", ServiceTableBatch{Meta: site, Run: "run-1", Events: []ServiceEvent{{Type: Add, Service: "default/c", Generation: 2000}}})
+	if services := e.table.ServicesOf(site); len(services) != 1 {
+		t.Errorf("Expected the batch from the earlier run to be dropped, got %v", services)
+	}
+	e.applyBatch("", ServiceTableBatch{Meta: site, Run: "run-2", Events: []ServiceEvent{{Type: Add, Service: "default/c", Generation: 21}}})
+	if services := e.table.ServicesOf(site); len(services) != 2 {
+		t.Errorf("Expected the new run to carry on, got %v", services)
+	}
+}
+
+func TestApplySyncFiltered(t *testing.T) {
+	e := New()
+	e.authorizationOf("downstream").services = []string{"team-a/*"}
+	site := Site{ID: "downstream", IP: net.ParseIP("10.0.0.1")}
+	services := []string{"a.team-a" + serviceExtension, "b.team-b" + serviceExtension}
+
+	// Services the site may not register are left out, rather than failing
+	// the whole sync.
+	full := ServiceTableSync{Meta: site, Services: services, Digest: digestServices(services), Full: true}
+	if err := e.applySync("downstream", full); err != nil {
+		t.Fatal(err)
+	}
+	got := e.table.ServicesOf(site)
+	if len(got) != 1 || got[0] != services[0] {
+		t.Errorf("Expected only %s, got %v", services[0], got)
+	}
+
+	// And the site's digest keeps matching the services that were kept.
+	sync := ServiceTableSync{Meta: site, Digest: digestServices(services)}
+	if err := e.applySync("downstream", sync); err != nil {
+		t.Errorf("Expected digest of the filtered sync to be accepted, got %v", err)
+	}
+}
+
+func TestApplySyncConfirms(t *testing.T) {
+	e := New()
+	site := Site{ID: "downstream", IP: net.ParseIP("10.0.0.1")}
+	e.table.Add(site, "default/a")
+	added := e.table.Entries()["default/a"][0].Updated
+
+	// A sync matching the table confirms its entries.
+	time.Sleep(10 * time.Millisecond)
+	sync := ServiceTableSync{Meta: site, Digest: digestServices([]string{"default/a"})}
+	if err := e.applySync("", sync); err != nil {
+		t.Fatal(err)
+	}
+	if confirmed := e.table.Entries()["default/a"][0].Updated; !confirmed.After(added) {
+		t.Errorf("Expected the entry to be confirmed after %s, got %s", added, confirmed)
+	}
+}
@@ -20,11 +20,16 @@
 
 package edge
 
-import "github.com/miekg/dns"
+import (
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
 
 // truncated looks at the error and if truncated return a nil errror
 // and a possible reconstructed dns message if that was nil.
-func truncated(ret *dns.Msg, err error) (*dns.Msg, error) {
+func truncated(state request.Request, ret *dns.Msg, err error) (*dns.Msg, error) {
 
 	// If you query for instance ANY isc.org; you get a truncated query back which miekg/dns fails to unpack
 	// because the RRs are not finished. The returned message can be useful or useless. Return the original
@@ -37,7 +42,7 @@ func truncated(ret *dns.Msg, err error) (*dns.Msg, error) {
 	m := ret
 	if ret == nil {
 		m = new(dns.Msg)
-		m.SetReply(ret)
+		m.SetReply(state.Req)
 		m.Truncated = true
 		m.Authoritative = true
 		m.Rcode = dns.RcodeSuccess
@@ -45,3 +50,30 @@ func truncated(ret *dns.Msg, err error) (*dns.Msg, error) {
 
 	return m, nil
 }
+
+// retryTruncated re-issues a UDP query to the same upstream over TCP when the
+// reply came back truncated and the client could have taken more than the
+// upstream sent. The original reply is returned if no retry is needed or if
+// the retry fails.
+func (p *Proxy) retryTruncated(ctx context.Context, state request.Request, res *dns.Msg) *dns.Msg {
+	if res == nil || !res.Truncated || state.Proto() != "udp" {
+		return res
+	}
+	TruncatedCount.WithLabelValues(p.addr).Inc()
+
+	// The client won't get anything more out of a TCP answer than what fits
+	// in its buffer, so only retry if the truncated reply is smaller than that.
+	if res.Len() >= state.Size() {
+		return res
+	}
+
+	ret, err := p.connect(ctx, state, true, true)
+	if err != nil {
+		TCPRetryCount.WithLabelValues(p.addr, "failure").Inc()
+		log.Debugf("tcp retry of truncated reply from %s failed (%v)", p.addr, err)
+		return res
+	}
+	TCPRetryCount.WithLabelValues(p.addr, "success").Inc()
+	log.Debugf("retried truncated reply from %s over tcp", p.addr)
+	return ret
+}
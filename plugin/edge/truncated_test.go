@@ -0,0 +1,152 @@
+package edge
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"golang.org/x/net/context"
+)
+
+// Starts a DNS server that truncates every reply over UDP, and answers with
+// a single A record over TCP.
+func newTruncatingServer() *dnstest.Server {
+	return dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		if _, udp := w.RemoteAddr().(*net.UDPAddr); udp {
+			ret.Truncated = true
+		} else {
+			ret.Answer = append(ret.Answer, test.A("example.org. 5 IN A 10.0.0.1"))
+		}
+		w.WriteMsg(ret)
+	})
+}
+
+// tcpResponseWriter is a test.ResponseWriter for a client connected over TCP.
+type tcpResponseWriter struct{ test.ResponseWriter }
+
+func (t *tcpResponseWriter) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.ParseIP("10.240.0.1"), Port: 40212}
+}
+
+// Returns the current value of a counter.
+func counterValue(c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	c.Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestRetryTruncated(t *testing.T) {
+	s := newTruncatingServer()
+	defer s.Close()
+
+	p := NewProxy(s.Addr, nil /* no TLS */)
+	p.transport.Start()
+	defer p.transport.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+	truncatedCount := counterValue(TruncatedCount.WithLabelValues(p.addr))
+	success := counterValue(TCPRetryCount.WithLabelValues(p.addr, "success"))
+
+	// The truncated UDP reply is retried over TCP.
+	res, err := p.connect(context.Background(), state, false, false)
+	if res, err = truncated(state, res, err); err != nil {
+		t.Fatal(err)
+	}
+	if !res.Truncated {
+		t.Fatal("Expected a truncated reply over UDP")
+	}
+	ret := p.retryTruncated(context.Background(), state, res)
+	if ret.Truncated || len(ret.Answer) != 1 {
+		t.Errorf("Expected the full reply over TCP, got %v", ret)
+	}
+	if n := counterValue(TruncatedCount.WithLabelValues(p.addr)); n != truncatedCount+1 {
+		t.Errorf("Expected the truncated count to go up by 1, got %f", n-truncatedCount)
+	}
+	if n := counterValue(TCPRetryCount.WithLabelValues(p.addr, "success")); n != success+1 {
+		t.Errorf("Expected the successful retry count to go up by 1, got %f", n-success)
+	}
+}
+
+func TestRetryTruncatedSizeGate(t *testing.T) {
+	p := NewProxy("127.0.0.1:1", nil /* no TLS */)
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+	// A truncated reply that already fills the client's buffer isn't retried,
+	// since the client couldn't take any more anyway.
+	res := new(dns.Msg)
+	res.SetReply(m)
+	res.Truncated = true
+	for res.Len() < state.Size() {
+		res.Answer = append(res.Answer, test.A("example.org. 5 IN A 10.0.0.1"))
+	}
+	failure := counterValue(TCPRetryCount.WithLabelValues(p.addr, "failure"))
+	if ret := p.retryTruncated(context.Background(), state, res); ret != res {
+		t.Errorf("Expected the truncated reply to be returned as is, got %v", ret)
+	}
+	if n := counterValue(TCPRetryCount.WithLabelValues(p.addr, "failure")); n != failure {
+		t.Errorf("Expected no retry, got %f failures", n-failure)
+	}
+
+	// Neither is a reply over TCP.
+	tcp := request.Request{W: &tcpResponseWriter{}, Req: m}
+	res.Answer = nil
+	if ret := p.retryTruncated(context.Background(), tcp, res); ret != res {
+		t.Errorf("Expected the reply over TCP to be returned as is, got %v", ret)
+	}
+}
+
+func TestRetryTruncatedFailure(t *testing.T) {
+	// Nothing listens on the upstream, so the retry fails and the truncated
+	// reply is handed back.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	p := NewProxy(addr, nil /* no TLS */)
+	p.transport.Start()
+	defer p.transport.Stop()
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+	res := new(dns.Msg)
+	res.SetReply(m)
+	res.Truncated = true
+
+	failure := counterValue(TCPRetryCount.WithLabelValues(p.addr, "failure"))
+	if ret := p.retryTruncated(context.Background(), state, res); ret != res {
+		t.Errorf("Expected the truncated reply back, got %v", ret)
+	}
+	if n := counterValue(TCPRetryCount.WithLabelValues(p.addr, "failure")); n != failure+1 {
+		t.Errorf("Expected the failed retry count to go up by 1, got %f", n-failure)
+	}
+}
+
+func TestTruncatedWithoutReply(t *testing.T) {
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	state := request.Request{W: &test.ResponseWriter{}, Req: m}
+
+	// Without a reply to go on, one is made up for the client to retry.
+	ret, err := truncated(state, nil, dns.ErrTruncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ret.Truncated || ret.Id != m.Id {
+		t.Errorf("Expected a truncated reply to %d, got %v", m.Id, ret)
+	}
+}
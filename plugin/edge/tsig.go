@@ -0,0 +1,78 @@
+package edge
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The allowed clock skew, in seconds, between signing and verifying edge sites.
+const tsigFudge = 300
+
+// tsigKey is a shared secret used to sign requests between edge sites.
+type tsigKey struct {
+	name      string
+	algorithm string
+	secret    string
+}
+
+// Creates a new TSIG key, normalizing the key and algorithm names.
+func newTsigKey(name, algorithm, secret string) (*tsigKey, error) {
+	algorithm = dns.Fqdn(strings.ToLower(algorithm))
+	switch algorithm {
+	case dns.HmacMD5, dns.HmacSHA1, dns.HmacSHA256, dns.HmacSHA512:
+	default:
+		return nil, errInvalidTsigAlgorithm
+	}
+	if _, err := base64.StdEncoding.DecodeString(secret); err != nil {
+		return nil, errInvalidTsigSecret
+	}
+	return &tsigKey{
+		name:      dns.Fqdn(strings.ToLower(name)),
+		algorithm: algorithm,
+		secret:    secret,
+	}, nil
+}
+
+// Returns a signed copy of the message, ready to be written to a connection
+// that knows the key's secret.
+func (k *tsigKey) sign(m *dns.Msg) *dns.Msg {
+	signed := m.Copy()
+	signed.SetTsig(k.name, k.algorithm, tsigFudge, time.Now().Unix())
+	return signed
+}
+
+// Verifies and strips the TSIG record from a request forwarded by a
+// downstream edge site. Returns true if the request may be trusted, which is
+// when it was validly signed with one of the downstream keys, or when
+// insecure_downstream is set.
+func (e *Edge) verifyTsig(r *dns.Msg) bool {
+	t := r.IsTsig()
+	if t == nil {
+		return e.insecureDownstream
+	}
+
+	// Verify the signature over the request as it was received, before
+	// anything is removed from it.
+	verified := false
+	if key, found := e.downstreamKeys[strings.ToLower(t.Hdr.Name)]; found {
+		buf, err := r.Pack()
+		if err == nil {
+			err = dns.TsigVerify(buf, key.secret, "", false)
+		}
+		if err != nil {
+			log.Errorf("invalid TSIG signature from key %s (%v)", t.Hdr.Name, err)
+		} else {
+			verified = true
+		}
+	} else {
+		log.Errorf("request signed with unknown TSIG key %s", t.Hdr.Name)
+	}
+
+	// Strip the TSIG record, which is always the last one in Extra.
+	r.Extra = r.Extra[:len(r.Extra)-1]
+
+	return verified || e.insecureDownstream
+}
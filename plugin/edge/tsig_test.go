@@ -0,0 +1,129 @@
+package edge
+
+import (
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+)
+
+const testTsigSecret = "c2VjcmV0LXNoYXJlZC1ieS1lZGdlLXNpdGVz"
+
+// Creates an edge site that trusts requests signed with the given keys.
+func newTsigEdge(keys ...*tsigKey) *Edge {
+	e := New()
+	for _, key := range keys {
+		e.downstreamKeys[key.name] = key
+	}
+	return e
+}
+
+func newTestTsigKey(t *testing.T, name, secret string) *tsigKey {
+	key, err := newTsigKey(name, "HMAC-SHA256", secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Signs a request with the given key and returns it as the receiving edge
+// site would parse it off the wire.
+func signedRequest(t *testing.T, key *tsigKey, tamper func(*dns.Msg)) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetQuestion("svc.default.svc.cluster.external.", dns.TypeA)
+	insertLocation(m, edgeLocation{Location: Location{Point: NewPoint(1, 2)}, SiteID: "edge-1"})
+	buf, _, err := dns.TsigGenerate(key.sign(m), key.secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := new(dns.Msg)
+	if err := r.Unpack(buf); err != nil {
+		t.Fatal(err)
+	}
+	if tamper != nil {
+		tamper(r)
+	}
+	return r
+}
+
+func TestVerifyTsig(t *testing.T) {
+	key := newTestTsigKey(t, "edge-1.", testTsigSecret)
+	other := newTestTsigKey(t, "edge-1.", "b3RoZXItc2VjcmV0")
+	unknown := newTestTsigKey(t, "edge-2.", testTsigSecret)
+
+	tests := []struct {
+		name     string
+		r        *dns.Msg
+		insecure bool
+		trusted  bool
+	}{
+		{"valid", signedRequest(t, key, nil), false, true},
+		{"valid with insecure_downstream", signedRequest(t, key, nil), true, true},
+		{"wrong secret", signedRequest(t, other, nil), false, false},
+		{"unknown key", signedRequest(t, unknown, nil), false, false},
+		{"tampered", signedRequest(t, key, func(r *dns.Msg) { r.Question[0].Name = "other.external." }), false, false},
+		{"unsigned", signedRequest(t, key, func(r *dns.Msg) { r.Extra = r.Extra[:len(r.Extra)-1] }), false, false},
+		{"unsigned with insecure_downstream", signedRequest(t, key, func(r *dns.Msg) { r.Extra = r.Extra[:len(r.Extra)-1] }), true, true},
+	}
+	for _, test := range tests {
+		e := newTsigEdge(key)
+		e.insecureDownstream = test.insecure
+		if trusted := e.verifyTsig(test.r); trusted != test.trusted {
+			t.Errorf("%s: expected trusted to be %v, got %v", test.name, test.trusted, trusted)
+		}
+
+		// The TSIG record is always stripped, and only it.
+		if test.r.IsTsig() != nil {
+			t.Errorf("%s: expected the TSIG record to be stripped", test.name)
+		}
+		if _, found := extractLocation(test.r); !found {
+			t.Errorf("%s: expected the location option to be left alone", test.name)
+		}
+	}
+}
+
+func TestVerifyTsigNoKeys(t *testing.T) {
+	// Without downstream keys, nothing is trusted unless asked for.
+	e := New()
+	if e.verifyTsig(signedRequest(t, newTestTsigKey(t, "edge-1.", testTsigSecret), nil)) {
+		t.Error("Expected requests not to be trusted without downstream keys")
+	}
+}
+
+func TestVerifyTsigPipelined(t *testing.T) {
+	key := newTestTsigKey(t, "edge-1.", testTsigSecret)
+	e := newTsigEdge(key)
+
+	// The pipeline sends the query under a connection-local ID, after the TSIG
+	// record was added, so the signature has to cover the ID it's sent with.
+	trusted := make(chan bool, 1)
+	s := dnstest.NewServer(func(w dns.ResponseWriter, r *dns.Msg) {
+		trusted <- e.verifyTsig(r)
+		ret := new(dns.Msg)
+		ret.SetReply(r)
+		w.WriteMsg(ret)
+	})
+	defer s.Close()
+
+	tr := newTransport(s.Addr, nil /* no TLS */)
+	tr.SetTsigSecret(map[string]string{key.name: key.secret})
+	tr.Start()
+	defer tr.Stop()
+	pl := newPipeline(tr, defaultPipelineConns, defaultPipelineInFlight)
+	defer pl.close()
+
+	m := new(dns.Msg)
+	m.SetQuestion("svc.default.svc.cluster.external.", dns.TypeA)
+	m.Id = 1234
+	ret, err := pl.Exchange(context.Background(), key.sign(m))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ret.Id != m.Id {
+		t.Errorf("Expected reply ID %d, got %d", m.Id, ret.Id)
+	}
+	if !<-trusted {
+		t.Error("Expected the pipelined request to verify")
+	}
+}